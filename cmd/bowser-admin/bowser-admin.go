@@ -0,0 +1,374 @@
+package main
+
+/*
+	This tool manages the accounts file directly, for everything that would
+	otherwise mean hand-editing JSON. Changes only apply to a running bowser
+	once it reloads its accounts (SIGHUP). broadcast is the exception, it talks
+	to the running bowser through its HTTP API.
+*/
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/b1naryth1ef/bowser/lib"
+	"github.com/mdp/qrterminal"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var configPath = flag.String("config", "config.json", "path to config file")
+
+const usage = `usage: bowser-admin [-config path] <command> [args]
+
+commands:
+  list                           list accounts
+  show <username>                print an account as json
+  add                            add an account read as json from stdin
+  edit <username> [flags]        change account settings (see bowser-admin edit -h)
+  disable <username>             archive an account, rejecting its keys
+  enable <username>              restore an archived account
+  delete <username>              remove an account
+  add-key <username> <file>      add an ssh public key from a file
+  remove-key <username> <fp>     remove an ssh key by its SHA256 fingerprint
+  rotate-totp <username>         generate a new TOTP secret
+  seal-totp                      seal existing TOTP secrets with the totp master key
+  validate                       check the accounts file for problems
+  import <file>                  copy groups and accounts from an accounts file into
+                                 the configured backend (e.g. sql)
+  broadcast <message>            write a message into every active interactive
+                                 session (requires the HTTP API)
+`
+
+func fail(format string, args ...interface{}) {
+	fmt.Printf(format+"\n", args...)
+	os.Exit(1)
+}
+
+func loadAccounts(config *bowser.Config) []bowser.Account {
+	accounts, err := config.LoadAccounts()
+	if err != nil {
+		fail("Failed to load accounts: %v", err)
+	}
+	return accounts
+}
+
+func saveAccounts(config *bowser.Config, accounts []bowser.Account) {
+	err := config.SaveAccounts(accounts)
+	if err != nil {
+		fail("Failed to save accounts: %v", err)
+	}
+	fmt.Printf("Saved accounts, send SIGHUP to bowser to apply the change\n")
+}
+
+// Finds an account by username, exiting if it doesn't exist
+func findAccount(accounts []bowser.Account, username string) *bowser.Account {
+	for i := range accounts {
+		if accounts[i].Username == username {
+			return &accounts[i]
+		}
+	}
+
+	fail("No account named %s", username)
+	return nil
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+func list(config *bowser.Config) {
+	for _, account := range loadAccounts(config) {
+		status := "active"
+		if account.ArchivedAt != nil {
+			status = "archived " + account.ArchivedAt.Format(time.RFC3339)
+		} else if account.ExpiresAt != nil {
+			status = "expires " + account.ExpiresAt.Format(time.RFC3339)
+		}
+
+		fmt.Printf("%s\t%d keys\tgroups=%s\t%s\n", account.Username, len(account.SSHKeysRaw), strings.Join(account.Groups, ","), status)
+	}
+}
+
+func add(config *bowser.Config) {
+	var account bowser.Account
+	err := json.NewDecoder(os.Stdin).Decode(&account)
+	if err != nil {
+		fail("Failed to decode account: %v", err)
+	}
+
+	accounts := loadAccounts(config)
+	for _, existing := range accounts {
+		if existing.Username == account.Username {
+			fail("Account %s already exists", account.Username)
+		}
+	}
+
+	saveAccounts(config, append(accounts, account))
+}
+
+func edit(config *bowser.Config, username string, args []string) {
+	flags := flag.NewFlagSet("edit", flag.ExitOnError)
+	whitelist := flags.String("whitelist", "", "whitelist regex")
+	blacklist := flags.String("blacklist", "", "blacklist regex")
+	allowTags := flags.String("allow-tags", "", "comma separated allowed tags")
+	denyTags := flags.String("deny-tags", "", "comma separated denied tags")
+	groups := flags.String("groups", "", "comma separated groups")
+	principals := flags.String("principals", "", "comma separated certificate principals")
+	forceUser := flags.String("force-user", "", "username to force on issued certificates")
+	expiresAt := flags.String("expires-at", "", "RFC3339 expiry date, or empty to clear it")
+	flags.Parse(args)
+
+	accounts := loadAccounts(config)
+	account := findAccount(accounts, username)
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "whitelist":
+			account.Whitelist = *whitelist
+		case "blacklist":
+			account.Blacklist = *blacklist
+		case "allow-tags":
+			account.AllowTags = splitList(*allowTags)
+		case "deny-tags":
+			account.DenyTags = splitList(*denyTags)
+		case "groups":
+			account.Groups = splitList(*groups)
+		case "principals":
+			account.Principals = splitList(*principals)
+		case "force-user":
+			account.ForceUser = *forceUser
+		case "expires-at":
+			if *expiresAt == "" {
+				account.ExpiresAt = nil
+				return
+			}
+
+			expires, err := time.Parse(time.RFC3339, *expiresAt)
+			if err != nil {
+				fail("Invalid expiry date: %v", err)
+			}
+			account.ExpiresAt = &expires
+		}
+	})
+
+	saveAccounts(config, accounts)
+}
+
+func setArchived(config *bowser.Config, username string, archived bool) {
+	accounts := loadAccounts(config)
+	account := findAccount(accounts, username)
+
+	if archived {
+		now := time.Now().UTC()
+		account.ArchivedAt = &now
+	} else {
+		account.ArchivedAt = nil
+	}
+
+	saveAccounts(config, accounts)
+}
+
+func remove(config *bowser.Config, username string) {
+	accounts := loadAccounts(config)
+	findAccount(accounts, username)
+
+	var remaining []bowser.Account
+	for _, account := range accounts {
+		if account.Username != username {
+			remaining = append(remaining, account)
+		}
+	}
+
+	saveAccounts(config, remaining)
+}
+
+func addKey(config *bowser.Config, username, path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fail("Failed to read key: %v", err)
+	}
+
+	raw := strings.TrimSpace(string(data))
+	if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(raw)); err != nil {
+		fail("Failed to parse key: %v", err)
+	}
+
+	accounts := loadAccounts(config)
+	account := findAccount(accounts, username)
+	account.SSHKeysRaw = append(account.SSHKeysRaw, raw)
+	saveAccounts(config, accounts)
+}
+
+func removeKey(config *bowser.Config, username, fingerprint string) {
+	accounts := loadAccounts(config)
+	account := findAccount(accounts, username)
+
+	var remaining []string
+	for _, raw := range account.SSHKeysRaw {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(raw))
+		if err == nil && ssh.FingerprintSHA256(key) == fingerprint {
+			continue
+		}
+		remaining = append(remaining, raw)
+	}
+
+	if len(remaining) == len(account.SSHKeysRaw) {
+		fail("Account %s has no key with fingerprint %s", username, fingerprint)
+	}
+
+	account.SSHKeysRaw = remaining
+	saveAccounts(config, accounts)
+}
+
+// TOTP secrets are encrypted with the users password, so rotating one needs it
+func rotateTOTP(config *bowser.Config, username string) {
+	accounts := loadAccounts(config)
+	account := findAccount(accounts, username)
+
+	fmt.Printf("Password for %s: ", username)
+	password, err := terminal.ReadPassword(0)
+	fmt.Printf("\n")
+	if err != nil {
+		fail("Failed to read password: %v", err)
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(account.Password), password) != nil {
+		fail("Incorrect password")
+	}
+
+	totpRaw := make([]byte, 32)
+	if _, err := rand.Read(totpRaw); err != nil {
+		fail("Failed to generate TOTP token: %v", err)
+	}
+	totpEncoded := base32.StdEncoding.EncodeToString(totpRaw)[:16]
+
+	qrterminal.Generate(fmt.Sprintf("otpauth://totp/SSH:%s?secret=%s", username, totpEncoded), qrterminal.H, os.Stdout)
+	fmt.Printf("Please scan the above QR code with your TOTP app (or enter manually: `%s`)", totpEncoded)
+	bufio.NewReader(os.Stdin).ReadString('\n')
+
+	totpEncrypted, err := bowser.EncryptTOTP(password, []byte(username), []byte(totpEncoded))
+	if err != nil {
+		fail("Failed to encrypt TOTP token: %v", err)
+	}
+
+	account.MFA.TOTP = string(totpEncrypted)
+	saveAccounts(config, accounts)
+}
+
+func validate(config *bowser.Config) {
+	problems := config.ValidateAccounts()
+	for _, problem := range problems {
+		fmt.Printf("%v\n", problem)
+	}
+
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("Accounts file is valid\n")
+}
+
+// Broadcasts a message through the running bowser's HTTP API
+func broadcast(config *bowser.Config, message string) {
+	data, err := bowser.AdminRequestJSON(config, "POST", "/broadcast", map[string]string{"message": message})
+	if err != nil {
+		fail("Failed to broadcast: %v", err)
+	}
+
+	var result struct {
+		Delivered []string `json:"delivered"`
+		Skipped   int      `json:"skipped"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		fail("Failed to decode response: %v", err)
+	}
+
+	for _, id := range result.Delivered {
+		fmt.Printf("Delivered to %s\n", id)
+	}
+	fmt.Printf("Delivered to %d sessions, %d sessions have no terminal\n", len(result.Delivered), result.Skipped)
+}
+
+func main() {
+	flag.Usage = func() { fmt.Print(usage) }
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config, err := bowser.LoadConfig(*configPath)
+	if err != nil {
+		fail("Failed to load config: %v", err)
+	}
+
+	// Every command but list, add, seal-totp and validate needs a username
+	command, args := args[0], args[1:]
+	if command != "list" && command != "add" && command != "seal-totp" && command != "validate" && len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch command {
+	case "list":
+		list(config)
+	case "show":
+		data, _ := json.MarshalIndent(findAccount(loadAccounts(config), args[0]), "", "  ")
+		fmt.Printf("%s\n", data)
+	case "add":
+		add(config)
+	case "edit":
+		edit(config, args[0], args[1:])
+	case "disable":
+		setArchived(config, args[0], true)
+	case "enable":
+		setArchived(config, args[0], false)
+	case "delete":
+		remove(config, args[0])
+	case "add-key", "remove-key":
+		if len(args) != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+
+		if command == "add-key" {
+			addKey(config, args[0], args[1])
+		} else {
+			removeKey(config, args[0], args[1])
+		}
+	case "rotate-totp":
+		rotateTOTP(config, args[0])
+	case "seal-totp":
+		count, err := config.SealTOTPSecrets()
+		if err != nil {
+			fail("Failed to seal TOTP secrets: %v", err)
+		}
+		fmt.Printf("Sealed %d TOTP secrets\n", count)
+	case "validate":
+		validate(config)
+	case "import":
+		if err := config.ImportAccounts(args[0]); err != nil {
+			fail("Failed to import accounts: %v", err)
+		}
+		fmt.Printf("Imported accounts from %s\n", args[0])
+	case "broadcast":
+		broadcast(config, strings.Join(args, " "))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
@@ -3,51 +3,48 @@ package main
 /*
 	This script is responsible for provisioning and adding user accounts to our
 	configuration. Generally it was meant to be run on the bastion box with the
-	configuration path passed, thus automatically adding the account.
+	configuration path passed, thus automatically adding the account. Passing
+	-username or -stdin-json skips every prompt, for provisioning pipelines.
+
+	Alternatively, invited users can run it on their own machine with an
+	enrollment token minted by an admin, which submits the account to the
+	bowser HTTP API instead.
 */
 
 import (
 	"bufio"
-	"crypto/aes"
-	"crypto/cipher"
+	"bytes"
 	"crypto/rand"
-	"crypto/sha1"
 	"encoding/base32"
-	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"strings"
 
 	"github.com/b1naryth1ef/bowser/lib"
 	"github.com/mdp/qrterminal"
+	"github.com/pquerna/otp/totp"
 	"golang.org/x/crypto/bcrypt"
-	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
 var configPath = flag.String("config", "config.json", "path to config file")
+var enrollURL = flag.String("enroll", "", "bowser API url to enroll against (requires -token)")
+var enrollToken = flag.String("token", "", "enrollment token given to you by an admin")
 
-func encryptTOTP(password []byte, salt []byte, totp []byte) ([]byte, error) {
-	dk := pbkdf2.Key(password, salt, 10000, 32, sha1.New)
-
-	block, err := aes.NewCipher(dk)
-	if err != nil {
-		return nil, err
-	}
-
-	ciphertext := make([]byte, aes.BlockSize+len(totp))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return nil, err
-	}
-
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(ciphertext[aes.BlockSize:], totp)
-
-	return []byte(base64.URLEncoding.EncodeToString(ciphertext)), nil
-}
+// Passing a username (or -stdin-json) switches to non-interactive mode
+var usernameFlag = flag.String("username", "", "account username, creates the account non-interactively")
+var keyFile = flag.String("key-file", "", "path to a file of ssh public keys, one per line")
+var passwordFile = flag.String("password-file", "", "path to a file containing the password (defaults to $BOWSER_PASSWORD)")
+var stdinJSON = flag.Bool("stdin-json", false, "read username, ssh_keys, password and yubikey as json from stdin")
+var yubikeyFlag = flag.String("yubikey", "", "a YubiKey OTP, to register that key")
+var noQR = flag.Bool("no-qr", false, "don't print the TOTP QR code")
+var printURI = flag.Bool("totp-uri", false, "print the TOTP provisioning URI")
 
 func readPassword(attempts int) string {
 	// Create a raw terminal so we can read the password without echo
@@ -75,79 +72,263 @@ func readPassword(attempts int) string {
 	return ""
 }
 
-func main() {
-	flag.Parse()
-	reader := bufio.NewReader(os.Stdin)
+// Submit the account to the bowser API, redeeming our enrollment token
+func enroll(account bowser.Account) error {
+	data, err := json.Marshal(bowser.EnrollRequest{Token: *enrollToken, Account: account})
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimSuffix(*enrollURL, "/") + "/enroll"
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return fmt.Errorf("server returned %d: %s", resp.StatusCode, body.Error)
+	}
+
+	return nil
+}
+
+// Everything we need from the user to create an account
+type accountInput struct {
+	Username string   `json:"username"`
+	SSHKeys  []string `json:"ssh_keys"`
+	Password string   `json:"password"`
+	YubiKey  string   `json:"yubikey"`
+}
+
+func readInteractive(reader *bufio.Reader) (*accountInput, error) {
+	var input accountInput
 
 	// Grab username
 	fmt.Printf("Username: ")
 	username, _ := reader.ReadString('\n')
+	input.Username = strings.TrimSpace(username)
 
 	// Grab SSH Public key
 	fmt.Printf("SSH Public Key: ")
 	sshKey, _ := reader.ReadString('\n')
+	input.SSHKeys = []string{strings.TrimSpace(sshKey)}
 
 	// Grab password
-	password := readPassword(3)
-	if password == "" {
+	input.Password = readPassword(3)
+	if input.Password == "" {
+		return nil, fmt.Errorf("passwords did not match")
+	}
+
+	return &input, nil
+}
+
+// Reads input from flags, the environment, or json on stdin so account creation
+// can be scripted.
+func readNonInteractive() (*accountInput, error) {
+	var input accountInput
+	if *stdinJSON {
+		err := json.NewDecoder(os.Stdin).Decode(&input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode stdin: %v", err)
+		}
+	}
+
+	if *usernameFlag != "" {
+		input.Username = *usernameFlag
+	}
+
+	if *keyFile != "" {
+		data, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				input.SSHKeys = append(input.SSHKeys, line)
+			}
+		}
+	}
+
+	if *passwordFile != "" {
+		data, err := ioutil.ReadFile(*passwordFile)
+		if err != nil {
+			return nil, err
+		}
+		input.Password = strings.TrimRight(string(data), "\r\n")
+	} else if input.Password == "" {
+		input.Password = os.Getenv("BOWSER_PASSWORD")
+	}
+
+	if *yubikeyFlag != "" {
+		input.YubiKey = *yubikeyFlag
+	}
+
+	if input.Username == "" || len(input.SSHKeys) == 0 || input.Password == "" {
+		return nil, fmt.Errorf("a username, at least one ssh key and a password are required")
+	}
+
+	return &input, nil
+}
+
+func main() {
+	flag.Parse()
+	reader := bufio.NewReader(os.Stdin)
+
+	if *enrollURL != "" && *enrollToken == "" {
+		fmt.Printf("An enrollment token is required when enrolling (-token)\n")
 		return
 	}
-	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte(password), 12)
+
+	// In non-interactive mode stdout only carries the account json, so everything
+	//  meant for a human goes to stderr instead.
+	interactive := *usernameFlag == "" && !*stdinJSON
+	out := io.Writer(os.Stdout)
+	if !interactive {
+		out = os.Stderr
+	}
+
+	if !interactive && *enrollURL != "" {
+		fmt.Fprintf(out, "Enrolling requires interactive mode, since the MFA code has to be confirmed\n")
+		os.Exit(1)
+	}
+
+	var input *accountInput
+	var err error
+	if interactive {
+		input, err = readInteractive(reader)
+	} else {
+		input, err = readNonInteractive()
+	}
+	if err != nil {
+		fmt.Fprintf(out, "Invalid input: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, key := range input.SSHKeys {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key)); err != nil {
+			fmt.Fprintf(out, "Invalid SSH public key: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte(input.Password), 12)
 
 	// Generate TOTP code
 	totpRaw := make([]byte, 32)
-	_, err := rand.Read(totpRaw)
+	_, err = rand.Read(totpRaw)
 	if err != nil {
-		fmt.Printf("Failed to generate TOTP token: %s\n", err)
+		fmt.Fprintf(out, "Failed to generate TOTP token: %s\n", err)
 		return
 	}
 
 	// Encode the TOTP token as base32 and truncate to 16 characters
 	totpEncoded := base32.StdEncoding.EncodeToString(totpRaw)[:16]
+	totpURL := fmt.Sprintf("otpauth://totp/SSH:%s?secret=%s", input.Username, totpEncoded)
 
 	// Generate and display TOTP QR code
-	qrterminal.Generate(fmt.Sprintf(
-		"otpauth://totp/SSH:%s?secret=%s",
-		username[:len(username)-1],
-		totpEncoded,
-	), qrterminal.H, os.Stdout)
-	fmt.Printf("Please scan the above QR code with your TOTP app (or enter manually: `%s`)", totpEncoded)
-	reader.ReadString('\n')
+	if !*noQR {
+		qrterminal.Generate(totpURL, qrterminal.H, out)
+		fmt.Fprintf(out, "Please scan the above QR code with your TOTP app (or enter manually: `%s`)", totpEncoded)
+		if interactive {
+			reader.ReadString('\n')
+		} else {
+			fmt.Fprintf(out, "\n")
+		}
+	}
+
+	if *printURI {
+		fmt.Fprintf(out, "TOTP provisioning URI: %s\n", totpURL)
+	}
+
+	// When self-enrolling, make sure the user has actually set up their TOTP app
+	//  before we submit the account, since nobody is around to fix it afterwards.
+	if *enrollURL != "" {
+		fmt.Printf("MFA Code: ")
+		code, _ := reader.ReadString('\n')
+		if !totp.Validate(strings.TrimSpace(code), totpEncoded) {
+			fmt.Printf("Invalid MFA code, please try again\n")
+			return
+		}
+	}
+
+	// Generate backup codes for when the TOTP device is lost
+	backupCodes, backupHashes, err := bowser.GenerateBackupCodes(10)
+	if err != nil {
+		fmt.Fprintf(out, "Failed to generate backup codes: %v\n", err)
+		return
+	}
+
+	fmt.Fprintf(out, "\nYour single-use MFA backup codes, store them somewhere safe:\n")
+	for _, code := range backupCodes {
+		fmt.Fprintf(out, "  %s\n", code)
+	}
+
+	// Optionally register a YubiKey, tapping it gives us an OTP which starts with
+	//  the keys public ID.
+	if interactive {
+		fmt.Printf("\nYubiKey (tap to register, or leave empty): ")
+		input.YubiKey, _ = reader.ReadString('\n')
+	}
+
+	var yubikeys []string
+	if yubikeyOTP := strings.TrimSpace(input.YubiKey); yubikeyOTP != "" {
+		publicID := bowser.YubikeyPublicID(yubikeyOTP)
+		if publicID == "" {
+			fmt.Fprintf(out, "That does not look like a YubiKey OTP\n")
+			os.Exit(1)
+		}
+		yubikeys = append(yubikeys, publicID)
+	}
 
 	// Now encrypt the TOTP token with the password
-	totpEncrypted, err := encryptTOTP([]byte(password), []byte(username[:len(username)-1]), []byte(totpEncoded))
+	totpEncrypted, err := bowser.EncryptTOTP([]byte(input.Password), []byte(input.Username), []byte(totpEncoded))
 	if err != nil {
-		fmt.Printf("Failed to encrypt TOTP token: %v\n", err)
+		fmt.Fprintf(out, "Failed to encrypt TOTP token: %v\n", err)
 		return
 	}
 
 	// Create a new account struct
 	account := bowser.Account{
-		Username:   username[:len(username)-1],
+		Username:   input.Username,
 		Password:   string(bcryptHash),
-		SSHKeysRaw: []string{sshKey[:len(sshKey)-1]},
-		MFA:        bowser.AccountMFA{TOTP: string(totpEncrypted)},
+		SSHKeysRaw: input.SSHKeys,
+		MFA:        bowser.AccountMFA{TOTP: string(totpEncrypted), BackupCodes: backupHashes, YubiKeys: yubikeys},
 	}
 
-	// If the configuration path was passed, we can attempt to append this to the
+	// If we're enrolling, submit the account to the API. Otherwise if the
+	//  configuration path was passed, we can attempt to append this to the
 	//  accounts file.
-	if *configPath != "" {
-		config, err := bowser.LoadConfig(*configPath)
+	if *enrollURL != "" {
+		err = enroll(account)
 		if err != nil {
-			fmt.Printf("Failed to load config: %v\n", err)
+			fmt.Printf("Failed to enroll: %v\n", err)
 			return
 		}
 
+		fmt.Printf("Enrollment complete, your account is now active\n")
+	} else if *configPath != "" {
+		config, err := bowser.LoadConfig(*configPath)
+		if err != nil {
+			fmt.Fprintf(out, "Failed to load config: %v\n", err)
+			os.Exit(1)
+		}
+
 		accounts, err := config.LoadAccounts()
 		if err != nil {
-			fmt.Printf("Failed to load accounts: %v\n", err)
-			return
+			fmt.Fprintf(out, "Failed to load accounts: %v\n", err)
+			os.Exit(1)
 		}
 
 		err = config.SaveAccounts(append(accounts, account))
 		if err != nil {
-			fmt.Printf("Failed to save accounts: %v\n", err)
-			return
+			fmt.Fprintf(out, "Failed to save accounts: %v\n", err)
+			os.Exit(1)
 		}
 	} else {
 		// Otherwise, we just echo the payload to stdout
@@ -1,15 +1,244 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
 	"github.com/b1naryth1ef/bowser/lib"
 )
 
 var configPath = flag.String("config", "config.json", "path to json configuration file")
 
+func version(args []string) {
+	flags := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print build info as json")
+	flags.Parse(args)
+
+	info := bowser.GetBuildInfo()
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(info)
+		return
+	}
+
+	fmt.Printf("bowser %s (commit %s, built %s, %s)\n", info.Version, info.GitCommit, info.BuildDate, info.GoVersion)
+}
+
+func supportBundle(args []string) {
+	flags := flag.NewFlagSet("support-bundle", flag.ExitOnError)
+	output := flags.String("o", fmt.Sprintf("bowser-support-%s.tar.gz", time.Now().UTC().Format("20060102-150405")), "path to write the bundle to")
+	flags.Parse(args)
+
+	file, err := os.OpenFile(*output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		fmt.Printf("Failed to create bundle: %v\n", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	err = bowser.WriteSupportBundle(*configPath, file)
+	if err != nil {
+		fmt.Printf("Failed to write bundle: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Wrote support bundle to %s, please review it before sharing\n", *output)
+}
+
+func policy(args []string) {
+	if len(args) == 0 || args[0] != "test" {
+		fmt.Printf("usage: bowser policy test -account <username> <destination>...\n")
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet("policy test", flag.ExitOnError)
+	username := flags.String("account", "", "account to evaluate the policy of")
+	asJSON := flags.Bool("json", false, "print decisions as json")
+	flags.Parse(args[1:])
+
+	config, err := bowser.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+
+	account, err := config.LoadAccount(*username)
+	if err != nil {
+		fmt.Printf("Failed to load account: %v\n", err)
+		os.Exit(1)
+	}
+
+	decisions := bowser.EvaluatePolicy(config, account, flags.Args())
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(decisions)
+		return
+	}
+
+	for _, decision := range decisions {
+		verdict := "DENY "
+		if decision.Allowed {
+			verdict = "ALLOW"
+		}
+
+		fmt.Printf("%s %s (%s)", verdict, decision.Host, decision.Rule)
+		if len(decision.Tags) > 0 {
+			fmt.Printf(" tags=%s", strings.Join(decision.Tags, ","))
+		}
+		fmt.Printf("\n")
+	}
+}
+
+func lockouts(args []string) {
+	config, err := bowser.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+
+	path := "/lockouts"
+	method := "GET"
+	if len(args) > 0 {
+		if args[0] != "unlock" || len(args) != 2 {
+			fmt.Printf("usage: bowser lockouts [unlock <username>]\n")
+			os.Exit(2)
+		}
+
+		path = "/accounts/" + args[1] + "/unlock"
+		method = "POST"
+	}
+
+	data, err := bowser.AdminRequest(config, method, path)
+	if err != nil {
+		fmt.Printf("Request failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	os.Stdout.Write(data)
+}
+
+func backup(args []string) {
+	if len(args) != 2 || args[0] != "decrypt" {
+		fmt.Printf("usage: bowser backup decrypt <file>\n")
+		os.Exit(2)
+	}
+
+	config, err := bowser.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+
+	data, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		fmt.Printf("Failed to read backup: %v\n", err)
+		os.Exit(1)
+	}
+
+	decrypted, err := bowser.DecryptBackup(config.Backup, data)
+	if err != nil {
+		fmt.Printf("Failed to decrypt backup: %v\n", err)
+		os.Exit(1)
+	}
+
+	os.Stdout.Write(decrypted)
+}
+
+func secrets(args []string) {
+	if len(args) != 2 || args[0] != "encrypt" {
+		fmt.Printf("usage: bowser secrets encrypt <file>\n")
+		os.Exit(2)
+	}
+
+	config, err := bowser.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+
+	data, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		fmt.Printf("Failed to read secrets: %v\n", err)
+		os.Exit(1)
+	}
+
+	encrypted, err := bowser.EncryptSecretsFile(config.Secrets, data)
+	if err != nil {
+		fmt.Printf("Failed to encrypt secrets: %v\n", err)
+		os.Exit(1)
+	}
+
+	os.Stdout.Write(encrypted)
+}
+
+func reload(args []string) {
+	flags := flag.NewFlagSet("reload", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only show what would change")
+	flags.Parse(args)
+
+	config, err := bowser.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+
+	data, err := bowser.AdminRequest(config, "POST", fmt.Sprintf("/reload?dry_run=%v", *dryRun))
+	if err != nil {
+		fmt.Printf("Request failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	os.Stdout.Write(data)
+}
+
+func check(args []string) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.Parse(args)
+
+	problems := bowser.CheckConfig(*configPath)
+	for _, problem := range problems {
+		fmt.Printf("%v\n", problem)
+	}
+
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("Config is valid\n")
+}
+
 func main() {
 	flag.Parse()
 
+	switch flag.Arg(0) {
+	case "version":
+		version(flag.Args()[1:])
+		return
+	case "support-bundle":
+		supportBundle(flag.Args()[1:])
+		return
+	case "policy":
+		policy(flag.Args()[1:])
+		return
+	case "lockouts":
+		lockouts(flag.Args()[1:])
+		return
+	case "backup":
+		backup(flag.Args()[1:])
+		return
+	case "reload":
+		reload(flag.Args()[1:])
+		return
+	case "check":
+		check(flag.Args()[1:])
+		return
+	case "secrets":
+		secrets(flag.Args()[1:])
+		return
+	}
+
 	sshd := bowser.NewSSHDState(*configPath)
 	sshd.Run()
 }
@@ -0,0 +1,247 @@
+package bowser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Configuration for incident alerting on security relevant events. Thresholds are
+// counted per source (IP or username) within the window.
+type AlertConfig struct {
+	PagerDutyRoutingKey string `json:"pagerduty_routing_key"`
+	OpsgenieAPIKey      string `json:"opsgenie_api_key"`
+
+	Window              int `json:"window"`
+	BadKeyThreshold     int `json:"bad_key_threshold"`
+	MFAFailureThreshold int `json:"mfa_failure_threshold"`
+}
+
+// An Alert opens (or, via its DedupKey, updates) an incident with a provider
+type Alert struct {
+	DedupKey string
+	Summary  string
+	Severity string
+	Details  map[string]string
+}
+
+type AlertProvider interface {
+	Alert(alert Alert) error
+	Name() string
+}
+
+func postJSON(url string, headers map[string]string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Opens incidents through the PagerDuty Events v2 API
+type PagerDutyAlertProvider struct {
+	RoutingKey string
+}
+
+func (p PagerDutyAlertProvider) Name() string {
+	return "pagerduty"
+}
+
+func (p PagerDutyAlertProvider) Alert(alert Alert) error {
+	return postJSON("https://events.pagerduty.com/v2/enqueue", nil, map[string]interface{}{
+		"routing_key":  p.RoutingKey,
+		"event_action": "trigger",
+		"dedup_key":    alert.DedupKey,
+		"payload": map[string]interface{}{
+			"summary":        alert.Summary,
+			"source":         "bowser",
+			"severity":       alert.Severity,
+			"custom_details": alert.Details,
+		},
+	})
+}
+
+// Opens alerts through the Opsgenie Alert API, using the alias for deduplication
+type OpsgenieAlertProvider struct {
+	APIKey string
+}
+
+func (o OpsgenieAlertProvider) Name() string {
+	return "opsgenie"
+}
+
+func (o OpsgenieAlertProvider) Alert(alert Alert) error {
+	priority := "P3"
+	if alert.Severity == "critical" {
+		priority = "P1"
+	}
+
+	return postJSON("https://api.opsgenie.com/v2/alerts", map[string]string{
+		"Authorization": "GenieKey " + o.APIKey,
+	}, map[string]interface{}{
+		"message":  alert.Summary,
+		"alias":    alert.DedupKey,
+		"source":   "bowser",
+		"priority": priority,
+		"details":  alert.Details,
+	})
+}
+
+// Alerter tracks security relevant events and raises alerts with every configured
+// provider once their thresholds are crossed.
+type Alerter struct {
+	config    AlertConfig
+	providers []AlertProvider
+	log       *zap.Logger
+
+	counter  *windowCounter
+	inflight sync.WaitGroup
+}
+
+func NewAlerter(config AlertConfig, log *zap.Logger) *Alerter {
+	var providers []AlertProvider
+	if config.PagerDutyRoutingKey != "" {
+		providers = append(providers, PagerDutyAlertProvider{RoutingKey: config.PagerDutyRoutingKey})
+	}
+
+	if config.OpsgenieAPIKey != "" {
+		providers = append(providers, OpsgenieAlertProvider{APIKey: config.OpsgenieAPIKey})
+	}
+
+	return &Alerter{
+		config:    config,
+		providers: providers,
+		log:       log,
+		counter:   newWindowCounter(time.Duration(config.Window) * time.Second),
+	}
+}
+
+// Records an occurrence for key and returns true only when this occurrence is the
+// one that crosses the threshold, so each window raises at most one alert.
+func (a *Alerter) count(key string, threshold int) bool {
+	if threshold <= 0 {
+		return false
+	}
+
+	return a.counter.add(key) == threshold
+}
+
+func (a *Alerter) raise(alert Alert) {
+	for _, provider := range a.providers {
+		a.inflight.Add(1)
+		go func(provider AlertProvider) {
+			defer a.inflight.Done()
+
+			err := provider.Alert(alert)
+			if err != nil {
+				a.log.Error(
+					"Failed to raise alert",
+					zap.String("provider", provider.Name()),
+					zap.String("dedup-key", alert.DedupKey),
+					zap.Error(err))
+			}
+		}(provider)
+	}
+}
+
+// Called whenever a source address offers an SSH key we don't know about
+func (a *Alerter) BadKey(source string) {
+	if !a.count("bad-key:"+source, a.config.BadKeyThreshold) {
+		return
+	}
+
+	a.raise(Alert{
+		DedupKey: "bowser-bad-key-" + source,
+		Summary:  fmt.Sprintf("Repeated invalid SSH keys from %s", source),
+		Severity: "warning",
+		Details:  map[string]string{"source": source},
+	})
+}
+
+// Called whenever an account fails MFA
+func (a *Alerter) MFAFailure(username, source string) {
+	if !a.count("mfa:"+username, a.config.MFAFailureThreshold) {
+		return
+	}
+
+	a.raise(Alert{
+		DedupKey: "bowser-mfa-" + username,
+		Summary:  fmt.Sprintf("Possible MFA brute forcing against %s", username),
+		Severity: "critical",
+		Details:  map[string]string{"username": username, "source": source},
+	})
+}
+
+// Called whenever a session attempts to reach a destination matching a deny rule
+func (a *Alerter) DeniedDestination(username, sessionID, destination string) {
+	a.raise(Alert{
+		DedupKey: fmt.Sprintf("bowser-denied-%s-%s", username, destination),
+		Summary:  fmt.Sprintf("%s attempted to reach denied destination %s", username, destination),
+		Severity: "error",
+		Details:  map[string]string{"username": username, "session": sessionID, "destination": destination},
+	})
+}
+
+// Called for audit events routed to alerting by severity
+func (a *Alerter) AuditEvent(event AuditEvent) {
+	details := make(map[string]string)
+	for _, field := range auditFields(event) {
+		details[field[0]] = field[1]
+	}
+
+	severity := event.Severity
+	if severity == AuditSeverityNotice {
+		severity = "info"
+	}
+
+	a.raise(Alert{
+		DedupKey: fmt.Sprintf("bowser-audit-%s-%s-%s", event.Type, event.Username, event.Destination),
+		Summary:  auditSummary(event),
+		Severity: severity,
+		Details:  details,
+	})
+}
+
+// Waits up to timeout for in-flight alerts to be delivered, returning false if
+// some of them did not finish in time.
+func (a *Alerter) Close(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		a.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,109 @@
+package bowser
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Restricts the ciphers, MACs and key exchanges offered to clients (and to hosts the
+// destination picker logs into). A preset supplies all three lists, while any list
+// given explicitly replaces the preset's. Without either, the ssh library defaults
+// are used.
+type AlgorithmsConfig struct {
+	Preset       string   `json:"preset"`
+	Ciphers      []string `json:"ciphers"`
+	MACs         []string `json:"macs"`
+	KeyExchanges []string `json:"key_exchanges"`
+}
+
+type algorithmPreset struct {
+	ciphers      []string
+	macs         []string
+	keyExchanges []string
+}
+
+var modernAlgorithms = algorithmPreset{
+	ciphers:      []string{"chacha20-poly1305@openssh.com", "aes128-gcm@openssh.com", "aes256-ctr", "aes192-ctr", "aes128-ctr"},
+	macs:         []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256"},
+	keyExchanges: []string{"curve25519-sha256@libssh.org", "ecdh-sha2-nistp521", "ecdh-sha2-nistp384", "ecdh-sha2-nistp256"},
+}
+
+var algorithmPresets = map[string]algorithmPreset{
+	"modern": modernAlgorithms,
+
+	// Adds what older clients still need on top of modern
+	"compat": {
+		ciphers:      append(append([]string{}, modernAlgorithms.ciphers...), "aes128-cbc"),
+		macs:         append(append([]string{}, modernAlgorithms.macs...), "hmac-sha1"),
+		keyExchanges: append(append([]string{}, modernAlgorithms.keyExchanges...), "diffie-hellman-group14-sha1"),
+	},
+
+	// Only FIPS 140-2 approved algorithms
+	"fips": {
+		ciphers:      []string{"aes128-gcm@openssh.com", "aes256-ctr", "aes192-ctr", "aes128-ctr"},
+		macs:         []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256"},
+		keyExchanges: []string{"ecdh-sha2-nistp521", "ecdh-sha2-nistp384", "ecdh-sha2-nistp256"},
+	},
+}
+
+// Every algorithm the ssh library implements
+var supportedAlgorithms = map[string]bool{
+	"chacha20-poly1305@openssh.com": true,
+	"aes128-gcm@openssh.com":        true,
+	"aes256-ctr":                    true,
+	"aes192-ctr":                    true,
+	"aes128-ctr":                    true,
+	"aes128-cbc":                    true,
+	"3des-cbc":                      true,
+	"arcfour256":                    true,
+	"arcfour128":                    true,
+	"arcfour":                       true,
+
+	"hmac-sha2-256-etm@openssh.com": true,
+	"hmac-sha2-256":                 true,
+	"hmac-sha1":                     true,
+	"hmac-sha1-96":                  true,
+
+	"curve25519-sha256@libssh.org": true,
+	"ecdh-sha2-nistp521":           true,
+	"ecdh-sha2-nistp384":           true,
+	"ecdh-sha2-nistp256":           true,
+	"diffie-hellman-group14-sha1":  true,
+	"diffie-hellman-group1-sha1":   true,
+}
+
+func (c AlgorithmsConfig) validate() error {
+	if _, exists := algorithmPresets[c.Preset]; c.Preset != "" && !exists {
+		return fmt.Errorf("unknown ssh_algorithms preset %q", c.Preset)
+	}
+
+	for _, list := range [][]string{c.Ciphers, c.MACs, c.KeyExchanges} {
+		for _, name := range list {
+			if !supportedAlgorithms[name] {
+				return fmt.Errorf("unsupported ssh algorithm %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// Applies the configured algorithms to an ssh server or client config
+func (c AlgorithmsConfig) apply(config *ssh.Config) {
+	preset := algorithmPresets[c.Preset]
+	config.Ciphers = preset.ciphers
+	config.MACs = preset.macs
+	config.KeyExchanges = preset.keyExchanges
+
+	if len(c.Ciphers) > 0 {
+		config.Ciphers = c.Ciphers
+	}
+
+	if len(c.MACs) > 0 {
+		config.MACs = c.MACs
+	}
+
+	if len(c.KeyExchanges) > 0 {
+		config.KeyExchanges = c.KeyExchanges
+	}
+}
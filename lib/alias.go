@@ -0,0 +1,90 @@
+package bowser
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Checks every alias target is a host, or a host and port
+func (c *Config) validateAliases() error {
+	for name, target := range c.Aliases {
+		if name == "" || strings.ContainsAny(name, ":/") {
+			return fmt.Errorf("invalid alias name %q", name)
+		}
+
+		if _, _, err := splitAliasTarget(target); err != nil {
+			return fmt.Errorf("invalid target for alias %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func splitAliasTarget(target string) (string, uint32, error) {
+	host, rawPort, err := net.SplitHostPort(target)
+	if err != nil {
+		// Targets without a port keep the port the client asked for
+		if strings.Contains(target, ":") && net.ParseIP(target) == nil {
+			return "", 0, err
+		}
+		return strings.Trim(target, "[]"), 0, nil
+	}
+
+	port, err := strconv.ParseUint(rawPort, 10, 16)
+	if err != nil || port == 0 {
+		return "", 0, fmt.Errorf("invalid port %q", rawPort)
+	}
+	return host, uint32(port), nil
+}
+
+// Returns the host to resolve and the port to connect to for a destination. For an
+// alias these are its target (the port only when the target has one), otherwise the
+// destination itself. Everything else, ACLs, the host inventory and audit events,
+// sees the alias name.
+func (c *Config) resolveAlias(host string, port uint32) (string, uint32) {
+	target, exists := c.Aliases[host]
+	if !exists {
+		// Destinations are looked up normalized, alias names might not be
+		for name, other := range c.Aliases {
+			if normalizeDestination(name) == host {
+				target, exists = other, true
+				break
+			}
+		}
+	}
+
+	if !exists {
+		return host, port
+	}
+
+	targetHost, targetPort, _ := splitAliasTarget(target)
+	if targetPort != 0 {
+		port = targetPort
+	}
+	return normalizeDestination(targetHost), port
+}
+
+// Checks the target an alias resolves to against the deny side of the account's
+// rules (blacklist, deny_tags, deny_networks and host allow_ports), so an alias can't
+// reach a destination the account is denied. Allow rules only apply to the alias name.
+func (a *Account) canConnectToTarget(config *Config, host, target string, port int) error {
+	if target == host {
+		return nil
+	}
+
+	if err := a.canConnectToAddress(config, target); err != nil {
+		return err
+	}
+	return a.canConnectToPort(config, target, port)
+}
+
+// Returns the tags of a destination along with those of the alias target it resolves
+// to, for deciding whether it is recorded, captured or throttled
+func (c *Config) destinationTags(host, target string) []string {
+	tags := c.TagsFor(host)
+	if target != host {
+		tags = append(tags, c.TagsFor(target)...)
+	}
+	return tags
+}
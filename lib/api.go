@@ -0,0 +1,221 @@
+package bowser
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// HTTPAPI exposes administrative and self-service endpoints for a running bowser
+type HTTPAPI struct {
+	state *SSHDState
+	mux   *http.ServeMux
+}
+
+func NewHTTPAPI(state *SSHDState) *HTTPAPI {
+	api := &HTTPAPI{
+		state: state,
+		mux:   http.NewServeMux(),
+	}
+
+	api.mux.HandleFunc("/enrollments", api.mutating(api.requireAdmin(api.handleCreateEnrollment)))
+	api.mux.HandleFunc("/enroll", api.mutating(api.handleEnroll))
+	api.mux.HandleFunc("/info", api.requireAdmin(api.handleInfo))
+	api.mux.HandleFunc("/analytics/destinations", api.requireAdmin(api.handleDestinationAnalytics))
+	api.mux.HandleFunc("/features", api.requireAdmin(api.handleListFeatures))
+	api.mux.HandleFunc("/features/", api.mutating(api.requireAdmin(api.handleSetFeature)))
+	api.mux.HandleFunc("/lockouts", api.requireAdmin(api.handleListLockouts))
+	api.mux.HandleFunc("/debug/goroutines", api.requireAdmin(api.handleDebugGoroutines))
+	api.mux.HandleFunc("/debug/logs", api.requireAdmin(api.handleDebugLogs))
+	api.mux.HandleFunc("/debug/runtime", api.requireAdmin(api.handleDebugRuntime))
+	api.mux.HandleFunc("/accounts/", api.mutating(api.requireAdmin(api.handleAccountAction)))
+	api.mux.HandleFunc("/expirations", api.requireAdmin(api.handleListExpirations))
+	api.mux.HandleFunc("/sessions", api.requireAdmin(api.handleListSessions))
+	api.mux.HandleFunc("/sessions/", api.mutating(api.requireAdmin(api.handleSession)))
+	api.mux.HandleFunc("/broadcast", api.mutating(api.requireAdmin(api.handleBroadcast)))
+	api.mux.HandleFunc("/certs", api.requireAdmin(api.handleListCerts))
+	api.mux.HandleFunc("/history/sessions", api.requireAdmin(api.handleSessionHistory))
+	api.mux.HandleFunc("/history/sessions/", api.requireAdmin(api.handleSessionHistory))
+	api.mux.HandleFunc("/reload", api.requireAdmin(api.handleReload))
+	api.mux.HandleFunc("/stats", api.requireAdmin(api.handleStats))
+	api.mux.HandleFunc("/metrics", api.requireAdmin(api.handleMetrics))
+	api.mux.HandleFunc("/events/stream", api.requireAdmin(api.handleEventStream))
+	api.mux.HandleFunc("/loglevel", api.mutating(api.requireAdmin(api.handleLogLevel)))
+	api.mux.HandleFunc("/healthz", api.handleHealthz)
+	api.mux.HandleFunc("/readyz", api.handleReadyz)
+	return api
+}
+
+func (api *HTTPAPI) Run() error {
+	config := api.state.Config()
+	server := &http.Server{
+		Addr:      config.APIBind,
+		Handler:   api.mux,
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+
+	// Anything without a certificate from the client CA is turned away during the
+	//  handshake, before any endpoint is reachable.
+	if config.APIClientCAPath != "" {
+		data, err := ioutil.ReadFile(config.APIClientCAPath)
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", config.APIClientCAPath)
+		}
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if config.APITLSCertPath != "" {
+		api.state.log.Info("HTTPS API listening", zap.String("bind", config.APIBind))
+		return server.ListenAndServeTLS(config.APITLSCertPath, config.APITLSKeyPath)
+	}
+
+	api.state.log.Info("HTTP API listening", zap.String("bind", config.APIBind))
+	return server.ListenAndServe()
+}
+
+// Wraps a handler so it may only be called with an API token, which needs the read
+// scope for GET and HEAD requests and the write scope for anything else
+func (api *HTTPAPI) requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := api.authenticate(r)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "invalid api token")
+			return
+		}
+
+		scope := APIScopeWrite
+		if r.Method == "GET" || r.Method == "HEAD" {
+			scope = APIScopeRead
+		}
+
+		if !token.hasScope(scope) {
+			writeError(w, http.StatusForbidden, "api token lacks the "+scope+" scope")
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// Wraps a handler that changes state, rejecting anything but GET and HEAD requests
+// when the API is in read-only mode
+func (api *HTTPAPI) mutating(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if api.state.Config().APIReadOnly && r.Method != "GET" && r.Method != "HEAD" {
+			writeError(w, http.StatusForbidden, "api is in read-only mode")
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// GET /info, describes the running build and loaded configuration
+func (api *HTTPAPI) handleInfo(w http.ResponseWriter, r *http.Request) {
+	accounts, keys := api.state.accountSet()
+	writeJSON(w, http.StatusOK, struct {
+		BuildInfo
+		ConfigHash string   `json:"config_hash"`
+		Features   []string `json:"features"`
+		Accounts   int      `json:"accounts"`
+		Keys       int      `json:"keys"`
+	}{
+		BuildInfo:  GetBuildInfo(),
+		ConfigHash: api.state.Config().Hash(),
+		Features:   api.state.Config().Features(),
+		Accounts:   len(accounts),
+		Keys:       len(keys),
+	})
+}
+
+// GET /analytics/destinations?since=24h, aggregates completed forwards per
+// destination. since and until accept either RFC3339 times or durations ago.
+func (api *HTTPAPI) handleDestinationAnalytics(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+
+	since, err := parseTimeParam(r.URL.Query().Get("since"), now.Add(-24*time.Hour), now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid since")
+		return
+	}
+
+	until, err := parseTimeParam(r.URL.Query().Get("until"), now, now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid until")
+		return
+	}
+
+	usage := aggregateDestinations(api.state.history.between(since, until))
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].Forwards > usage[j].Forwards
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"since":        since,
+		"until":        until,
+		"destinations": usage,
+	})
+}
+
+// Routes POST /accounts/:username/:action
+func (api *HTTPAPI) handleAccountAction(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/accounts/"), "/")
+	if len(parts) != 2 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	switch parts[1] {
+	case "unlock":
+		api.handleUnlockAccount(w, r, parts[0])
+	case "archive":
+		api.handleArchiveAccount(w, r, parts[0])
+	case "restore":
+		api.handleRestoreAccount(w, r, parts[0])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// Parses a time query parameter which is either an RFC3339 time or a duration
+// before now, returning fallback when empty.
+func parseTimeParam(value string, fallback, now time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(-duration), nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
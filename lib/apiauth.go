@@ -0,0 +1,99 @@
+package bowser
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Scopes API tokens can be given. Read allows GET and HEAD requests, write
+// everything else.
+const (
+	APIScopeRead  = "read"
+	APIScopeWrite = "write"
+)
+
+// An API token limited to some scopes, e.g. a read-only one for dashboards. The
+// api_token from the config has every scope.
+type APITokenConfig struct {
+	Name   string   `json:"name"`
+	Token  string   `json:"token"`
+	Scopes []string `json:"scopes"`
+}
+
+// Maps the common name of client certificates (with api_client_ca_path) to scopes, so
+// they can be used without a token
+type APIClientConfig struct {
+	Subject string   `json:"subject"`
+	Scopes  []string `json:"scopes"`
+}
+
+func (t APITokenConfig) validate() error {
+	if t.Name == "" || t.Token == "" {
+		return fmt.Errorf("api tokens require a name and token")
+	}
+	return validateScopes("api token "+t.Name, t.Scopes)
+}
+
+func (c APIClientConfig) validate() error {
+	if c.Subject == "" {
+		return fmt.Errorf("api clients require a subject")
+	}
+	return validateScopes("api client "+c.Subject, c.Scopes)
+}
+
+func validateScopes(owner string, scopes []string) error {
+	for _, scope := range scopes {
+		if scope != APIScopeRead && scope != APIScopeWrite {
+			return fmt.Errorf("unknown scope %q for %s", scope, owner)
+		}
+	}
+	return nil
+}
+
+func (t APITokenConfig) hasScope(scope string) bool {
+	for _, other := range t.Scopes {
+		if other == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the token a request was made with, either as a bearer token or in the
+// X-API-Key header
+func requestToken(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// Finds the configured token (or client certificate) a request was made with
+func (api *HTTPAPI) authenticate(r *http.Request) (APITokenConfig, bool) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		subject := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for _, client := range api.state.Config().APIClients {
+			if client.Subject == subject {
+				return APITokenConfig{Name: "cert:" + subject, Scopes: client.Scopes}, true
+			}
+		}
+	}
+
+	token := []byte(requestToken(r))
+	if len(token) == 0 {
+		return APITokenConfig{}, false
+	}
+
+	if api.state.Config().APIToken != "" && subtle.ConstantTimeCompare(token, []byte(api.state.Config().APIToken)) == 1 {
+		return APITokenConfig{Name: "admin", Scopes: []string{APIScopeRead, APIScopeWrite}}, true
+	}
+
+	for _, scoped := range api.state.Config().APITokens {
+		if subtle.ConstantTimeCompare(token, []byte(scoped.Token)) == 1 {
+			return scoped, true
+		}
+	}
+	return APITokenConfig{}, false
+}
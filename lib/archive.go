@@ -0,0 +1,148 @@
+package bowser
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var accountNotFoundError = fmt.Errorf("account not found")
+
+// Rewrites a single account in the accounts file and reloads
+func (s *SSHDState) updateAccount(username string, update func(account *Account) error) error {
+	s.accountsLock.Lock()
+	defer s.accountsLock.Unlock()
+
+	accounts, err := s.Config().LoadAccounts()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for i := range accounts {
+		if accounts[i].Username == username {
+			found = true
+			if err = update(&accounts[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !found {
+		return accountNotFoundError
+	}
+
+	err = s.Config().SaveAccounts(accounts)
+	if err != nil {
+		return err
+	}
+
+	s.reloadAccounts()
+	return nil
+}
+
+// Archives an account, rejecting its keys and closing its sessions while keeping it
+// in the accounts file until the retention period passes.
+func (s *SSHDState) archiveAccount(username string) error {
+	return s.updateAccount(username, func(account *Account) error {
+		if account.ArchivedAt != nil {
+			return fmt.Errorf("account %s is already archived", username)
+		}
+
+		now := time.Now().UTC()
+		account.ArchivedAt = &now
+		return nil
+	})
+}
+
+func (s *SSHDState) restoreAccount(username string) error {
+	return s.updateAccount(username, func(account *Account) error {
+		if account.ArchivedAt == nil {
+			return fmt.Errorf("account %s is not archived", username)
+		}
+
+		account.ArchivedAt = nil
+		return nil
+	})
+}
+
+// Removes accounts which have been archived for longer than the retention period
+func (s *SSHDState) purgeArchivedAccounts() {
+	if s.Config().ArchiveRetention <= 0 {
+		return
+	}
+
+	cutoff := time.Now().UTC().Add(-time.Duration(s.Config().ArchiveRetention) * 24 * time.Hour)
+
+	s.accountsLock.Lock()
+	defer s.accountsLock.Unlock()
+
+	accounts, err := s.Config().LoadAccounts()
+	if err != nil {
+		s.log.Error("Failed to load accounts to purge archived accounts", zap.Error(err))
+		return
+	}
+
+	var remaining []Account
+	for _, account := range accounts {
+		if account.ArchivedAt != nil && account.ArchivedAt.Before(cutoff) {
+			s.log.Info("Purging archived account", zap.String("username", account.Username), zap.Time("archived-at", *account.ArchivedAt))
+			s.audit.Emit(AuditEvent{
+				Type:     AuditAdminAction,
+				Username: account.Username,
+				Reason:   "archived account purged",
+			})
+			continue
+		}
+		remaining = append(remaining, account)
+	}
+
+	if len(remaining) == len(accounts) {
+		return
+	}
+
+	err = s.Config().SaveAccounts(remaining)
+	if err != nil {
+		s.log.Error("Failed to save accounts after purging archived accounts", zap.Error(err))
+		return
+	}
+
+	s.reloadAccounts()
+}
+
+func (s *SSHDState) runArchivePurger() {
+	for {
+		s.purgeArchivedAccounts()
+		time.Sleep(time.Hour)
+	}
+}
+
+// POST /accounts/:username/archive
+func (api *HTTPAPI) handleArchiveAccount(w http.ResponseWriter, r *http.Request, username string) {
+	api.accountChange(w, username, "account archived", api.state.archiveAccount(username))
+}
+
+// POST /accounts/:username/restore
+func (api *HTTPAPI) handleRestoreAccount(w http.ResponseWriter, r *http.Request, username string) {
+	api.accountChange(w, username, "account restored", api.state.restoreAccount(username))
+}
+
+func (api *HTTPAPI) accountChange(w http.ResponseWriter, username, action string, err error) {
+	if err == accountNotFoundError {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	api.state.log.Info("Account changed", zap.String("username", username), zap.String("action", action))
+	api.state.audit.Emit(AuditEvent{
+		Type:     AuditAdminAction,
+		Username: username,
+		Reason:   action,
+	})
+	writeJSON(w, http.StatusOK, map[string]string{"username": username})
+}
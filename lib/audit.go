@@ -0,0 +1,326 @@
+package bowser
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The types of security relevant events emitted to audit sinks
+const (
+	AuditAuthSuccess   = "auth.success"
+	AuditAuthFailure   = "auth.failure"
+	AuditSessionStart  = "session.start"
+	AuditSessionEnd    = "session.end"
+	AuditForwardOpen   = "forward.open"
+	AuditForwardClose  = "forward.close"
+	AuditForwardReject = "forward.reject"
+	AuditCertIssued    = "cert.issued"
+	AuditSourceBanned  = "source.banned"
+	AuditAdminAction   = "admin.action"
+	AuditAccountLocked = "account.locked"
+	AuditLimitExceeded = "limit.exceeded"
+
+	AuditRemoteForwardOpen   = "remote_forward.open"
+	AuditRemoteForwardClose  = "remote_forward.close"
+	AuditRemoteForwardReject = "remote_forward.reject"
+)
+
+// Audit event severities, in increasing order
+const (
+	AuditSeverityInfo     = "info"
+	AuditSeverityNotice   = "notice"
+	AuditSeverityWarning  = "warning"
+	AuditSeverityCritical = "critical"
+)
+
+var auditSeverityRanks = map[string]int{
+	AuditSeverityInfo:     0,
+	AuditSeverityNotice:   1,
+	AuditSeverityWarning:  2,
+	AuditSeverityCritical: 3,
+}
+
+// The severity events get unless whoever emits them picks one
+var auditDefaultSeverities = map[string]string{
+	AuditAuthFailure:   AuditSeverityWarning,
+	AuditForwardReject: AuditSeverityNotice,
+	AuditCertIssued:    AuditSeverityNotice,
+	AuditSourceBanned:  AuditSeverityWarning,
+	AuditAdminAction:   AuditSeverityNotice,
+	AuditAccountLocked: AuditSeverityWarning,
+	AuditLimitExceeded: AuditSeverityWarning,
+
+	AuditRemoteForwardOpen:   AuditSeverityNotice,
+	AuditRemoteForwardReject: AuditSeverityNotice,
+}
+
+// Returns the rank of a severity name, an empty name ranks lowest
+func parseAuditSeverity(severity string) (int, error) {
+	if severity == "" {
+		return 0, nil
+	}
+
+	rank, exists := auditSeverityRanks[severity]
+	if !exists {
+		return 0, fmt.Errorf("unknown audit severity %s", severity)
+	}
+	return rank, nil
+}
+
+// An AuditEvent is a structured record of a security relevant action
+type AuditEvent struct {
+	Time        time.Time         `json:"time"`
+	Type        string            `json:"type"`
+	Severity    string            `json:"severity"`
+	Username    string            `json:"username,omitempty"`
+	SessionID   string            `json:"session_id,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	Country     string            `json:"country,omitempty"`
+	Destination string            `json:"destination,omitempty"`
+	Reason      string            `json:"reason,omitempty"`
+	Fields      map[string]string `json:"fields,omitempty"`
+}
+
+// Whether the event describes something being denied or failing
+func (e AuditEvent) Failed() bool {
+	return e.Type == AuditAuthFailure || e.Type == AuditForwardReject
+}
+
+// An AuditSink ships audit events somewhere, e.g. a SIEM
+type AuditSink interface {
+	Emit(event AuditEvent) error
+	Close() error
+	Name() string
+}
+
+// Configuration for all audit sinks. Every sink takes a min_severity, and only
+// receives events at or above it.
+type AuditConfig struct {
+	QueueSize   int                 `json:"queue_size"`
+	Alerts      AuditAlertConfig    `json:"alerts"`
+	Syslog      []SyslogConfig      `json:"syslog"`
+	Kafka       []KafkaConfig       `json:"kafka"`
+	EventBridge []EventBridgeConfig `json:"eventbridge"`
+	File        *AuditFileConfig    `json:"file"`
+	Email       []EmailConfig       `json:"email"`
+}
+
+// Raises alerts (through the providers in the alerts config) for audit events at or
+// above a severity. Disabled unless min_severity is set.
+type AuditAlertConfig struct {
+	MinSeverity string `json:"min_severity"`
+}
+
+type auditRoute struct {
+	sink        AuditSink
+	minSeverity int
+}
+
+// Auditor fans audit events out to every configured sink from a background worker
+type Auditor struct {
+	routes []auditRoute
+	events chan AuditEvent
+	done   chan struct{}
+	log    *zap.Logger
+
+	lock    sync.Mutex
+	closed  bool
+	dropped int
+}
+
+// Any extra sinks given receive every event.
+func NewAuditor(config AuditConfig, alerter *Alerter, log *zap.Logger, sinks ...AuditSink) (*Auditor, error) {
+	var routes []auditRoute
+	route := func(sink AuditSink, minSeverity string) error {
+		rank, err := parseAuditSeverity(minSeverity)
+		if err != nil {
+			return err
+		}
+		routes = append(routes, auditRoute{sink, rank})
+		return nil
+	}
+
+	for _, syslogConfig := range config.Syslog {
+		sink, err := NewSyslogSink(syslogConfig)
+		if err != nil {
+			return nil, err
+		}
+		if err = route(sink, syslogConfig.MinSeverity); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, kafkaConfig := range config.Kafka {
+		sink, err := NewKafkaSink(kafkaConfig)
+		if err != nil {
+			return nil, err
+		}
+		if err = route(sink, kafkaConfig.MinSeverity); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, eventBridgeConfig := range config.EventBridge {
+		sink, err := NewEventBridgeSink(eventBridgeConfig)
+		if err != nil {
+			return nil, err
+		}
+		if err = route(sink, eventBridgeConfig.MinSeverity); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.File != nil {
+		sink, err := NewFileAuditSink(*config.File)
+		if err != nil {
+			return nil, err
+		}
+		if err = route(sink, config.File.MinSeverity); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, emailConfig := range config.Email {
+		sink, err := NewEmailSink(emailConfig, log)
+		if err != nil {
+			return nil, err
+		}
+		if err = route(sink, emailConfig.MinSeverity); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Alerts.MinSeverity != "" {
+		if err := route(alertAuditSink{alerter}, config.Alerts.MinSeverity); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, sink := range sinks {
+		routes = append(routes, auditRoute{sink, 0})
+	}
+
+	a := &Auditor{
+		routes: routes,
+		events: make(chan AuditEvent, config.QueueSize),
+		done:   make(chan struct{}),
+		log:    log,
+	}
+
+	go a.run()
+	return a, nil
+}
+
+func (a *Auditor) run() {
+	defer close(a.done)
+
+	for event := range a.events {
+		rank := auditSeverityRanks[event.Severity]
+		for _, route := range a.routes {
+			if rank < route.minSeverity {
+				continue
+			}
+
+			err := route.sink.Emit(event)
+			if err != nil {
+				a.log.Error(
+					"Failed to emit audit event",
+					zap.String("sink", route.sink.Name()),
+					zap.String("type", event.Type),
+					zap.Error(err))
+			}
+		}
+	}
+}
+
+// Queue an event for all sinks, dropping it (and logging) if the queue is full
+func (a *Auditor) Emit(event AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	if event.Severity == "" {
+		event.Severity = auditDefaultSeverities[event.Type]
+		if event.Severity == "" {
+			event.Severity = AuditSeverityInfo
+		}
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.closed {
+		a.dropped++
+		return
+	}
+
+	select {
+	case a.events <- event:
+	default:
+		a.dropped++
+		a.log.Error("Dropping audit event, queue is full", zap.String("type", event.Type))
+	}
+}
+
+// Stop accepting events, wait up to timeout for queued ones to be written and close
+// every sink. Returns the number of events dropped over the lifetime of the auditor.
+func (a *Auditor) Close(timeout time.Duration) int {
+	a.lock.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.events)
+	}
+	a.lock.Unlock()
+
+	select {
+	case <-a.done:
+	case <-time.After(timeout):
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	dropped := a.dropped + len(a.events)
+	for _, route := range a.routes {
+		route.sink.Close()
+	}
+
+	return dropped
+}
+
+// Sinks writing to files implement this to be reopened after external log rotation
+type reopenableAuditSink interface {
+	Reopen() error
+}
+
+// Reopens every file backed sink
+func (a *Auditor) Reopen() {
+	for _, route := range a.routes {
+		if sink, ok := route.sink.(reopenableAuditSink); ok {
+			if err := sink.Reopen(); err != nil {
+				a.log.Error("Failed to reopen audit sink", zap.String("sink", route.sink.Name()), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Feeds audit events into the alerter, e.g. so only critical events page somebody
+type alertAuditSink struct {
+	alerter *Alerter
+}
+
+func (s alertAuditSink) Name() string {
+	return "alerts"
+}
+
+func (s alertAuditSink) Emit(event AuditEvent) error {
+	s.alerter.AuditEvent(event)
+	return nil
+}
+
+func (s alertAuditSink) Close() error {
+	return nil
+}
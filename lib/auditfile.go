@@ -0,0 +1,59 @@
+package bowser
+
+import (
+	"encoding/json"
+)
+
+// The schema every audit log line follows. Bump it whenever a field changes meaning
+// or is removed, adding fields is backwards compatible.
+const auditFileSchema = "bowser.audit/v1"
+
+// Configuration for the audit log, an append-only file of JSON lines kept apart from
+// the application log, rotated like the log file.
+type AuditFileConfig struct {
+	Path        string `json:"path"`
+	MinSeverity string `json:"min_severity"`
+	LogRotationConfig
+}
+
+type auditRecord struct {
+	Schema string `json:"schema"`
+	AuditEvent
+}
+
+// Writes audit events to a dedicated, rotated audit log file
+type FileAuditSink struct {
+	file *rotatingFile
+}
+
+func NewFileAuditSink(config AuditFileConfig) (*FileAuditSink, error) {
+	file, err := openRotatingFile(config.Path, config.LogRotationConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileAuditSink{file: file}, nil
+}
+
+func (s *FileAuditSink) Name() string {
+	return "file"
+}
+
+func (s *FileAuditSink) Emit(event AuditEvent) error {
+	line, err := json.Marshal(auditRecord{auditFileSchema, event})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+func (s *FileAuditSink) Reopen() error {
+	return s.file.Reopen()
+}
+
+func (s *FileAuditSink) Close() error {
+	s.file.Sync()
+	return s.file.Close()
+}
@@ -0,0 +1,226 @@
+package bowser
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+)
+
+// Configuration for pushing encrypted snapshots of the accounts file somewhere else
+// whenever it changes. The encryption key is 32 base64 encoded bytes, and snapshots
+// can be decrypted with `bowser backup decrypt`.
+type BackupConfig struct {
+	EncryptionKey string           `json:"encryption_key"`
+	S3            *S3BackupConfig  `json:"s3"`
+	Git           *GitBackupConfig `json:"git"`
+}
+
+// Snapshots are written to s3://bucket/prefix/accounts-<timestamp>.json.enc
+type S3BackupConfig struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix"`
+	Region string `json:"region"`
+}
+
+// Snapshots are committed to a local clone, and pushed if a remote is set
+type GitBackupConfig struct {
+	RepoPath string `json:"repo_path"`
+	Remote   string `json:"remote"`
+	Branch   string `json:"branch"`
+}
+
+type accountsBackup struct {
+	config   BackupConfig
+	key      []byte
+	s3       *s3.S3
+	log      *zap.Logger
+	lastHash string
+
+	// Only the newest pending snapshot matters, so this holds at most one
+	pending chan []byte
+}
+
+func newAccountsBackup(config BackupConfig, log *zap.Logger) (*accountsBackup, error) {
+	b := &accountsBackup{config: config, log: log, pending: make(chan []byte, 1)}
+	if config.S3 == nil && config.Git == nil {
+		return b, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(config.EncryptionKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("backup encryption_key must be 32 base64 encoded bytes")
+	}
+	b.key = key
+
+	if config.S3 != nil {
+		awsConfig := aws.NewConfig()
+		if config.S3.Region != "" {
+			awsConfig = awsConfig.WithRegion(config.S3.Region)
+		}
+
+		sess, err := session.NewSession(awsConfig)
+		if err != nil {
+			return nil, err
+		}
+		b.s3 = s3.New(sess)
+	}
+
+	go b.run()
+	return b, nil
+}
+
+// Queues a snapshot of the accounts data, replacing any snapshot still pending
+func (b *accountsBackup) snapshot(data []byte) {
+	if b.key == nil {
+		return
+	}
+
+	for {
+		select {
+		case b.pending <- data:
+			return
+		default:
+		}
+
+		select {
+		case <-b.pending:
+		default:
+		}
+	}
+}
+
+func (b *accountsBackup) run() {
+	for data := range b.pending {
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		if hash == b.lastHash {
+			continue
+		}
+
+		encrypted, err := encryptBackup(b.key, data)
+		if err != nil {
+			b.log.Error("Failed to encrypt accounts backup", zap.Error(err))
+			continue
+		}
+
+		name := fmt.Sprintf("accounts-%s.json.enc", time.Now().UTC().Format("20060102T150405Z"))
+		if b.s3 != nil {
+			err = b.pushS3(name, encrypted)
+			if err != nil {
+				b.log.Error("Failed to push accounts backup to S3", zap.Error(err))
+				continue
+			}
+		}
+
+		if b.config.Git != nil {
+			err = b.pushGit(name, encrypted)
+			if err != nil {
+				b.log.Error("Failed to push accounts backup to git", zap.Error(err))
+				continue
+			}
+		}
+
+		b.lastHash = hash
+		b.log.Info("Pushed accounts backup", zap.String("name", name), zap.String("sha256", hash))
+	}
+}
+
+func (b *accountsBackup) pushS3(name string, data []byte) error {
+	_, err := b.s3.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(b.config.S3.Bucket),
+		Key:    aws.String(filepath.ToSlash(filepath.Join(b.config.S3.Prefix, name))),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+func (b *accountsBackup) pushGit(name string, data []byte) error {
+	repo := b.config.Git.RepoPath
+	err := ioutil.WriteFile(filepath.Join(repo, name), data, 0600)
+	if err != nil {
+		return err
+	}
+
+	commands := [][]string{
+		{"add", name},
+		{"commit", "-q", "-m", "Accounts backup " + name},
+	}
+	if b.config.Git.Remote != "" {
+		branch := b.config.Git.Branch
+		if branch == "" {
+			branch = "master"
+		}
+		commands = append(commands, []string{"push", "-q", b.config.Git.Remote, "HEAD:" + branch})
+	}
+
+	for _, args := range commands {
+		output, err := exec.Command("git", append([]string{"-C", repo}, args...)...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("git %s: %v: %s", args[0], err, bytes.TrimSpace(output))
+		}
+	}
+
+	return nil
+}
+
+// Encrypts a snapshot with AES-GCM, prefixing the nonce
+func encryptBackup(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+// Decrypts a snapshot written by the accounts backup
+func DecryptBackup(config BackupConfig, data []byte) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(config.EncryptionKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("backup encryption_key must be 32 base64 encoded bytes")
+	}
+	return decryptBackup(key, data)
+}
+
+func decryptBackup(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("backup is too short")
+	}
+
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
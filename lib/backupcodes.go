@@ -0,0 +1,56 @@
+package bowser
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Backup codes are checked one after another, so they use a cheaper bcrypt cost
+// than passwords to keep MFA prompts responsive.
+const backupCodeCost = 10
+
+// Generates n single-use MFA backup codes, returning both the codes (to show the
+// user once) and their bcrypt hashes (to store on the account).
+func GenerateBackupCodes(n int) (codes []string, hashes []string, err error) {
+	for i := 0; i < n; i++ {
+		raw := make([]byte, 5)
+		if _, err = rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(raw))
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), backupCodeCost)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, string(hash))
+	}
+
+	return
+}
+
+func normalizeBackupCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.Replace(code, "-", "", -1)
+}
+
+// Returns the hash of the backup code that matches, or an empty string
+func (am *AccountMFA) matchBackupCode(code string) string {
+	code = normalizeBackupCode(code)
+	if code == "" {
+		return ""
+	}
+
+	for _, hash := range am.BackupCodes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			return hash
+		}
+	}
+
+	return ""
+}
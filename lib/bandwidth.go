@@ -0,0 +1,132 @@
+package bowser
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// A bandwidth limit in bytes per second for each direction, 0 meaning unlimited.
+// Upload is data the client sends to destinations, download data coming back.
+type BandwidthLimit struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// Throttles forwards. The top level limits are shared by every forward of a session
+// (accounts can set their own bandwidth instead), while the limits for a tag apply to
+// each forward to a destination carrying it, on top of the session's.
+type BandwidthConfig struct {
+	BandwidthLimit
+	Tags map[string]BandwidthLimit `json:"tags"`
+}
+
+// Returns the session wide limit for an account
+func (c BandwidthConfig) forAccount(account *Account) BandwidthLimit {
+	if account != nil && account.Bandwidth != nil {
+		return *account.Bandwidth
+	}
+	return c.BandwidthLimit
+}
+
+// Returns the per forward limit for a destination's tags, the lowest one for each
+// direction when several tags have a limit
+func (c BandwidthConfig) forTags(tags []string) BandwidthLimit {
+	lowest := func(current, limit int64) int64 {
+		if limit > 0 && (current == 0 || limit < current) {
+			return limit
+		}
+		return current
+	}
+
+	var limit BandwidthLimit
+	for _, tag := range tags {
+		if tagLimit, exists := c.Tags[tag]; exists {
+			limit.Upload = lowest(limit.Upload, tagLimit.Upload)
+			limit.Download = lowest(limit.Download, tagLimit.Download)
+		}
+	}
+	return limit
+}
+
+// A token bucket allowing up to a second worth of bytes as a burst. A nil limiter
+// doesn't limit anything.
+type bandwidthLimiter struct {
+	rate int64
+
+	lock sync.Mutex
+	next time.Time
+}
+
+func newBandwidthLimiter(rate int64) *bandwidthLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{rate: rate}
+}
+
+// Blocks until n more bytes may pass
+func (l *bandwidthLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	if earliest := now.Add(-time.Second); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.lock.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Writes are split into chunks this big, so slow limits still trickle data steadily
+const throttleChunkSize = 16 * 1024
+
+// Holds writes back to stay within every limiter
+type throttledWriter struct {
+	w        io.Writer
+	limiters []*bandwidthLimiter
+}
+
+// Wraps w in a throttledWriter when any of the limiters limits something
+func throttle(w io.Writer, limiters ...*bandwidthLimiter) io.Writer {
+	var active []*bandwidthLimiter
+	for _, limiter := range limiters {
+		if limiter != nil {
+			active = append(active, limiter)
+		}
+	}
+
+	if len(active) == 0 {
+		return w
+	}
+	return throttledWriter{w, active}
+}
+
+func (t throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > throttleChunkSize {
+			chunk = chunk[:throttleChunkSize]
+		}
+
+		for _, limiter := range t.limiters {
+			limiter.wait(len(chunk))
+		}
+
+		n, err := t.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
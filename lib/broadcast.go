@@ -0,0 +1,109 @@
+package bowser
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// Registers an interactive (destination picker) channel to receive broadcasts,
+// returning a function removing it again
+func (s *SSHSession) addTerminal(channel ssh.Channel) func() {
+	s.lock.Lock()
+	s.terminals = append(s.terminals, channel)
+	s.lock.Unlock()
+
+	return func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		for i, terminal := range s.terminals {
+			if terminal == channel {
+				s.terminals = append(s.terminals[:i], s.terminals[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Writes a message to the stderr of every interactive channel in the session,
+// returning how many it was written to
+func (s *SSHSession) broadcast(message string) int {
+	s.lock.Lock()
+	terminals := append([]ssh.Channel{}, s.terminals...)
+	s.lock.Unlock()
+
+	text := fmt.Sprintf("\r\n*** Message from the bastion administrators ***\r\n%s\r\n\r\n",
+		strings.Replace(strings.TrimRight(message, "\n"), "\n", "\r\n", -1))
+
+	delivered := 0
+	for _, terminal := range terminals {
+		if _, err := terminal.Stderr().Write([]byte(text)); err != nil {
+			s.log.Warn("Failed to write broadcast message", zap.Error(err))
+			continue
+		}
+		delivered++
+	}
+	return delivered
+}
+
+// POST /broadcast writes a message into every interactive session (optionally only
+// those of username), returning the sessions it reached. Sessions only forwarding
+// ports have no terminal to write to and are skipped.
+func (api *HTTPAPI) handleBroadcast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var payload struct {
+		Message  string `json:"message"`
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json payload")
+		return
+	}
+
+	if strings.TrimSpace(payload.Message) == "" {
+		writeError(w, http.StatusBadRequest, "message is required")
+		return
+	}
+
+	delivered := []string{}
+	skipped := 0
+	for _, session := range api.state.listSessions() {
+		if payload.Username != "" && session.Conn.User() != payload.Username {
+			continue
+		}
+
+		if session.broadcast(payload.Message) == 0 {
+			skipped++
+			continue
+		}
+
+		session.log.Info("Delivered broadcast message")
+		delivered = append(delivered, session.UUID)
+	}
+
+	api.state.log.Info(
+		"Broadcast message to sessions",
+		zap.Int("delivered", len(delivered)),
+		zap.Int("skipped", skipped))
+	api.state.audit.Emit(AuditEvent{
+		Type:     AuditAdminAction,
+		Username: payload.Username,
+		Reason:   "broadcast",
+		Fields:   map[string]string{"message": payload.Message, "sessions": strconv.Itoa(len(delivered))},
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"delivered": delivered,
+		"skipped":   skipped,
+	})
+}
@@ -2,6 +2,7 @@ package bowser
 
 import (
 	"crypto/rand"
+	"encoding/binary"
 	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/ssh"
 	"io/ioutil"
@@ -9,6 +10,9 @@ import (
 	"time"
 )
 
+// How long issued certificates are valid for, they are only used to login once
+const certificateValidity = 1 * time.Minute
+
 // CertificateAuthority represents an SSH CA that can generate/sign SSH user certificates
 type CertificateAuthority struct {
 	signer ssh.Signer
@@ -20,7 +24,19 @@ func NewCertificateAuthority(keyPath string) (ca *CertificateAuthority, err erro
 	if err != nil {
 		return
 	}
+	return newCertificateAuthorityFromKey(rawKeyData)
+}
+
+// Loads the CA from ca_key when it's set (usually as a secret reference), otherwise
+// from ca_key_path
+func (c *Config) loadCertificateAuthority() (*CertificateAuthority, error) {
+	if c.CAKey != "" {
+		return newCertificateAuthorityFromKey([]byte(c.CAKey))
+	}
+	return NewCertificateAuthority(c.CAKeyPath)
+}
 
+func newCertificateAuthorityFromKey(rawKeyData []byte) (ca *CertificateAuthority, err error) {
 	signer, err := ssh.ParsePrivateKey(rawKeyData)
 	if err != nil {
 		return
@@ -45,13 +61,20 @@ func (ca *CertificateAuthority) Generate(keyID, command string, validPrincipals,
 		return nil, nil, err
 	}
 
+	// Serials let single certificates be revoked
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, nil, err
+	}
+
 	cert := ssh.Certificate{
+		Serial:          binary.BigEndian.Uint64(serial[:]),
 		Key:             publicKey,
 		CertType:        ssh.UserCert,
 		KeyId:           keyID,
 		ValidPrincipals: validPrincipals,
 		ValidAfter:      uint64(time.Now().UTC().Add(-15 * time.Second).Unix()),
-		ValidBefore:     uint64(time.Now().UTC().Add(1 * time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().UTC().Add(certificateValidity).Unix()),
 	}
 
 	// These are required to be set, even if they are unused
@@ -0,0 +1,65 @@
+package bowser
+
+import (
+	"container/list"
+	"sync"
+)
+
+type aclCacheEntry struct {
+	key string
+	err error
+}
+
+// A fixed size LRU cache of ACL decisions, keyed by account and destination. Both
+// allowed (nil) and denied decisions are cached.
+type aclCache struct {
+	lock  sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newACLCache(size int) *aclCache {
+	return &aclCache{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Returns the cached entry for key, or nil if there is none
+func (c *aclCache) get(key string) *aclCacheEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, exists := c.items[key]
+	if !exists {
+		return nil
+	}
+
+	c.order.MoveToFront(element)
+	return element.Value.(*aclCacheEntry)
+}
+
+func (c *aclCache) put(key string, err error) {
+	if c.size <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, exists := c.items[key]; exists {
+		element.Value.(*aclCacheEntry).err = err
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&aclCacheEntry{key: key, err: err})
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*aclCacheEntry).key)
+	}
+}
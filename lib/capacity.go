@@ -0,0 +1,95 @@
+package bowser
+
+import (
+	"net"
+	"time"
+)
+
+// Message written to connections turned away while bowser is at capacity. SSH clients
+// display lines sent before the version exchange.
+const overloadedMessage = "bowser: too many connections, try again later\r\n"
+
+// Global bounds on concurrent TCP connections and in-flight handshakes, so a connection
+// flood can't exhaust file descriptors and memory. When at capacity, overload "reject"
+// closes new connections with a message, while "block" stops accepting until a slot
+// frees up, leaving connections queued in the kernel backlog. A limit of 0 disables it.
+type CapacityConfig struct {
+	MaxConnections int    `json:"max_connections"`
+	MaxHandshakes  int    `json:"max_handshakes"`
+	Overload       string `json:"overload"`
+}
+
+type capacity struct {
+	block       bool
+	connections chan struct{}
+	handshakes  chan struct{}
+}
+
+func newCapacity(config CapacityConfig) *capacity {
+	c := &capacity{block: config.Overload == "block"}
+	if config.MaxConnections > 0 {
+		c.connections = make(chan struct{}, config.MaxConnections)
+	}
+	if config.MaxHandshakes > 0 {
+		c.handshakes = make(chan struct{}, config.MaxHandshakes)
+	}
+	return c
+}
+
+func trySemaphore(sem chan struct{}) bool {
+	if sem == nil {
+		return true
+	}
+
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseSemaphore(sem chan struct{}) {
+	if sem != nil {
+		<-sem
+	}
+}
+
+// Waits for a connection and a handshake slot, used before accepting in block mode
+func (c *capacity) wait() {
+	if c.connections != nil {
+		c.connections <- struct{}{}
+	}
+	if c.handshakes != nil {
+		c.handshakes <- struct{}{}
+	}
+}
+
+// Takes a connection and a handshake slot if both are free
+func (c *capacity) tryAcquire() bool {
+	if !trySemaphore(c.connections) {
+		return false
+	}
+
+	if !trySemaphore(c.handshakes) {
+		releaseSemaphore(c.connections)
+		return false
+	}
+
+	return true
+}
+
+func (c *capacity) handshakeDone() {
+	releaseSemaphore(c.handshakes)
+}
+
+func (c *capacity) connectionDone() {
+	releaseSemaphore(c.connections)
+}
+
+// Turns a connection away with a message, without waiting on a slow client
+func (c *capacity) reject(conn net.Conn) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte(overloadedMessage))
+	conn.Close()
+}
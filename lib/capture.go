@@ -0,0 +1,122 @@
+package bowser
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Configuration for capturing the raw bytes of forwards to destinations carrying any of
+// the given host inventory tags. Each forward is written to its own file in directory,
+// and recording stops once max_bytes (64MB by default) were captured.
+type CaptureConfig struct {
+	Directory string   `json:"directory"`
+	Tags      []string `json:"tags"`
+	MaxBytes  int64    `json:"max_bytes"`
+}
+
+// Capture files start with this line, followed by a JSON header line and frames of a
+// direction byte, a big endian unix nanosecond timestamp (8 bytes), a big endian length
+// (4 bytes) and that many bytes of data.
+const captureMagic = "bowser-capture/v1\n"
+
+// Frame directions, from the user's point of view
+const (
+	captureSent     = '>'
+	captureReceived = '<'
+)
+
+type captureHeader struct {
+	SessionID   string    `json:"session_id"`
+	ForwardID   string    `json:"forward_id"`
+	Username    string    `json:"username"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	OpenedAt    time.Time `json:"opened_at"`
+}
+
+func (c CaptureConfig) matches(tags []string) bool {
+	return c.Directory != "" && firstCommonTag(tags, c.Tags) != ""
+}
+
+// The capture file of a single forward, written to from both copy directions
+type forwardCapture struct {
+	lock      sync.Mutex
+	file      *os.File
+	path      string
+	written   int64
+	limit     int64
+	truncated bool
+}
+
+func newForwardCapture(config CaptureConfig, header captureHeader) (*forwardCapture, error) {
+	path := filepath.Join(config.Directory, fmt.Sprintf("%s-%s.cap", header.SessionID, header.ForwardID))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(header)
+	if err == nil {
+		_, err = file.Write(append([]byte(captureMagic), append(data, '\n')...))
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	limit := config.MaxBytes
+	if limit <= 0 {
+		limit = 64 << 20
+	}
+	return &forwardCapture{file: file, path: path, limit: limit}, nil
+}
+
+// Records data copied in the given direction, until the size cap is reached
+func (c *forwardCapture) record(direction byte, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.truncated {
+		return
+	}
+
+	if remaining := c.limit - c.written; int64(len(data)) > remaining {
+		data = data[:remaining]
+		c.truncated = true
+	}
+
+	frame := make([]byte, 13, 13+len(data))
+	frame[0] = direction
+	binary.BigEndian.PutUint64(frame[1:9], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(frame[9:13], uint32(len(data)))
+
+	if _, err := c.file.Write(append(frame, data...)); err != nil {
+		c.truncated = true
+	}
+	c.written += int64(len(data))
+}
+
+func (c *forwardCapture) Close() error {
+	return c.file.Close()
+}
+
+// Writes through to w, recording everything written in the capture
+type captureWriter struct {
+	w         io.Writer
+	capture   *forwardCapture
+	direction byte
+}
+
+func (c captureWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if n > 0 {
+		c.capture.record(c.direction, p[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,135 @@
+package bowser
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A CertificateRecord describes one certificate the CA signed
+type CertificateRecord struct {
+	Serial       uint64    `json:"serial"`
+	KeyID        string    `json:"key_id"`
+	Principals   []string  `json:"principals"`
+	Username     string    `json:"username"`
+	SessionID    string    `json:"session_id"`
+	Destination  string    `json:"destination"`
+	Source       string    `json:"source"`
+	ForceCommand string    `json:"force_command,omitempty"`
+	IssuedAt     time.Time `json:"issued_at"`
+	ValidAfter   time.Time `json:"valid_after"`
+	ValidBefore  time.Time `json:"valid_before"`
+}
+
+// Appends every issued certificate to a file of JSON lines, which is never rotated or
+// truncated so it stays a complete record of what the CA signed
+type certificateLog struct {
+	path string
+
+	lock sync.Mutex
+	file *os.File
+}
+
+func openCertificateLog(path string) (*certificateLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &certificateLog{path: path, file: file}, nil
+}
+
+// Records a certificate, syncing it to disk before the certificate is handed out
+func (l *certificateLog) add(record CertificateRecord) error {
+	if l == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Returns the certificates issued within [since, until] matching the filters, which
+// are ignored when empty
+func (l *certificateLog) query(since, until time.Time, username string, serial uint64) ([]CertificateRecord, error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := []CertificateRecord{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record CertificateRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, err
+		}
+
+		if record.IssuedAt.Before(since) || record.IssuedAt.After(until) ||
+			username != "" && record.Username != username ||
+			serial != 0 && record.Serial != serial {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// GET /certs?since=24h lists issued certificates, optionally filtered by username and
+// serial. since and until accept either RFC3339 times or durations ago.
+func (api *HTTPAPI) handleListCerts(w http.ResponseWriter, r *http.Request) {
+	if api.state.certLog == nil {
+		writeError(w, http.StatusNotFound, "certificate log is not enabled")
+		return
+	}
+
+	now := time.Now()
+	query := r.URL.Query()
+	since, err := parseTimeParam(query.Get("since"), now.Add(-24*time.Hour), now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid since")
+		return
+	}
+
+	until, err := parseTimeParam(query.Get("until"), now, now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid until")
+		return
+	}
+
+	var serial uint64
+	if raw := query.Get("serial"); raw != "" {
+		serial, err = strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid serial")
+			return
+		}
+	}
+
+	records, err := api.state.certLog.query(since, until, query.Get("username"), serial)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, records)
+}
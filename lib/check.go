@@ -0,0 +1,134 @@
+package bowser
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/template"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Loads the config at path and everything it references the same way the server would
+// at startup, returning every problem found instead of stopping at the first. Meant to
+// be run in CI before deploying config changes.
+func CheckConfig(path string) []error {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return []error{fmt.Errorf("config: %v", err)}
+	}
+
+	problems := config.ValidateAccounts()
+
+	if config.CAKey != "" {
+		if _, err := ssh.ParsePrivateKey([]byte(config.CAKey)); err != nil {
+			problems = append(problems, fmt.Errorf("ca key: %v", err))
+		}
+	} else if err := checkPrivateKey(config.CAKeyPath); err != nil {
+		problems = append(problems, fmt.Errorf("ca key: %v", err))
+	}
+
+	for _, listener := range config.listeners() {
+		if err := checkPrivateKey(listener.HostKeyPath); err != nil {
+			problems = append(problems, fmt.Errorf("listener %s: host key: %v", listener.Bind, err))
+		}
+
+		if listener.Banner != "" {
+			if _, err := template.New("banner").Parse(listener.Banner); err != nil {
+				problems = append(problems, fmt.Errorf("listener %s: banner: %v", listener.Bind, err))
+			}
+		}
+	}
+
+	if _, err := config.loadUserCertAuthorities(); err != nil {
+		problems = append(problems, fmt.Errorf("trusted user cas: %v", err))
+	}
+
+	if _, err := config.loadMOTD(); err != nil {
+		problems = append(problems, fmt.Errorf("motd: %v", err))
+	}
+
+	if config.Picker.Enabled {
+		if _, err := knownhosts.New(config.Picker.KnownHostsPath); err != nil {
+			problems = append(problems, fmt.Errorf("picker known hosts: %v", err))
+		}
+	}
+
+	if config.Recording.Directory != "" {
+		if err := checkPrivateDirectory(config.Recording.Directory); err != nil {
+			problems = append(problems, fmt.Errorf("recording directory: %v", err))
+		}
+	}
+
+	if config.Capture.Directory != "" {
+		if err := checkPrivateDirectory(config.Capture.Directory); err != nil {
+			problems = append(problems, fmt.Errorf("capture directory: %v", err))
+		}
+	}
+
+	if config.APITLSCertPath != "" {
+		if _, err := tls.LoadX509KeyPair(config.APITLSCertPath, config.APITLSKeyPath); err != nil {
+			problems = append(problems, fmt.Errorf("api tls: %v", err))
+		}
+	}
+
+	if config.APIClientCAPath != "" {
+		data, err := ioutil.ReadFile(config.APIClientCAPath)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("api client ca: %v", err))
+		} else if !x509.NewCertPool().AppendCertsFromPEM(data) {
+			problems = append(problems, fmt.Errorf("api client ca: no certificates found in %s", config.APIClientCAPath))
+		}
+	}
+
+	return problems
+}
+
+// Private keys must parse and must not be readable by anyone but their owner
+func checkPrivateKey(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s is accessible by other users (mode %v)", path, info.Mode().Perm())
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := ssh.ParsePrivateKey(data); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// Recordings and captures hold session contents, the directories they're written to
+// must exist, be writable and not be readable by other users.
+func checkPrivateDirectory(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+
+	if info.Mode().Perm()&0007 != 0 {
+		return fmt.Errorf("%s is accessible by other users (mode %v)", path, info.Mode().Perm())
+	}
+
+	file, err := ioutil.TempFile(path, ".bowser-check")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %v", path, err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
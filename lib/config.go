@@ -3,44 +3,178 @@ package bowser
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"path"
 	"regexp"
+	"time"
 
 	"golang.org/x/crypto/pbkdf2"
 )
 
 type AccountMFA struct {
 	TOTP string `json:"totp"`
+
+	// bcrypt hashes of single-use backup codes, removed once used
+	BackupCodes []string `json:"backup_codes,omitempty"`
+
+	// Public IDs of the YubiKeys registered to the account
+	YubiKeys []string `json:"yubikeys,omitempty"`
+
+	// Whether "any" (the default) or "all" of the factors above are required
+	Policy string `json:"policy,omitempty"`
 }
 
 // Accounts represent individual users (auth keys) that can login
 type Account struct {
-	Username    string            `json:"username"`
-	Password    string            `json:"password"`
-	SSHKeysRaw  []string          `json:"ssh-keys"`
-	MFA         AccountMFA        `json:"mfa,omitempty"`
-	Whitelist   string            `json:"whitelist"`
-	Blacklist   string            `json:"blacklist"`
-	PlatformIDs map[string]string `json:"platform_ids"`
-	Principals  []string          `json:"principals"`
+	Username     string            `json:"username"`
+	Password     string            `json:"password"`
+	SSHKeysRaw   []string          `json:"ssh-keys"`
+	MFA          AccountMFA        `json:"mfa,omitempty"`
+	Whitelist    string            `json:"whitelist"`
+	Blacklist    string            `json:"blacklist"`
+	PlatformIDs  map[string]string `json:"platform_ids"`
+	Principals   []string          `json:"principals"`
+	AllowTags    []string          `json:"allow_tags"`
+	DenyTags     []string          `json:"deny_tags"`
+	Groups       []string          `json:"groups,omitempty"`
+	ForceUser    string            `json:"force_user,omitempty"`
+	ForceCommand string            `json:"force_command,omitempty"`
+	MaxSessions  int               `json:"max_sessions,omitempty"`
+	MaxForwards  int               `json:"max_forwards,omitempty"`
+	AllowPorts   []int             `json:"allow_ports,omitempty"`
+	DenyPorts    []int             `json:"deny_ports,omitempty"`
+	ExpiresAt    *time.Time        `json:"expires_at,omitempty"`
+	ArchivedAt   *time.Time        `json:"archived_at,omitempty"`
+
+	AllowCountries []string `json:"allow_countries"`
+	DenyCountries  []string `json:"deny_countries"`
+
+	RemoteForwardPorts []int `json:"remote_forward_ports,omitempty"`
+
+	Bandwidth *BandwidthLimit `json:"bandwidth,omitempty"`
 
 	whitelistRe *regexp.Regexp
 	blacklistRe *regexp.Regexp
 }
 
+// Configuration for TOTP validation. Skew is the number of periods before and after
+// the current one which are also accepted, to tolerate clock drift.
+type TOTPConfig struct {
+	Period uint `json:"period"`
+	Skew   uint `json:"skew"`
+
+	// The key TOTP secrets are sealed with in the accounts backend, either given
+	// directly or as a data key encrypted with AWS KMS
+	MasterKey  string `json:"master_key"`
+	KMSDataKey string `json:"kms_data_key"`
+	KMSRegion  string `json:"kms_region"`
+}
+
+// An entry in the host inventory, mapping a hostname (or glob pattern) to a set of tags.
+// ForceUser and ForceCommand apply to matching hosts unless the account sets its own,
+// and AllowPorts restricts the ports forwarded to on matching hosts.
+type Host struct {
+	Host         string   `json:"host"`
+	Tags         []string `json:"tags"`
+	ForceUser    string   `json:"force_user,omitempty"`
+	ForceCommand string   `json:"force_command,omitempty"`
+	AllowPorts   []int    `json:"allow_ports,omitempty"`
+}
+
 // The base config which stores mostly paths and some general configuration info
 type Config struct {
-	Bind                     string   `json:"bind"`
-	AccountsPath             string   `json:"accounts_path"`
-	IDRSAPath                string   `json:"id_rsa_path"`
-	CAKeyPath                string   `json:"ca_key_path"`
-	DiscordWebhooks          []string `json:"discord_webhooks"`
-	ForceCommand             string   `json:"force_command"`
-	ForceUser                string   `json:"force_user"`
-	PermittedSourceAddresses []string `json:"permitted_source_addresses"`
+	Bind                     string               `json:"bind"`
+	AccountsPath             string               `json:"accounts_path"`
+	IDRSAPath                string               `json:"id_rsa_path"`
+	CAKeyPath                string               `json:"ca_key_path"`
+	DiscordWebhooks          []string             `json:"discord_webhooks"`
+	SlackWebhooks            []SlackConfig        `json:"slack_webhooks"`
+	ForceCommand             string               `json:"force_command"`
+	ForceUser                string               `json:"force_user"`
+	PermittedSourceAddresses []string             `json:"permitted_source_addresses"`
+	Hosts                    []Host               `json:"hosts"`
+	WebhookQueueSize         int                  `json:"webhook_queue_size"`
+	ShutdownTimeout          int                  `json:"shutdown_timeout"`
+	APIBind                  string               `json:"api_bind"`
+	APIToken                 string               `json:"api_token"`
+	APIReadOnly              bool                 `json:"api_read_only"`
+	APITokens                []APITokenConfig     `json:"api_tokens"`
+	APITLSCertPath           string               `json:"api_tls_cert_path"`
+	APITLSKeyPath            string               `json:"api_tls_key_path"`
+	APIClientCAPath          string               `json:"api_client_ca_path"`
+	APIClients               []APIClientConfig    `json:"api_clients"`
+	APIClientCertPath        string               `json:"api_client_cert_path"`
+	APIClientKeyPath         string               `json:"api_client_key_path"`
+	Alerts                   AlertConfig          `json:"alerts"`
+	ACLCacheSize             int                  `json:"acl_cache_size"`
+	Audit                    AuditConfig          `json:"audit"`
+	RateLimit                RateLimitConfig      `json:"rate_limit"`
+	ForwardHistorySize       int                  `json:"forward_history_size"`
+	GeoIP                    GeoIPConfig          `json:"geoip"`
+	FeatureFlags             map[string]bool      `json:"feature_flags"`
+	TOTP                     TOTPConfig           `json:"totp"`
+	MFALockout               LockoutConfig        `json:"mfa_lockout"`
+	Yubico                   YubicoConfig         `json:"yubico"`
+	DialCacheTTL             int                  `json:"dial_cache_ttl"`
+	ArchiveRetention         int                  `json:"archive_retention"`
+	Listeners                []ListenerConfig     `json:"listeners"`
+	Backup                   BackupConfig         `json:"backup"`
+	AccountsBackend          string               `json:"accounts_backend"`
+	AccountsSQL              SQLStoreConfig       `json:"accounts_sql"`
+	AccountsSignatureKey     string               `json:"accounts_signature_key"`
+	AccountsCachePath        string               `json:"accounts_cache_path"`
+	AccountsRefresh          int                  `json:"accounts_refresh"`
+	Picker                   PickerConfig         `json:"picker"`
+	Identities               []IdentityMapping    `json:"identities"`
+	Keepalive                KeepaliveConfig      `json:"keepalive"`
+	MaxSessionsPerAccount    int                  `json:"max_sessions_per_account"`
+	MaxForwardsPerSession    int                  `json:"max_forwards_per_session"`
+	Capacity                 CapacityConfig       `json:"capacity"`
+	LogLevel                 string               `json:"log_level"`
+	LogModules               map[string]string    `json:"log_modules"`
+	LogFile                  string               `json:"log_file"`
+	LogEncoding              string               `json:"log_encoding"`
+	LogOutputs               []string             `json:"log_outputs"`
+	LogRotation              LogRotationConfig    `json:"log_rotation"`
+	ErrorReporting           ErrorReportingConfig `json:"error_reporting"`
+	ReadyMaxAccountsAge      int                  `json:"ready_max_accounts_age"`
+	MOTD                     string               `json:"motd"`
+	MOTDPath                 string               `json:"motd_path"`
+	DenyNetworks             []string             `json:"deny_networks"`
+	RemoteForwardBind        string               `json:"remote_forward_bind"`
+	Capture                  CaptureConfig        `json:"capture"`
+	Recording                RecordingConfig      `json:"recording"`
+	KRLPath                  string               `json:"krl_path"`
+	KRLWebhook               string               `json:"krl_webhook"`
+	WatchFiles               bool                 `json:"watch_files"`
+	Secrets                  SecretsConfig        `json:"secrets"`
+	CAKey                    string               `json:"ca_key"`
+	AuthTimeout              int                  `json:"auth_timeout"`
+	TrustedUserCAKeysPath    string               `json:"trusted_user_ca_keys_path"`
+	RevokedUserKeysPath      string               `json:"revoked_user_keys_path"`
+	UserCAPrincipals         map[string]string    `json:"user_ca_principals"`
+	SSHAlgorithms            AlgorithmsConfig     `json:"ssh_algorithms"`
+	CertLogPath              string               `json:"cert_log_path"`
+	SessionStore             *SQLStoreConfig      `json:"session_store"`
+	Discord                  []DiscordConfig      `json:"discord"`
+	Teams                    []TeamsConfig        `json:"teams"`
+	Bandwidth                BandwidthConfig      `json:"bandwidth"`
+	Aliases                  map[string]string    `json:"aliases"`
+
+	hash         string
+	store        accountStore
+	denyNetworks []*net.IPNet
+	secrets      secretsProvider
+	totpKey      []byte
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -54,34 +188,434 @@ func LoadConfig(path string) (*Config, error) {
 		AccountsPath: "accounts.json",
 		IDRSAPath:    "id_rsa",
 		CAKeyPath:    "ca.key",
+
+		WebhookQueueSize: 512,
+		ShutdownTimeout:  10,
+		ACLCacheSize:     4096,
+
+		ForwardHistorySize: 100000,
+		ArchiveRetention:   90,
+
+		AuthTimeout: 120,
+
+		Picker: PickerConfig{
+			Port: 22,
+		},
+
+		LogLevel: "info",
+
+		RemoteForwardBind: "localhost",
+
+		Keepalive: KeepaliveConfig{
+			Interval:  30,
+			MaxMissed: 3,
+		},
+
+		AccountsCachePath: "accounts.cache.json",
+		AccountsRefresh:   300,
+
+		Audit: AuditConfig{
+			QueueSize: 4096,
+		},
+
+		TOTP: TOTPConfig{
+			Period: 30,
+			Skew:   1,
+		},
+
+		MFALockout: LockoutConfig{
+			MaxFailures: 10,
+			Window:      900,
+			Duration:    900,
+		},
+
+		RateLimit: RateLimitConfig{
+			Window:               60,
+			ConnectionsPerWindow: 30,
+			AuthFailures:         30,
+			BanDuration:          900,
+			NetblockSizeIPv4:     32,
+			NetblockSizeIPv6:     128,
+		},
+
+		Alerts: AlertConfig{
+			Window:              300,
+			BadKeyThreshold:     20,
+			MFAFailureThreshold: 5,
+		},
+	}
+
+	result.secrets, err = loadSecretsProvider(file)
+	if err != nil {
+		return &result, err
 	}
 
-	err = json.Unmarshal(file, &result)
+	resolved, err := interpolateConfig(file, result.secrets)
+	if err != nil {
+		return &result, err
+	}
+
+	err = json.Unmarshal(resolved, &result)
+	if err != nil {
+		return &result, err
+	}
+
+	sum := sha256.Sum256(file)
+	result.hash = hex.EncodeToString(sum[:])
+
+	err = result.validate()
+	if err != nil {
+		return &result, err
+	}
+
+	result.totpKey, err = result.TOTP.masterKey()
+	if err != nil {
+		return &result, err
+	}
+
+	result.store, err = openAccountStore(&result)
 	return &result, err
 }
 
-func (c *Config) LoadAccounts() (acts []Account, err error) {
-	file, err := ioutil.ReadFile(c.AccountsPath)
-	if err != nil {
-		return
+func (c *Config) validate() error {
+	// Validate all host patterns up front, path.Match only reports bad patterns
+	//  when it is actually used.
+	for _, host := range c.Hosts {
+		if _, err := path.Match(host.Host, ""); err != nil {
+			return fmt.Errorf("invalid host pattern %q: %v", host.Host, err)
+		}
+	}
+
+	for _, mapping := range c.Identities {
+		if _, err := path.Match(mapping.Host, ""); err != nil {
+			return fmt.Errorf("invalid identity pattern %q: %v", mapping.Host, err)
+		}
+	}
+
+	if c.RateLimit.NetblockSizeIPv4 < 0 || c.RateLimit.NetblockSizeIPv4 > 32 ||
+		c.RateLimit.NetblockSizeIPv6 < 0 || c.RateLimit.NetblockSizeIPv6 > 128 {
+		return fmt.Errorf("invalid rate_limit netblock size")
+	}
+
+	if c.Capacity.Overload != "" && c.Capacity.Overload != "reject" && c.Capacity.Overload != "block" {
+		return fmt.Errorf("invalid capacity overload mode %q", c.Capacity.Overload)
+	}
+
+	if err := c.SSHAlgorithms.validate(); err != nil {
+		return err
+	}
+
+	if err := c.validateAliases(); err != nil {
+		return err
+	}
+
+	for _, discord := range c.Discord {
+		if _, err := compileNotificationTemplates(discord.Templates); err != nil {
+			return fmt.Errorf("invalid discord template: %v", err)
+		}
+	}
+
+	for _, slack := range c.SlackWebhooks {
+		if _, err := compileNotificationTemplates(slack.Templates); err != nil {
+			return fmt.Errorf("invalid slack template: %v", err)
+		}
+	}
+
+	for _, teams := range c.Teams {
+		if _, err := compileNotificationTemplates(teams.Templates); err != nil {
+			return fmt.Errorf("invalid teams template: %v", err)
+		}
+	}
+
+	if c.Picker.Enabled && c.Picker.KnownHostsPath == "" {
+		return fmt.Errorf("the destination picker requires picker.known_hosts_path")
+	}
+
+	if c.Picker.Port == 0 {
+		c.Picker.Port = 22
+	} else if c.Picker.Port < 0 || c.Picker.Port > 65535 {
+		return fmt.Errorf("invalid picker.port %d", c.Picker.Port)
+	}
+
+	for _, token := range c.APITokens {
+		if err := token.validate(); err != nil {
+			return err
+		}
+	}
+
+	if (c.APITLSCertPath == "") != (c.APITLSKeyPath == "") {
+		return fmt.Errorf("api_tls_cert_path and api_tls_key_path must be set together")
+	}
+
+	if c.APIClientCAPath != "" && c.APITLSCertPath == "" {
+		return fmt.Errorf("api_client_ca_path requires api_tls_cert_path")
+	}
+
+	for _, client := range c.APIClients {
+		if err := client.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Recording.Directory != "" && !c.Picker.Enabled {
+		return fmt.Errorf("session recording requires the destination picker")
+	}
+
+	c.denyNetworks = nil
+	for _, cidr := range c.DenyNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid deny network %q: %v", cidr, err)
+		}
+		c.denyNetworks = append(c.denyNetworks, network)
+	}
+
+	return nil
+}
+
+// Returns the sha256 hash of the config file this config was loaded from
+func (c *Config) Hash() string {
+	return c.hash
+}
+
+// Returns the names of optional features enabled by this config
+func (c *Config) Features() (features []string) {
+	if c.APIBind != "" {
+		features = append(features, "api")
+	}
+
+	if c.APIReadOnly {
+		features = append(features, "api-read-only")
+	}
+
+	if c.APITLSCertPath != "" {
+		features = append(features, "api-tls")
+	}
+
+	if c.APIClientCAPath != "" {
+		features = append(features, "api-mtls")
+	}
+
+	if len(c.DiscordWebhooks) > 0 || len(c.Discord) > 0 {
+		features = append(features, "discord")
+	}
+
+	if len(c.SlackWebhooks) > 0 {
+		features = append(features, "slack")
+	}
+
+	if len(c.Teams) > 0 {
+		features = append(features, "teams")
+	}
+
+	if c.Alerts.PagerDutyRoutingKey != "" {
+		features = append(features, "pagerduty")
+	}
+
+	if c.Alerts.OpsgenieAPIKey != "" {
+		features = append(features, "opsgenie")
+	}
+
+	if len(c.Hosts) > 0 {
+		features = append(features, "host-inventory")
+	}
+
+	if c.GeoIP.DatabasePath != "" {
+		features = append(features, "geoip")
+	}
+
+	if c.Picker.Enabled {
+		features = append(features, "destination-picker")
+	}
+
+	if c.Capture.Directory != "" {
+		features = append(features, "forward-capture")
+	}
+
+	if c.Recording.Directory != "" {
+		features = append(features, "session-recording")
+	}
+
+	if c.Secrets.Backend != "" {
+		features = append(features, "secrets-"+c.Secrets.Backend)
 	}
 
-	err = json.Unmarshal(file, &acts)
 	return
 }
 
-func (c *Config) SaveAccounts(acts []Account) (err error) {
-	data, err := json.MarshalIndent(acts, "", "  ")
-	if err != nil {
-		return
+// Returns all tags the host inventory applies to the given host
+func (c *Config) TagsFor(host string) (tags []string) {
+	for _, entry := range c.Hosts {
+		if hostMatches(entry.Host, host) {
+			tags = append(tags, entry.Tags...)
+		}
+	}
+	return
+}
+
+// Returns the user and command certificates for the given account and destination are
+// forced to, in order of the account (or its groups), the identity mappings (user
+// only), the host inventory and the config.
+func (c *Config) forcedLogin(account *Account, host string) (user, command string) {
+	user, command = account.ForceUser, account.ForceCommand
+	if user == "" {
+		user = c.mappedIdentity(account, host)
 	}
 
-	// TODO: consider adding sanity checks here
+	for _, entry := range c.Hosts {
+		if !hostMatches(entry.Host, host) {
+			continue
+		}
 
-	err = ioutil.WriteFile(c.AccountsPath, data, 644)
+		if user == "" {
+			user = entry.ForceUser
+		}
+		if command == "" {
+			command = entry.ForceCommand
+		}
+	}
+
+	if user == "" {
+		user = c.ForceUser
+	}
+	if command == "" {
+		command = c.ForceCommand
+	}
 	return
 }
 
+func (c *Config) loadAccountsFile() (*accountsFile, error) {
+	return c.accountStore().load()
+}
+
+// Loads accounts as they are stored, without group settings applied. Use this when
+// the accounts will be written back with SaveAccounts.
+func (c *Config) LoadAccounts() ([]Account, error) {
+	file, err := c.loadAccountsFile()
+	if err != nil {
+		return nil, err
+	}
+	return file.Accounts, nil
+}
+
+// Loads and compiles a single account by username
+func (c *Config) LoadAccount(username string) (*Account, error) {
+	accounts, err := c.LoadResolvedAccounts()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range accounts {
+		if accounts[i].Username == username {
+			account := accounts[i]
+			return &account, account.compile()
+		}
+	}
+
+	return nil, fmt.Errorf("no account named %s", username)
+}
+
+// Checks the accounts file for anything that would stop it from loading, returning
+// every problem found.
+func (c *Config) ValidateAccounts() []error {
+	accounts, err := c.LoadResolvedAccounts()
+	if err != nil {
+		return []error{err}
+	}
+
+	var problems []error
+	usernames := make(map[string]bool)
+	keys := make(map[string]string)
+	for i := range accounts {
+		account := &accounts[i]
+		if account.Username == "" {
+			problems = append(problems, fmt.Errorf("account %d has no username", i))
+			continue
+		}
+
+		if usernames[account.Username] {
+			problems = append(problems, fmt.Errorf("duplicate username %s", account.Username))
+		}
+		usernames[account.Username] = true
+
+		if err := account.compile(); err != nil {
+			problems = append(problems, fmt.Errorf("account %s: %v", account.Username, err))
+		}
+
+		if _, err := c.unsealTOTP(account.Username, account.MFA.TOTP); err != nil {
+			problems = append(problems, fmt.Errorf("account %s: %v", account.Username, err))
+		}
+
+		for _, raw := range account.SSHKeysRaw {
+			key, err := NewAccountKey(account, []byte(raw))
+			if err != nil {
+				problems = append(problems, fmt.Errorf("account %s: invalid ssh key: %v", account.Username, err))
+				continue
+			}
+
+			if other, exists := keys[key.ID()]; exists {
+				problems = append(problems, fmt.Errorf("ssh key shared by accounts %s and %s", other, account.Username))
+			}
+			keys[key.ID()] = account.Username
+		}
+	}
+
+	return problems
+}
+
+// Saves accounts, keeping any existing groups
+func (c *Config) SaveAccounts(acts []Account) error {
+	acts, _, err := c.sealAccounts(acts)
+	if err != nil {
+		return err
+	}
+	return c.accountStore().save(acts)
+}
+
+// Compiles the accounts whitelist and blacklist regexes
+func (a *Account) compile() (err error) {
+	if a.Whitelist != "" {
+		a.whitelistRe, err = regexp.Compile(a.Whitelist)
+		if err != nil {
+			return fmt.Errorf("failed to parse whitelist regex: %v", err)
+		}
+	}
+
+	if a.Blacklist != "" {
+		a.blacklistRe, err = regexp.Compile(a.Blacklist)
+		if err != nil {
+			return fmt.Errorf("failed to parse blacklist regex: %v", err)
+		}
+	}
+
+	if a.MFA.Policy != "" && a.MFA.Policy != MFAPolicyAny && a.MFA.Policy != MFAPolicyAll {
+		return fmt.Errorf("unknown mfa policy: %s", a.MFA.Policy)
+	}
+
+	return nil
+}
+
+// Encrypts a TOTP secret with a key derived from the accounts password
+func EncryptTOTP(password []byte, salt []byte, totp []byte) ([]byte, error) {
+	dk := pbkdf2.Key(password, salt, 10000, 32, sha1.New)
+
+	block, err := aes.NewCipher(dk)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := make([]byte, aes.BlockSize+len(totp))
+	iv := ciphertext[:aes.BlockSize]
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+
+	stream := cipher.NewCFBEncrypter(block, iv)
+	stream.XORKeyStream(ciphertext[aes.BlockSize:], totp)
+
+	return []byte(base64.URLEncoding.EncodeToString(ciphertext)), nil
+}
+
 func (am *AccountMFA) decryptTOTP(password []byte, salt []byte) (string, error) {
 	dk := pbkdf2.Key(password, salt, 10000, 32, sha1.New)
 
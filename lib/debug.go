@@ -0,0 +1,92 @@
+package bowser
+
+import (
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// A logRing keeps the most recent encoded log lines in memory, so they can be
+// included in support bundles without access to the hosts log files.
+type logRing struct {
+	lock  sync.Mutex
+	lines [][]byte
+	next  int
+	full  bool
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{lines: make([][]byte, size)}
+}
+
+func (l *logRing) Write(p []byte) (int, error) {
+	line := make([]byte, len(p))
+	copy(line, p)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.lines[l.next] = line
+	l.next = (l.next + 1) % len(l.lines)
+	if l.next == 0 {
+		l.full = true
+	}
+	return len(p), nil
+}
+
+func (l *logRing) Sync() error {
+	return nil
+}
+
+// Writes every buffered line, oldest first
+func (l *logRing) dump(w io.Writer) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	start := 0
+	if l.full {
+		start = l.next
+	}
+
+	for i := 0; i < len(l.lines); i++ {
+		line := l.lines[(start+i)%len(l.lines)]
+		if line != nil {
+			w.Write(line)
+		}
+	}
+}
+
+// GET /debug/goroutines, a full goroutine dump
+func (api *HTTPAPI) handleDebugGoroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	pprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// GET /debug/logs, recent log lines as newline delimited json
+func (api *HTTPAPI) handleDebugLogs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	api.state.logs.dump(w)
+}
+
+// GET /debug/runtime, a snapshot of runtime and daemon statistics
+func (api *HTTPAPI) handleDebugRuntime(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	accounts, keys := api.state.accountSet()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"time":        time.Now().UTC(),
+		"goroutines":  runtime.NumGoroutine(),
+		"sessions":    len(api.state.listSessions()),
+		"accounts":    len(accounts),
+		"keys":        len(keys),
+		"lockouts":    len(api.state.lockouts.list()),
+		"heap_alloc":  mem.HeapAlloc,
+		"heap_sys":    mem.HeapSys,
+		"num_gc":      mem.NumGC,
+		"pause_total": mem.PauseTotalNs,
+	})
+}
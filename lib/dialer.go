@@ -0,0 +1,94 @@
+package bowser
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Caches DNS results for a session, so clients opening many forwards to the same
+// destination in quick succession (e.g. SFTP) don't resolve it every time. Failed
+// lookups are cached as well, which keeps a retrying client from hammering DNS.
+type dialCache struct {
+	ttl    time.Duration
+	dialer net.Dialer
+
+	lock    sync.Mutex
+	entries map[string]*dialCacheEntry
+}
+
+type dialCacheEntry struct {
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+func newDialCache(ttl int, keepAlive time.Duration) *dialCache {
+	return &dialCache{
+		ttl:     time.Duration(ttl) * time.Second,
+		dialer:  net.Dialer{KeepAlive: keepAlive},
+		entries: make(map[string]*dialCacheEntry),
+	}
+}
+
+func (d *dialCache) resolve(host string) ([]string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{host}, nil
+	}
+
+	if d.ttl == 0 {
+		return net.LookupHost(host)
+	}
+
+	d.lock.Lock()
+	entry, exists := d.entries[host]
+	d.lock.Unlock()
+
+	if exists && time.Now().Before(entry.expires) {
+		return entry.addrs, entry.err
+	}
+
+	addrs, err := net.LookupHost(host)
+
+	d.lock.Lock()
+	d.entries[host] = &dialCacheEntry{addrs: addrs, err: err, expires: time.Now().Add(d.ttl)}
+	d.lock.Unlock()
+
+	return addrs, err
+}
+
+// Moves an address that worked to the front, so the next dial tries it first
+func (d *dialCache) prefer(host, addr string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	entry, exists := d.entries[host]
+	if !exists {
+		return
+	}
+
+	for i, other := range entry.addrs {
+		if other == addr && i != 0 {
+			addrs := append([]string{addr}, entry.addrs[:i]...)
+			entry.addrs = append(addrs, entry.addrs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Opens a TCP connection to one of the addresses host resolved to, trying each in
+// turn. Only the given addresses are dialed, so they can be vetted beforehand.
+func (d *dialCache) dial(host string, addrs []string, port string) (net.Conn, error) {
+	err := fmt.Errorf("%s has no addresses", host)
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = d.dialer.Dial("tcp", net.JoinHostPort(addr, port))
+		if err == nil {
+			d.prefer(host, addr)
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
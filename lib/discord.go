@@ -0,0 +1,202 @@
+package bowser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Configuration for a Discord provider posting rich embeds to a webhook. Events
+// limits which event types are sent (all of them when empty), and APIURL is the
+// externally reachable address of the HTTP API, used to link sessions in embeds.
+// Templates replace embeds with plain messages, see NotificationVars.
+type DiscordConfig struct {
+	WebhookURL string            `json:"webhook_url"`
+	Events     []string          `json:"events"`
+	APIURL     string            `json:"api_url"`
+	Templates  map[string]string `json:"templates"`
+}
+
+type MessagePayload struct {
+	Content string  `json:"content,omitempty"`
+	Embeds  []Embed `json:"embeds,omitempty"`
+}
+
+type Embed struct {
+	Title       string       `json:"title"`
+	Description string       `json:"description"`
+	URL         string       `json:"url"`
+	Color       uint         `json:"color"`
+	Fields      []EmbedField `json:"fields,omitempty"`
+	Timestamp   string       `json:"timestamp,omitempty"`
+	Footer      *EmbedFooter `json:"footer,omitempty"`
+}
+
+type EmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type EmbedFooter struct {
+	Text string `json:"text"`
+}
+
+type DiscordWebhookProvider struct {
+	URL    string
+	Events []string
+	APIURL string
+
+	templates notificationTemplates
+}
+
+func NewDiscordWebhookProvider(config DiscordConfig) DiscordWebhookProvider {
+	// Templates were already checked when the config was loaded
+	templates, _ := compileNotificationTemplates(config.Templates)
+	return DiscordWebhookProvider{
+		URL:       config.WebhookURL,
+		Events:    config.Events,
+		APIURL:    strings.TrimRight(config.APIURL, "/"),
+		templates: templates,
+	}
+}
+
+func (d DiscordWebhookProvider) PlatformName() string {
+	return "discord"
+}
+
+func (d DiscordWebhookProvider) send(payload MessagePayload) (err error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequest("POST", d.URL, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("discord returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (d DiscordWebhookProvider) wants(eventType string) bool {
+	if len(d.Events) == 0 {
+		return true
+	}
+
+	for _, wanted := range d.Events {
+		if wanted == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (d DiscordWebhookProvider) Notify(event WebhookEvent) error {
+	if !d.wants(event.Type) {
+		return nil
+	}
+
+	if content, templated, err := d.templates.render(event, d.PlatformName()); templated {
+		if err != nil {
+			return err
+		}
+		return d.send(MessagePayload{Content: content})
+	}
+
+	var title string
+	var color uint
+	switch event.Type {
+	case WebhookSessionStart:
+		title, color = fmt.Sprintf("%s connected", event.Username), 0x3aa3e3
+	case WebhookSessionEnd:
+		title, color = fmt.Sprintf("%s disconnected", event.Username), 0x3aa3e3
+	case WebhookForwardOpen:
+		title, color = fmt.Sprintf("%s@%s", event.Username, event.Destination), 7855479
+	case WebhookForwardClose:
+		title, color = fmt.Sprintf("%s@%s closed", event.Username, event.Destination), 0x999999
+	case WebhookRemoteForwardOpen:
+		title, color = fmt.Sprintf("%s exposed %s", event.Username, event.Destination), 7855479
+	case WebhookRemoteForwardClose:
+		title, color = fmt.Sprintf("%s closed %s", event.Username, event.Destination), 0x999999
+	case WebhookACLReject:
+		title, color = fmt.Sprintf("%s was denied access to %s", event.Username, event.Destination), 0xffcc00
+	case WebhookMFAFailure:
+		title, color = fmt.Sprintf("%s failed MFA", event.Username), 0xdd2e44
+	case WebhookSourceBanned:
+		title, color = fmt.Sprintf("%s was temporarily banned", event.Source), 0xdd2e44
+	default:
+		return nil
+	}
+
+	var fields []EmbedField
+	field := func(name, value string, inline bool) {
+		fields = append(fields, EmbedField{Name: name, Value: value, Inline: inline})
+	}
+
+	if platformID := event.PlatformIDs[d.PlatformName()]; platformID != "" {
+		field("User", fmt.Sprintf("<@%s>", platformID), true)
+	} else if event.Username != "" {
+		field("User", event.Username, true)
+	}
+
+	if event.Destination != "" {
+		field("Host", event.Destination, true)
+	}
+
+	if event.Country != "" {
+		field("Source", fmt.Sprintf("%s (%s)", event.Source, event.Country), true)
+	} else {
+		field("Source", event.Source, true)
+	}
+
+	if event.Reason != "" {
+		field("Reason", event.Reason, false)
+	}
+
+	if event.Type == WebhookSessionEnd || event.Type == WebhookForwardClose || event.Type == WebhookRemoteForwardClose {
+		field("Duration", event.Duration.String(), true)
+		field("Transferred", fmt.Sprintf("%d bytes sent, %d bytes received", event.BytesSent, event.BytesReceived), true)
+	}
+
+	if len(event.Traffic) > 0 {
+		field("Traffic", formatTraffic(event.Traffic), false)
+	} else if len(event.Destinations) > 0 {
+		field("Destinations", strings.Join(event.Destinations, ", "), false)
+	}
+
+	embed := Embed{
+		Title:     title,
+		Color:     color,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Footer:    &EmbedFooter{Text: "bowser " + VERSION},
+	}
+
+	if event.SessionID != "" {
+		field("Session", event.SessionID, false)
+
+		// Active sessions are under /sessions, ended ones only in the session history
+		if d.APIURL != "" {
+			embed.URL = fmt.Sprintf("%s/sessions/%s", d.APIURL, event.SessionID)
+			field("Links", fmt.Sprintf("[Session](%s) · [History](%s/history/sessions/%s)", embed.URL, d.APIURL, event.SessionID), false)
+		}
+	}
+
+	embed.Fields = fields
+	return d.send(MessagePayload{Embeds: []Embed{embed}})
+}
@@ -0,0 +1,314 @@
+package bowser
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The kinds of events email digests can contain
+const (
+	EmailNewCountry        = "new_country"
+	EmailDeniedDestination = "denied_destination"
+	EmailAccountLocked     = "account_locked"
+)
+
+// Configuration for emailing high severity events over SMTP. Events are collected
+// and sent as one digest every interval seconds (300 by default), of at most
+// max_events events, so an incident doesn't flood inboxes. TLS is either "starttls"
+// (the default), "tls" for implicit TLS (usually port 465) or "none".
+type EmailConfig struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	TLS      string   `json:"tls"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+
+	Events      []string `json:"events"`
+	Interval    int      `json:"interval"`
+	MaxEvents   int      `json:"max_events"`
+	MinSeverity string   `json:"min_severity"`
+}
+
+type emailEntry struct {
+	kind  string
+	event AuditEvent
+}
+
+// Sends digests of security events by email. Sources in new countries are detected
+// from session starts: the first country seen for a user after startup is learned
+// silently, every further country is reported.
+type EmailSink struct {
+	config EmailConfig
+	events map[string]bool
+	log    *zap.Logger
+
+	lock      sync.Mutex
+	pending   []emailEntry
+	omitted   int
+	countries map[string]map[string]bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewEmailSink(config EmailConfig, log *zap.Logger) (*EmailSink, error) {
+	if config.Host == "" || config.From == "" || len(config.To) == 0 {
+		return nil, fmt.Errorf("email requires a host, from and to")
+	}
+
+	switch config.TLS {
+	case "":
+		config.TLS = "starttls"
+	case "starttls", "tls", "none":
+	default:
+		return nil, fmt.Errorf("unknown email tls mode %s", config.TLS)
+	}
+
+	if config.Port == 0 {
+		config.Port = 587
+		if config.TLS == "tls" {
+			config.Port = 465
+		}
+	}
+
+	if config.Interval == 0 {
+		config.Interval = 300
+	}
+
+	if config.MaxEvents == 0 {
+		config.MaxEvents = 100
+	}
+
+	if len(config.Events) == 0 {
+		config.Events = []string{EmailNewCountry, EmailDeniedDestination, EmailAccountLocked}
+	}
+
+	events := make(map[string]bool)
+	for _, kind := range config.Events {
+		if kind != EmailNewCountry && kind != EmailDeniedDestination && kind != EmailAccountLocked {
+			return nil, fmt.Errorf("unknown email event %s", kind)
+		}
+		events[kind] = true
+	}
+
+	e := &EmailSink{
+		config:    config,
+		events:    events,
+		log:       log,
+		countries: make(map[string]map[string]bool),
+		done:      make(chan struct{}),
+	}
+
+	e.wg.Add(1)
+	go e.run()
+	return e, nil
+}
+
+func (e *EmailSink) Name() string {
+	return "email"
+}
+
+// Returns which kind of email event an audit event is, if any
+func (e *EmailSink) classify(event AuditEvent) string {
+	switch event.Type {
+	case AuditSessionStart:
+		if event.Country == "" || event.Username == "" {
+			return ""
+		}
+
+		seen, exists := e.countries[event.Username]
+		if !exists {
+			e.countries[event.Username] = map[string]bool{event.Country: true}
+			return ""
+		}
+
+		if seen[event.Country] {
+			return ""
+		}
+		seen[event.Country] = true
+		return EmailNewCountry
+	case AuditForwardReject:
+		// Only explicitly denied destinations are critical, plain misses aren't news
+		if event.Severity == AuditSeverityCritical {
+			return EmailDeniedDestination
+		}
+	case AuditAccountLocked:
+		return EmailAccountLocked
+	}
+	return ""
+}
+
+func (e *EmailSink) Emit(event AuditEvent) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	kind := e.classify(event)
+	if kind == "" || !e.events[kind] {
+		return nil
+	}
+
+	if len(e.pending) >= e.config.MaxEvents {
+		e.omitted++
+		return nil
+	}
+
+	e.pending = append(e.pending, emailEntry{kind, event})
+	return nil
+}
+
+func (e *EmailSink) run() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(e.config.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.flush(); err != nil {
+				e.log.Error("Failed to send email digest", zap.Error(err))
+			}
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// Sends whatever is pending as one digest. A failed digest is dropped rather than
+// retried, so a broken mail server can't grow it forever.
+func (e *EmailSink) flush() error {
+	e.lock.Lock()
+	entries, omitted := e.pending, e.omitted
+	e.pending, e.omitted = nil, 0
+	e.lock.Unlock()
+
+	if len(entries) == 0 {
+		return nil
+	}
+	return e.send(e.digest(entries, omitted))
+}
+
+var emailTitles = map[string]string{
+	EmailNewCountry:        "Connection from a new country",
+	EmailDeniedDestination: "Attempt to reach a denied destination",
+	EmailAccountLocked:     "Account locked",
+}
+
+func (e *EmailSink) digest(entries []emailEntry, omitted int) []byte {
+	counts := make(map[string]int)
+	for _, entry := range entries {
+		counts[entry.kind]++
+	}
+
+	var kinds []string
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	var summary []string
+	for _, kind := range kinds {
+		summary = append(summary, fmt.Sprintf("%d %s", counts[kind], strings.Replace(kind, "_", " ", -1)))
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", e.config.From)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(e.config.To, ", "))
+	fmt.Fprintf(&body, "Subject: [bowser] %d security events: %s\r\n", len(entries)+omitted, strings.Join(summary, ", "))
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	body.WriteString("MIME-Version: 1.0\r\n")
+	body.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+
+	for _, entry := range entries {
+		event := entry.event
+		fmt.Fprintf(&body, "%s - %s\r\n", event.Time.UTC().Format(time.RFC3339), emailTitles[entry.kind])
+		for _, field := range auditFields(event) {
+			fmt.Fprintf(&body, "  %s: %s\r\n", field[0], field[1])
+		}
+		body.WriteString("\r\n")
+	}
+
+	if omitted > 0 {
+		fmt.Fprintf(&body, "%d more events were omitted, see the audit log for them.\r\n", omitted)
+	}
+	return body.Bytes()
+}
+
+func (e *EmailSink) send(message []byte) error {
+	address := net.JoinHostPort(e.config.Host, strconv.Itoa(e.config.Port))
+	tlsConfig := &tls.Config{ServerName: e.config.Host}
+
+	var conn net.Conn
+	var err error
+	if e.config.TLS == "tls" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", address, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", address, 10*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	client, err := smtp.NewClient(conn, e.config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if e.config.TLS == "starttls" {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if e.config.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", e.config.Username, e.config.Password, e.config.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(e.config.From); err != nil {
+		return err
+	}
+
+	for _, to := range e.config.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// Stops the digest timer and sends what's left
+func (e *EmailSink) Close() error {
+	close(e.done)
+	e.wg.Wait()
+	return e.flush()
+}
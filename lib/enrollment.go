@@ -0,0 +1,200 @@
+package bowser
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// An Enrollment is a one-time token an admin mints for a new user, which the user
+// later redeems to submit their own SSH key, password and TOTP secret.
+type Enrollment struct {
+	Token     string    `json:"token"`
+	Username  string    `json:"username"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// Settings copied onto the account once the enrollment is redeemed
+	Whitelist   string            `json:"whitelist,omitempty"`
+	Blacklist   string            `json:"blacklist,omitempty"`
+	AllowTags   []string          `json:"allow_tags,omitempty"`
+	DenyTags    []string          `json:"deny_tags,omitempty"`
+	Principals  []string          `json:"principals,omitempty"`
+	PlatformIDs map[string]string `json:"platform_ids,omitempty"`
+}
+
+// The payload an invited user submits to redeem their enrollment. The password is
+// expected to already be bcrypt hashed and the TOTP secret encrypted with it, so
+// neither ever leaves the users machine in plaintext. The username must match the
+// one the enrollment was created for, as it salts the TOTP encryption.
+type EnrollRequest struct {
+	Token   string  `json:"token"`
+	Account Account `json:"account"`
+}
+
+type enrollmentStore struct {
+	sync.Mutex
+	pending map[string]*Enrollment
+}
+
+func newEnrollmentStore() *enrollmentStore {
+	return &enrollmentStore{pending: make(map[string]*Enrollment)}
+}
+
+func (es *enrollmentStore) create(enrollment Enrollment, ttl time.Duration) (*Enrollment, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+
+	enrollment.Token = hex.EncodeToString(raw)
+	enrollment.ExpiresAt = time.Now().UTC().Add(ttl)
+
+	es.Lock()
+	defer es.Unlock()
+	es.pending[enrollment.Token] = &enrollment
+	return &enrollment, nil
+}
+
+// Removes and returns the enrollment for a token, tokens can only ever be redeemed once
+func (es *enrollmentStore) redeem(token, username string) (*Enrollment, error) {
+	es.Lock()
+	defer es.Unlock()
+
+	enrollment, exists := es.pending[token]
+	if !exists || enrollment.Username != username {
+		return nil, fmt.Errorf("unknown enrollment token")
+	}
+
+	delete(es.pending, token)
+	if time.Now().UTC().After(enrollment.ExpiresAt) {
+		return nil, fmt.Errorf("enrollment token has expired")
+	}
+
+	return enrollment, nil
+}
+
+// POST /enrollments (admin), mints a one-time enrollment token for a new user
+func (api *HTTPAPI) handleCreateEnrollment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var payload struct {
+		Enrollment
+		TTL int `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json payload")
+		return
+	}
+
+	if payload.Username == "" {
+		writeError(w, http.StatusBadRequest, "username is required")
+		return
+	}
+
+	accounts, _ := api.state.accountSet()
+	if _, exists := accounts[payload.Username]; exists {
+		writeError(w, http.StatusConflict, "account already exists")
+		return
+	}
+
+	ttl := time.Duration(payload.TTL) * time.Second
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+
+	enrollment, err := api.state.enrollments.create(payload.Enrollment, ttl)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to generate token")
+		return
+	}
+
+	api.state.log.Info(
+		"Created enrollment",
+		zap.String("username", enrollment.Username),
+		zap.Time("expires-at", enrollment.ExpiresAt))
+	writeJSON(w, http.StatusOK, enrollment)
+}
+
+// POST /enroll, redeems an enrollment token and activates the new account
+func (api *HTTPAPI) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var payload EnrollRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json payload")
+		return
+	}
+
+	submitted := payload.Account
+	if submitted.Password == "" || submitted.MFA.TOTP == "" || len(submitted.SSHKeysRaw) == 0 {
+		writeError(w, http.StatusBadRequest, "password, mfa and ssh-keys are required")
+		return
+	}
+
+	if _, err := bcrypt.Cost([]byte(submitted.Password)); err != nil {
+		writeError(w, http.StatusBadRequest, "password must be bcrypt hashed")
+		return
+	}
+
+	// Keys belonging to another account would stop the accounts file from loading
+	_, keys := api.state.accountSet()
+	submittedKeys := make(map[string]bool)
+	for _, key := range submitted.SSHKeysRaw {
+		parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid ssh key")
+			return
+		}
+
+		id := string(parsed.Marshal())
+		if _, exists := keys[id]; exists || submittedKeys[id] {
+			writeError(w, http.StatusConflict, "ssh key is already registered")
+			return
+		}
+		submittedKeys[id] = true
+	}
+
+	enrollment, err := api.state.enrollments.redeem(payload.Token, submitted.Username)
+	if err != nil {
+		api.state.log.Warn("Rejected enrollment", zap.Error(err))
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	account := Account{
+		Username:    enrollment.Username,
+		Password:    submitted.Password,
+		SSHKeysRaw:  submitted.SSHKeysRaw,
+		MFA:         submitted.MFA,
+		Whitelist:   enrollment.Whitelist,
+		Blacklist:   enrollment.Blacklist,
+		AllowTags:   enrollment.AllowTags,
+		DenyTags:    enrollment.DenyTags,
+		Principals:  enrollment.Principals,
+		PlatformIDs: enrollment.PlatformIDs,
+	}
+
+	err = api.state.addAccount(account)
+	if err != nil {
+		api.state.log.Error("Failed to activate enrolled account", zap.String("username", account.Username), zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to activate account")
+		return
+	}
+
+	api.state.log.Info("Enrollment completed", zap.String("username", account.Username))
+	writeJSON(w, http.StatusOK, map[string]string{"username": account.Username})
+}
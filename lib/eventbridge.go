@@ -0,0 +1,111 @@
+package bowser
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+)
+
+// Configuration for publishing audit events to an AWS EventBridge bus. By default
+// only session lifecycle and policy violation events are published. Credentials
+// come from the standard AWS environment/instance profile chain.
+type EventBridgeConfig struct {
+	Region      string   `json:"region"`
+	EventBus    string   `json:"event_bus"`
+	Source      string   `json:"source"`
+	DetailType  string   `json:"detail_type"`
+	Events      []string `json:"events"`
+	MinSeverity string   `json:"min_severity"`
+}
+
+type EventBridgeSink struct {
+	config EventBridgeConfig
+	client *eventbridge.EventBridge
+	events map[string]bool
+}
+
+func NewEventBridgeSink(config EventBridgeConfig) (*EventBridgeSink, error) {
+	if config.EventBus == "" {
+		config.EventBus = "default"
+	}
+
+	if config.Source == "" {
+		config.Source = "bowser"
+	}
+
+	if len(config.Events) == 0 {
+		config.Events = []string{AuditSessionStart, AuditSessionEnd, AuditForwardReject}
+	}
+
+	awsConfig := aws.NewConfig()
+	if config.Region != "" {
+		awsConfig = awsConfig.WithRegion(config.Region)
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(map[string]bool)
+	for _, eventType := range config.Events {
+		events[eventType] = true
+	}
+
+	return &EventBridgeSink{
+		config: config,
+		client: eventbridge.New(sess),
+		events: events,
+	}, nil
+}
+
+func (e *EventBridgeSink) Name() string {
+	return "eventbridge"
+}
+
+func (e *EventBridgeSink) Emit(event AuditEvent) error {
+	if !e.events[event.Type] {
+		return nil
+	}
+
+	detail, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	// Without a configured detail type, the event type is used so rules can
+	//  match on it directly.
+	detailType := e.config.DetailType
+	if detailType == "" {
+		detailType = event.Type
+	}
+
+	result, err := e.client.PutEvents(&eventbridge.PutEventsInput{
+		Entries: []*eventbridge.PutEventsRequestEntry{
+			{
+				EventBusName: aws.String(e.config.EventBus),
+				Source:       aws.String(e.config.Source),
+				DetailType:   aws.String(detailType),
+				Detail:       aws.String(string(detail)),
+				Time:         aws.Time(event.Time),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if aws.Int64Value(result.FailedEntryCount) > 0 {
+		entry := result.Entries[0]
+		return fmt.Errorf("eventbridge rejected event: %s %s", aws.StringValue(entry.ErrorCode), aws.StringValue(entry.ErrorMessage))
+	}
+
+	return nil
+}
+
+func (e *EventBridgeSink) Close() error {
+	return nil
+}
@@ -0,0 +1,201 @@
+package bowser
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every audit event type, for validating stream filters
+var auditEventTypes = map[string]bool{
+	AuditAuthSuccess:         true,
+	AuditAuthFailure:         true,
+	AuditSessionStart:        true,
+	AuditSessionEnd:          true,
+	AuditForwardOpen:         true,
+	AuditForwardClose:        true,
+	AuditForwardReject:       true,
+	AuditCertIssued:          true,
+	AuditSourceBanned:        true,
+	AuditAdminAction:         true,
+	AuditAccountLocked:       true,
+	AuditLimitExceeded:       true,
+	AuditRemoteForwardOpen:   true,
+	AuditRemoteForwardClose:  true,
+	AuditRemoteForwardReject: true,
+}
+
+// How many events a subscriber may fall behind before it is disconnected
+const eventStreamBuffer = 256
+
+// How often idle streams get a comment, so proxies don't time them out
+const eventStreamKeepalive = 15 * time.Second
+
+type eventSubscriber struct {
+	events    chan AuditEvent
+	types     map[string]bool
+	usernames map[string]bool
+}
+
+func (s *eventSubscriber) matches(event AuditEvent) bool {
+	if len(s.types) > 0 && !s.types[event.Type] {
+		return false
+	}
+	return len(s.usernames) == 0 || s.usernames[event.Username]
+}
+
+// An audit sink fanning events out to everyone streaming /events/stream. Subscribers
+// which can't keep up are disconnected rather than slowing down the other sinks.
+type eventStream struct {
+	lock        sync.Mutex
+	subscribers map[*eventSubscriber]struct{}
+	closed      bool
+}
+
+func newEventStream() *eventStream {
+	return &eventStream{subscribers: make(map[*eventSubscriber]struct{})}
+}
+
+func (s *eventStream) Name() string {
+	return "stream"
+}
+
+func (s *eventStream) Emit(event AuditEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for subscriber := range s.subscribers {
+		if !subscriber.matches(event) {
+			continue
+		}
+
+		select {
+		case subscriber.events <- event:
+		default:
+			delete(s.subscribers, subscriber)
+			close(subscriber.events)
+		}
+	}
+	return nil
+}
+
+func (s *eventStream) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	for subscriber := range s.subscribers {
+		delete(s.subscribers, subscriber)
+		close(subscriber.events)
+	}
+	return nil
+}
+
+// Returns nil once the stream is closed
+func (s *eventStream) subscribe(types, usernames map[string]bool) *eventSubscriber {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	subscriber := &eventSubscriber{
+		events:    make(chan AuditEvent, eventStreamBuffer),
+		types:     types,
+		usernames: usernames,
+	}
+	s.subscribers[subscriber] = struct{}{}
+	return subscriber
+}
+
+func (s *eventStream) unsubscribe(subscriber *eventSubscriber) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, exists := s.subscribers[subscriber]; exists {
+		delete(s.subscribers, subscriber)
+		close(subscriber.events)
+	}
+}
+
+// Collects a filter given as repeated and/or comma separated query values
+func streamFilter(values []string) map[string]bool {
+	filter := make(map[string]bool)
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				filter[item] = true
+			}
+		}
+	}
+	return filter
+}
+
+// GET /events/stream sends every audit event as it happens, as server-sent events
+// named after the event type with the JSON encoded event as data. `type` and
+// `username` (repeated or comma separated) only send matching events. Streams end
+// when a client falls too far behind, so clients should reconnect.
+func (api *HTTPAPI) handleEventStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	query := r.URL.Query()
+	types := streamFilter(query["type"])
+	for eventType := range types {
+		if !auditEventTypes[eventType] {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown event type %s", eventType))
+			return
+		}
+	}
+
+	subscriber := api.state.events.subscribe(types, streamFilter(query["username"]))
+	if subscriber == nil {
+		writeError(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	defer api.state.events.unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventStreamKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case event, ok := <-subscriber.events:
+			if !ok {
+				return
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,99 @@
+package bowser
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The timestamp formats OpenSSH accepts for the expiry-time key option
+var keyExpiryFormats = []string{"20060102", "200601021504", "20060102150405"}
+
+// Parses an expiry-time="YYYYMMDD[HHMM[SS]]" authorized_keys option (in UTC), returning
+// a zero time if the key has none.
+func parseKeyExpiry(options []string) (time.Time, error) {
+	for _, option := range options {
+		if !strings.HasPrefix(option, "expiry-time=") {
+			continue
+		}
+
+		value := strings.Trim(strings.TrimPrefix(option, "expiry-time="), `"`)
+		for _, format := range keyExpiryFormats {
+			if len(value) == len(format) {
+				return time.Parse(format, value)
+			}
+		}
+
+		return time.Time{}, fmt.Errorf("invalid expiry-time %q", value)
+	}
+
+	return time.Time{}, nil
+}
+
+// Whether the account has passed its expires_at date
+func (a *Account) expired(now time.Time) bool {
+	return a.ExpiresAt != nil && !now.Before(*a.ExpiresAt)
+}
+
+// Whether the key has passed its expiry-time
+func (key *AccountKey) expired(now time.Time) bool {
+	return !key.ExpiresAt.IsZero() && !now.Before(key.ExpiresAt)
+}
+
+// An account or key with an expiration date
+type Expiration struct {
+	Username  string    `json:"username"`
+	Key       string    `json:"key,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Expired   bool      `json:"expired"`
+}
+
+// GET /expirations?within=168h, lists accounts and keys expiring within the given
+// duration (a week by default), including ones which already expired.
+func (api *HTTPAPI) handleListExpirations(w http.ResponseWriter, r *http.Request) {
+	within := 7 * 24 * time.Hour
+	if value := r.URL.Query().Get("within"); value != "" {
+		var err error
+		within, err = time.ParseDuration(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid within duration")
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	cutoff := now.Add(within)
+
+	accounts, keys := api.state.accountSet()
+	expirations := []Expiration{}
+	for _, account := range accounts {
+		if account.ExpiresAt != nil && account.ExpiresAt.Before(cutoff) {
+			expirations = append(expirations, Expiration{
+				Username:  account.Username,
+				ExpiresAt: *account.ExpiresAt,
+				Expired:   account.expired(now),
+			})
+		}
+	}
+
+	for _, key := range keys {
+		if !key.ExpiresAt.IsZero() && key.ExpiresAt.Before(cutoff) {
+			expirations = append(expirations, Expiration{
+				Username:  key.Account.Username,
+				Key:       ssh.FingerprintSHA256(key.Key),
+				ExpiresAt: key.ExpiresAt,
+				Expired:   key.expired(now),
+			})
+		}
+	}
+
+	sort.Slice(expirations, func(i, j int) bool {
+		return expirations[i].ExpiresAt.Before(expirations[j].ExpiresAt)
+	})
+
+	writeJSON(w, http.StatusOK, expirations)
+}
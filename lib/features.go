@@ -0,0 +1,155 @@
+package bowser
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+type featureFlag struct {
+	Default     bool
+	Description string
+
+	// Security sensitive flags can only be changed in the config file, never at
+	//  runtime through the API.
+	Security bool
+}
+
+// Every feature flag bowser knows about
+var featureFlags = map[string]featureFlag{
+	"acl-cache": {
+		Default:     true,
+		Description: "memoize ACL decisions between account reloads",
+	},
+	"forward-history": {
+		Default:     true,
+		Description: "keep completed forwards in memory for analytics",
+	},
+	"geoip-restrictions": {
+		Default:     true,
+		Description: "enforce GeoIP country allow/deny lists",
+		Security:    true,
+	},
+	"rate-limiting": {
+		Default:     true,
+		Description: "rate limit and ban abusive sources",
+		Security:    true,
+	},
+}
+
+// FeatureFlags holds the current state of every feature flag
+type FeatureFlags struct {
+	lock  sync.RWMutex
+	flags map[string]bool
+}
+
+// Builds the feature flags from their defaults and the configured overrides
+func NewFeatureFlags(overrides map[string]bool) (*FeatureFlags, error) {
+	flags := make(map[string]bool)
+	for name, flag := range featureFlags {
+		flags[name] = flag.Default
+	}
+
+	for name, enabled := range overrides {
+		if _, exists := featureFlags[name]; !exists {
+			return nil, fmt.Errorf("unknown feature flag %q", name)
+		}
+		flags[name] = enabled
+	}
+
+	return &FeatureFlags{flags: flags}, nil
+}
+
+func (f *FeatureFlags) Enabled(name string) bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.flags[name]
+}
+
+// Changes a flag at runtime, refusing unknown and security sensitive flags
+func (f *FeatureFlags) Set(name string, enabled bool) error {
+	flag, exists := featureFlags[name]
+	if !exists {
+		return fmt.Errorf("unknown feature flag %q", name)
+	}
+
+	if flag.Security {
+		return fmt.Errorf("feature flag %q is security sensitive and can only be changed in the config", name)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.flags[name] = enabled
+	return nil
+}
+
+type jsonFeatureFlag struct {
+	Name        string `json:"name"`
+	Enabled     bool   `json:"enabled"`
+	Default     bool   `json:"default"`
+	Security    bool   `json:"security"`
+	Description string `json:"description"`
+}
+
+func (f *FeatureFlags) list() []jsonFeatureFlag {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	var result []jsonFeatureFlag
+	for name, flag := range featureFlags {
+		result = append(result, jsonFeatureFlag{
+			Name:        name,
+			Enabled:     f.flags[name],
+			Default:     flag.Default,
+			Security:    flag.Security,
+			Description: flag.Description,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// GET /features, lists every feature flag and its current state
+func (api *HTTPAPI) handleListFeatures(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.state.features.list())
+}
+
+// PUT /features/:name {"enabled": bool}, flips a non-security feature flag until
+// the next restart
+func (api *HTTPAPI) handleSetFeature(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/features/")
+
+	var payload struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json payload")
+		return
+	}
+
+	if err := api.state.features.Set(name, payload.Enabled); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	api.state.log.Info("Feature flag changed", zap.String("flag", name), zap.Bool("enabled", payload.Enabled))
+	api.state.audit.Emit(AuditEvent{
+		Type:   AuditAdminAction,
+		Reason: "feature flag changed",
+		Fields: map[string]string{"flag": name, "enabled": fmt.Sprintf("%t", payload.Enabled)},
+	})
+	writeJSON(w, http.StatusOK, api.state.features.list())
+}
@@ -0,0 +1,114 @@
+package bowser
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// A Forward is one open direct-tcpip channel within a session
+type Forward struct {
+	// Updated atomically while the forward is open, must stay first for 64-bit
+	//  alignment.
+	bytesSent     int64
+	bytesReceived int64
+
+	ID          string
+	Destination string
+	OpenedAt    time.Time
+
+	close func()
+}
+
+// The JSON representation of a forward for the HTTP API
+type JSONForward struct {
+	ID            string    `json:"id"`
+	Destination   string    `json:"destination"`
+	OpenedAt      time.Time `json:"opened_at"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+}
+
+func (f *Forward) toJSON() JSONForward {
+	return JSONForward{
+		ID:            f.ID,
+		Destination:   f.Destination,
+		OpenedAt:      f.OpenedAt,
+		BytesSent:     atomic.LoadInt64(&f.bytesSent),
+		BytesReceived: atomic.LoadInt64(&f.bytesReceived),
+	}
+}
+
+// Tracks the open forwards of a session, forwards are removed once they close
+type forwardRegistry struct {
+	lock     sync.Mutex
+	forwards map[string]*Forward
+	slots    int
+}
+
+func newForwardRegistry() *forwardRegistry {
+	return &forwardRegistry{forwards: make(map[string]*Forward)}
+}
+
+func (r *forwardRegistry) open(destination string, close func()) *Forward {
+	id, _ := uuid.NewV4().MarshalText()
+	forward := &Forward{
+		ID:          string(id),
+		Destination: destination,
+		OpenedAt:    time.Now().UTC(),
+		close:       close,
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.forwards[forward.ID] = forward
+	return forward
+}
+
+func (r *forwardRegistry) remove(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.forwards, id)
+}
+
+// Returns an open forward by its ID, or nil
+func (r *forwardRegistry) get(id string) *Forward {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.forwards[id]
+}
+
+func (r *forwardRegistry) list() []*Forward {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	forwards := make([]*Forward, 0, len(r.forwards))
+	for _, forward := range r.forwards {
+		forwards = append(forwards, forward)
+	}
+	return forwards
+}
+
+// Closes every open forward, they remove themselves once their copies finish
+func (r *forwardRegistry) closeAll() {
+	for _, forward := range r.list() {
+		forward.close()
+	}
+}
+
+// Counts bytes written through to w
+type countingWriter struct {
+	w        io.Writer
+	counters []*int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	for _, counter := range c.counters {
+		atomic.AddInt64(counter, int64(n))
+	}
+	return n, err
+}
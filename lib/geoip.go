@@ -0,0 +1,78 @@
+package bowser
+
+import (
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// The country code used for addresses we could not resolve (private ranges, or when
+// no database is configured).
+const unknownCountry = "--"
+
+// Configuration for GeoIP based source restrictions, using a MaxMind country (or
+// city) database. The allow/deny lists apply to every account, in addition to any
+// lists on the account itself.
+type GeoIPConfig struct {
+	DatabasePath   string   `json:"database_path"`
+	AllowCountries []string `json:"allow_countries"`
+	DenyCountries  []string `json:"deny_countries"`
+}
+
+type geoIP struct {
+	db *geoip2.Reader
+}
+
+func newGeoIP(config GeoIPConfig) (*geoIP, error) {
+	if config.DatabasePath == "" {
+		return &geoIP{}, nil
+	}
+
+	db, err := geoip2.Open(config.DatabasePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &geoIP{db: db}, nil
+}
+
+// Returns the ISO country code for a remote address
+func (g *geoIP) country(addr net.Addr) string {
+	if g.db == nil {
+		return unknownCountry
+	}
+
+	ip := net.ParseIP(remoteIP(addr))
+	if ip == nil {
+		return unknownCountry
+	}
+
+	record, err := g.db.Country(ip)
+	if err != nil || record.Country.IsoCode == "" {
+		return unknownCountry
+	}
+
+	return record.Country.IsoCode
+}
+
+// Whether a country passes an allow and deny list. An empty allow list allows every
+// country, unknown countries can be allowed by listing "--".
+func countryAllowed(country string, allow, deny []string) bool {
+	for _, denied := range deny {
+		if denied == country {
+			return false
+		}
+	}
+
+	if len(allow) == 0 {
+		return true
+	}
+
+	for _, allowed := range allow {
+		if allowed == country {
+			return true
+		}
+	}
+
+	return false
+}
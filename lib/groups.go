@@ -0,0 +1,115 @@
+package bowser
+
+import (
+	"fmt"
+)
+
+// Groups carry settings shared by many accounts. Accounts inherit every setting they
+// don't set themselves, from the first of their groups which does.
+type Group struct {
+	Name         string   `json:"name"`
+	Whitelist    string   `json:"whitelist"`
+	Blacklist    string   `json:"blacklist"`
+	AllowTags    []string `json:"allow_tags"`
+	DenyTags     []string `json:"deny_tags"`
+	ForceUser    string   `json:"force_user"`
+	ForceCommand string   `json:"force_command"`
+	MFAPolicy    string   `json:"mfa_policy"`
+	MaxSessions  int      `json:"max_sessions"`
+	MaxForwards  int      `json:"max_forwards"`
+	AllowPorts   []int    `json:"allow_ports"`
+	DenyPorts    []int    `json:"deny_ports"`
+
+	RemoteForwardPorts []int `json:"remote_forward_ports"`
+
+	Bandwidth *BandwidthLimit `json:"bandwidth"`
+}
+
+// The accounts file, either a plain list of accounts or an object with groups
+type accountsFile struct {
+	Groups   []Group   `json:"groups,omitempty"`
+	Accounts []Account `json:"accounts"`
+}
+
+// Fills in any settings the account leaves empty from its groups
+func (a *Account) inherit(groups map[string]*Group) error {
+	for _, name := range a.Groups {
+		group, exists := groups[name]
+		if !exists {
+			return fmt.Errorf("unknown group %s", name)
+		}
+
+		if a.Whitelist == "" {
+			a.Whitelist = group.Whitelist
+		}
+		if a.Blacklist == "" {
+			a.Blacklist = group.Blacklist
+		}
+		if len(a.AllowTags) == 0 {
+			a.AllowTags = group.AllowTags
+		}
+		if len(a.DenyTags) == 0 {
+			a.DenyTags = group.DenyTags
+		}
+		if a.ForceUser == "" {
+			a.ForceUser = group.ForceUser
+		}
+		if a.ForceCommand == "" {
+			a.ForceCommand = group.ForceCommand
+		}
+		if a.MFA.Policy == "" {
+			a.MFA.Policy = group.MFAPolicy
+		}
+		if a.MaxSessions == 0 {
+			a.MaxSessions = group.MaxSessions
+		}
+		if a.MaxForwards == 0 {
+			a.MaxForwards = group.MaxForwards
+		}
+		if len(a.AllowPorts) == 0 {
+			a.AllowPorts = group.AllowPorts
+		}
+		if len(a.DenyPorts) == 0 {
+			a.DenyPorts = group.DenyPorts
+		}
+		if len(a.RemoteForwardPorts) == 0 {
+			a.RemoteForwardPorts = group.RemoteForwardPorts
+		}
+		if a.Bandwidth == nil {
+			a.Bandwidth = group.Bandwidth
+		}
+	}
+
+	return nil
+}
+
+// Loads all accounts with their group settings applied
+func (c *Config) LoadResolvedAccounts() ([]Account, error) {
+	file, err := c.loadAccountsFile()
+	if err != nil {
+		return nil, err
+	}
+	return file.resolve()
+}
+
+// Applies group settings to the file's accounts, in place
+func (file *accountsFile) resolve() ([]Account, error) {
+	var err error
+	groups := make(map[string]*Group)
+	for i := range file.Groups {
+		group := &file.Groups[i]
+		if _, exists := groups[group.Name]; exists {
+			return nil, fmt.Errorf("duplicate group %s", group.Name)
+		}
+		groups[group.Name] = group
+	}
+
+	for i := range file.Accounts {
+		err = file.Accounts[i].inherit(groups)
+		if err != nil {
+			return nil, fmt.Errorf("account %s: %v", file.Accounts[i].Username, err)
+		}
+	}
+
+	return file.Accounts, nil
+}
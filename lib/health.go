@@ -0,0 +1,100 @@
+package bowser
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The result of one readiness check
+type JSONHealthCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func healthCheck(err error) JSONHealthCheck {
+	if err != nil {
+		return JSONHealthCheck{Error: err.Error()}
+	}
+	return JSONHealthCheck{OK: true}
+}
+
+// Records whether a listener is accepting connections, a nil error meaning it is
+func (s *SSHDState) setListenerHealth(bind string, err error) {
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	s.listenerErrors[bind] = err
+}
+
+func (s *SSHDState) checkListeners() error {
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+
+	if len(s.listenerErrors) == 0 {
+		return fmt.Errorf("no listeners are open")
+	}
+
+	for bind, err := range s.listenerErrors {
+		if err != nil {
+			return fmt.Errorf("listener %s: %v", bind, err)
+		}
+	}
+	return nil
+}
+
+// Makes sure the CA can still sign, e.g. that a hardware backed key is reachable
+func (s *SSHDState) checkCA() error {
+	_, err := s.ca.signer.Sign(rand.Reader, []byte("readyz"))
+	return err
+}
+
+// Makes sure accounts were loaded, and that remote accounts are not older than
+// ready_max_accounts_age
+func (s *SSHDState) checkAccounts() error {
+	s.healthLock.Lock()
+	loadedAt := s.accountsLoadedAt
+	s.healthLock.Unlock()
+
+	if loadedAt.IsZero() {
+		return fmt.Errorf("accounts were never loaded")
+	}
+
+	remote, ok := s.Config().accountStore().(*httpAccountStore)
+	maxAge := time.Duration(s.Config().ReadyMaxAccountsAge) * time.Second
+	if !ok || maxAge <= 0 {
+		return nil
+	}
+
+	if fetchedAt := remote.lastFetched(); time.Since(fetchedAt) > maxAge {
+		return fmt.Errorf("remote accounts were last fetched at %s: %v", fetchedAt.UTC().Format(time.RFC3339), remote.fetchError())
+	}
+	return nil
+}
+
+// GET /healthz reports whether the process is alive
+func (api *HTTPAPI) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// GET /readyz reports whether the bastion can serve users, failing with a 503 so load
+// balancers take it out of rotation
+func (api *HTTPAPI) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]JSONHealthCheck{
+		"listeners": healthCheck(api.state.checkListeners()),
+		"ca":        healthCheck(api.state.checkCA()),
+		"accounts":  healthCheck(api.state.checkAccounts()),
+	}
+
+	status, code := "ok", http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+
+	writeJSON(w, code, struct {
+		Status string                     `json:"status"`
+		Checks map[string]JSONHealthCheck `json:"checks"`
+	}{status, checks})
+}
@@ -0,0 +1,96 @@
+package bowser
+
+import (
+	"sync"
+	"time"
+)
+
+// A ForwardRecord describes a single completed forward
+type ForwardRecord struct {
+	Username      string    `json:"username"`
+	SessionID     string    `json:"session_id"`
+	Destination   string    `json:"destination"`
+	StartedAt     time.Time `json:"started_at"`
+	EndedAt       time.Time `json:"ended_at"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+}
+
+// Keeps the most recent completed forwards in a fixed size ring buffer
+type forwardHistory struct {
+	lock    sync.Mutex
+	records []ForwardRecord
+	next    int
+	full    bool
+}
+
+func newForwardHistory(size int) *forwardHistory {
+	return &forwardHistory{records: make([]ForwardRecord, size)}
+}
+
+func (h *forwardHistory) add(record ForwardRecord) {
+	if len(h.records) == 0 {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.records[h.next] = record
+	h.next = (h.next + 1) % len(h.records)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Returns all records which ended within [since, until]
+func (h *forwardHistory) between(since, until time.Time) (records []ForwardRecord) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	count := h.next
+	if h.full {
+		count = len(h.records)
+	}
+
+	for i := 0; i < count; i++ {
+		record := h.records[i]
+		if !record.EndedAt.Before(since) && !record.EndedAt.After(until) {
+			records = append(records, record)
+		}
+	}
+	return
+}
+
+// Aggregate usage of a single destination
+type DestinationUsage struct {
+	Destination   string `json:"destination"`
+	Forwards      int    `json:"forwards"`
+	UniqueUsers   int    `json:"unique_users"`
+	BytesSent     int64  `json:"bytes_sent"`
+	BytesReceived int64  `json:"bytes_received"`
+}
+
+func aggregateDestinations(records []ForwardRecord) []*DestinationUsage {
+	usage := make(map[string]*DestinationUsage)
+	users := make(map[string]map[string]bool)
+
+	var result []*DestinationUsage
+	for _, record := range records {
+		entry, exists := usage[record.Destination]
+		if !exists {
+			entry = &DestinationUsage{Destination: record.Destination}
+			usage[record.Destination] = entry
+			users[record.Destination] = make(map[string]bool)
+			result = append(result, entry)
+		}
+
+		entry.Forwards++
+		entry.BytesSent += record.BytesSent
+		entry.BytesReceived += record.BytesReceived
+		users[record.Destination][record.Username] = true
+		entry.UniqueUsers = len(users[record.Destination])
+	}
+
+	return result
+}
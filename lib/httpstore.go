@@ -0,0 +1,177 @@
+package bowser
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ed25519"
+)
+
+var remoteAccountsReadOnlyError = fmt.Errorf("remote accounts are read-only")
+
+// Loads accounts from an HTTPS URL. When a signature key is configured the file must
+// have a valid detached ed25519 signature at <url>.sig (raw or base64). The last good
+// copy is cached on disk and used whenever fetching fails.
+type httpAccountStore struct {
+	url       string
+	key       ed25519.PublicKey
+	cachePath string
+	client    *http.Client
+
+	lock      sync.Mutex
+	lastError error
+	fetchedAt time.Time
+}
+
+func newHTTPAccountStore(config *Config) (*httpAccountStore, error) {
+	store := &httpAccountStore{
+		url:       config.AccountsPath,
+		cachePath: config.AccountsCachePath,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+
+	if config.AccountsSignatureKey != "" {
+		key, err := base64.StdEncoding.DecodeString(config.AccountsSignatureKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("accounts_signature_key must be a base64 encoded ed25519 public key")
+		}
+		store.key = ed25519.PublicKey(key)
+	}
+
+	return store, nil
+}
+
+func (h *httpAccountStore) get(url string) ([]byte, error) {
+	resp, err := h.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Fetches, verifies and parses the remote accounts, caching them if all of that works
+func (h *httpAccountStore) fetch() (*accountsFile, error) {
+	data, err := h.get(h.url)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.key != nil {
+		signature, err := h.get(h.url + ".sig")
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch signature: %v", err)
+		}
+
+		if len(signature) != ed25519.SignatureSize {
+			signature, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+			if err != nil {
+				return nil, fmt.Errorf("invalid signature encoding: %v", err)
+			}
+		}
+
+		if !ed25519.Verify(h.key, data, signature) {
+			return nil, fmt.Errorf("invalid accounts signature")
+		}
+	}
+
+	file, err := parseAccountsFile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.cachePath != "" {
+		err = ioutil.WriteFile(h.cachePath, data, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to cache accounts: %v", err)
+		}
+	}
+
+	return file, nil
+}
+
+func (h *httpAccountStore) load() (*accountsFile, error) {
+	file, err := h.fetch()
+
+	h.lock.Lock()
+	h.lastError = err
+	if err == nil {
+		h.fetchedAt = time.Now()
+	}
+	h.lock.Unlock()
+
+	if err == nil {
+		return file, nil
+	}
+
+	// The cached copy was verified when it was written
+	if h.cachePath != "" {
+		if cached, cacheErr := (fileAccountStore{path: h.cachePath}).load(); cacheErr == nil {
+			return cached, nil
+		}
+	}
+
+	return nil, err
+}
+
+// Returns the error from the latest fetch, if it failed and the cache was used instead
+func (h *httpAccountStore) fetchError() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.lastError
+}
+
+// Returns when the accounts were last fetched successfully
+func (h *httpAccountStore) lastFetched() time.Time {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.fetchedAt
+}
+
+func (h *httpAccountStore) save(accounts []Account) error {
+	return remoteAccountsReadOnlyError
+}
+
+func (h *httpAccountStore) saveGroups(groups []Group) error {
+	return remoteAccountsReadOnlyError
+}
+
+func (h *httpAccountStore) snapshot() ([]byte, error) {
+	if h.cachePath != "" {
+		return ioutil.ReadFile(h.cachePath)
+	}
+
+	file, err := h.load()
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(file, "", "  ")
+}
+
+// Periodically reloads remote accounts, so changes are picked up without a SIGHUP
+func (s *SSHDState) refreshRemoteAccounts(store *httpAccountStore) {
+	interval := time.Duration(s.Config().AccountsRefresh) * time.Second
+	if interval <= 0 {
+		return
+	}
+
+	for {
+		time.Sleep(interval)
+		s.reloadAccounts()
+
+		if err := store.fetchError(); err != nil {
+			s.log.Warn("Failed to fetch remote accounts, using cached copy", zap.String("url", store.url), zap.Error(err))
+		}
+	}
+}
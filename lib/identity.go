@@ -0,0 +1,30 @@
+package bowser
+
+import (
+	"strings"
+)
+
+// Maps destinations matching a glob pattern to the user certificates log in as. The
+// user may contain {username}, which expands to the account's own username.
+type IdentityMapping struct {
+	Host string `json:"host"`
+	User string `json:"user"`
+}
+
+// Returns the user the first matching identity mapping gives the account on host, or
+// an empty string if none match.
+func (c *Config) mappedIdentity(account *Account, host string) string {
+	for _, mapping := range c.Identities {
+		if !hostMatches(mapping.Host, host) {
+			continue
+		}
+
+		user := strings.Replace(mapping.User, "{username}", account.Username, -1)
+		if user == "" {
+			user = account.Username
+		}
+		return user
+	}
+
+	return ""
+}
@@ -0,0 +1,94 @@
+package bowser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var envReferenceRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+const fileReferencePrefix = "file://"
+
+// Resolves references in every string value of a config file, so one file can be
+// deployed to several environments. `${NAME}` anywhere in a value is replaced by the
+// environment variable NAME, and a value of `file://<path>` is replaced by the
+// contents of that file without its trailing newline. A value of `secret://<name>`
+// is fetched from the secrets backend. Anything unresolvable is an error rather than
+// an empty value.
+func interpolateConfig(data []byte, secrets secretsProvider) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var raw interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	resolved, err := interpolateValue(raw, "", secrets)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(resolved)
+}
+
+func interpolateValue(value interface{}, path string, secrets secretsProvider) (interface{}, error) {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, item := range typed {
+			resolved, err := interpolateValue(item, strings.TrimPrefix(path+"."+key, "."), secrets)
+			if err != nil {
+				return nil, err
+			}
+			typed[key] = resolved
+		}
+	case []interface{}:
+		for i, item := range typed {
+			resolved, err := interpolateValue(item, fmt.Sprintf("%s[%d]", path, i), secrets)
+			if err != nil {
+				return nil, err
+			}
+			typed[i] = resolved
+		}
+	case string:
+		return interpolateString(typed, path, secrets)
+	}
+	return value, nil
+}
+
+func interpolateString(value, path string, secrets secretsProvider) (string, error) {
+	if strings.HasPrefix(value, secretReferencePrefix) {
+		resolved, err := resolveSecret(secrets, value)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", path, err)
+		}
+		return resolved, nil
+	}
+
+	if strings.HasPrefix(value, fileReferencePrefix) {
+		data, err := ioutil.ReadFile(strings.TrimPrefix(value, fileReferencePrefix))
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", path, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	var missing []string
+	result := envReferenceRe.ReplaceAllStringFunc(value, func(reference string) string {
+		name := envReferenceRe.FindStringSubmatch(reference)[1]
+		resolved, exists := os.LookupEnv(name)
+		if !exists {
+			missing = append(missing, name)
+		}
+		return resolved
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("%s: %s not set in the environment", path, strings.Join(missing, ", "))
+	}
+	return result, nil
+}
@@ -0,0 +1,147 @@
+package bowser
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// How to use a certificate provisioned by POST /sessions/:id/jump
+type JumpInstructions struct {
+	Destination string    `json:"destination"`
+	Username    string    `json:"username"`
+	Serial      uint64    `json:"serial"`
+	ValidBefore time.Time `json:"valid_before"`
+	ProxyJump   string    `json:"proxy_jump"`
+	Command     string    `json:"command"`
+}
+
+// Adds a certificate and its key to the session's forwarded agent
+func (s *SSHSession) provisionCertificate(cert *ssh.Certificate, privateKey *ed25519.PrivateKey) error {
+	agentChan, reqs, err := s.Conn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		return fmt.Errorf("failed to open ssh agent: %v", err)
+	}
+	go ssh.DiscardRequests(reqs)
+	defer agentChan.Close()
+
+	return agent.NewClient(agentChan).Add(agent.AddedKey{
+		PrivateKey:   privateKey,
+		Certificate:  cert,
+		LifetimeSecs: uint32(certificateValidity / time.Second),
+		Comment:      "temporary ssh certificate",
+	})
+}
+
+// POST /sessions/:id/jump with {"destination": "host[:port]"} checks the session's
+// account may reach the destination, adds a certificate for it to the session's
+// forwarded agent, and returns how to connect (through the bastion) before the
+// certificate expires. The port defaults to 22.
+func (api *HTTPAPI) handleJump(w http.ResponseWriter, r *http.Request, session *SSHSession) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var payload struct {
+		Destination string `json:"destination"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json payload")
+		return
+	}
+
+	host, rawPort := payload.Destination, "22"
+	if strings.Contains(host, ":") {
+		var err error
+		if host, rawPort, err = net.SplitHostPort(payload.Destination); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid destination")
+			return
+		}
+	}
+
+	requested, err := strconv.ParseUint(rawPort, 10, 16)
+	if host == "" || err != nil {
+		writeError(w, http.StatusBadRequest, "invalid destination")
+		return
+	}
+
+	// Checked, audited and issued for in the spelling forwards use
+	host = normalizeDestination(host)
+
+	target, port := api.state.Config().resolveAlias(host, uint32(requested))
+	address := net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	// The same checks a forward to the destination goes through
+	if err := api.state.canConnectTo(session.Account(), host); err != nil {
+		session.destinationRejected(host, address, err)
+		writeError(w, http.StatusForbidden, "invalid permissions")
+		return
+	}
+
+	if err := session.Account().canConnectToPort(api.state.Config(), host, int(port)); err != nil {
+		session.destinationRejected(host, address, err)
+		writeError(w, http.StatusForbidden, "invalid permissions")
+		return
+	}
+
+	if err := session.Account().canConnectToTarget(api.state.Config(), host, target, int(port)); err != nil {
+		session.destinationRejected(host, address, err)
+		writeError(w, http.StatusForbidden, "invalid permissions")
+		return
+	}
+
+	if api.state.Config().Recording.matches(api.state.Config().destinationTags(host, target)) {
+		session.destinationRejected(host, address, recordingRequiredError)
+		writeError(w, http.StatusForbidden, "this destination "+recordingRequiredError.Error())
+		return
+	}
+
+	// The agent receiving the certificate has to hold the account's key
+	if reason := session.proveKeyOwnership(); reason != "" {
+		writeError(w, http.StatusConflict, reason)
+		return
+	}
+
+	cert, privateKey, username, err := session.issueCertificate(host, address)
+	if err != nil {
+		session.log.Error("Failed to generate ssh certificate for jump", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to generate ssh certificate")
+		return
+	}
+
+	if err := session.provisionCertificate(cert, privateKey); err != nil {
+		session.log.Error("Failed to add jump certificate to agent", zap.Error(err))
+		writeError(w, http.StatusBadGateway, "failed to add ssh key/cert to agent")
+		return
+	}
+
+	session.log.Info("Provisioned jump certificate", zap.String("host", address), zap.Uint64("serial", cert.Serial))
+	api.state.audit.Emit(AuditEvent{
+		Type:        AuditAdminAction,
+		Username:    session.Conn.User(),
+		SessionID:   session.UUID,
+		Destination: address,
+		Reason:      "jump certificate provisioned",
+	})
+
+	// Clients reach the destination through the listener their session came in on
+	proxyJump := fmt.Sprintf("%s@%s", session.Conn.User(), session.Conn.LocalAddr())
+	writeJSON(w, http.StatusOK, JumpInstructions{
+		Destination: address,
+		Username:    username,
+		Serial:      cert.Serial,
+		ValidBefore: time.Unix(int64(cert.ValidBefore), 0).UTC(),
+		ProxyJump:   proxyJump,
+		Command:     fmt.Sprintf("ssh -J %s -p %d %s@%s", proxyJump, port, username, host),
+	})
+}
@@ -0,0 +1,101 @@
+package bowser
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// Configuration for publishing audit events as JSON to a Kafka topic. SASL mechanism
+// may be empty, "plain", "scram-sha-256" or "scram-sha-512".
+type KafkaConfig struct {
+	Brokers       []string `json:"brokers"`
+	Topic         string   `json:"topic"`
+	TLS           bool     `json:"tls"`
+	SASLMechanism string   `json:"sasl_mechanism"`
+	SASLUsername  string   `json:"sasl_username"`
+	SASLPassword  string   `json:"sasl_password"`
+	MinSeverity   string   `json:"min_severity"`
+}
+
+type KafkaSink struct {
+	writer *kafka.Writer
+}
+
+func NewKafkaSink(config KafkaConfig) (*KafkaSink, error) {
+	if len(config.Brokers) == 0 || config.Topic == "" {
+		return nil, fmt.Errorf("kafka sink requires brokers and a topic")
+	}
+
+	transport := &kafka.Transport{}
+	if config.TLS {
+		transport.TLS = &tls.Config{}
+	}
+
+	var mechanism sasl.Mechanism
+	var err error
+	switch config.SASLMechanism {
+	case "":
+	case "plain":
+		mechanism = plain.Mechanism{Username: config.SASLUsername, Password: config.SASLPassword}
+	case "scram-sha-256":
+		mechanism, err = scram.Mechanism(scram.SHA256, config.SASLUsername, config.SASLPassword)
+	case "scram-sha-512":
+		mechanism, err = scram.Mechanism(scram.SHA512, config.SASLUsername, config.SASLPassword)
+	default:
+		return nil, fmt.Errorf("unknown kafka sasl mechanism %q", config.SASLMechanism)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	transport.SASL = mechanism
+
+	return &KafkaSink{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(config.Brokers...),
+			Topic:        config.Topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			Transport:    transport,
+		},
+	}, nil
+}
+
+func (k *KafkaSink) Name() string {
+	return "kafka"
+}
+
+func (k *KafkaSink) Emit(event AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	// Keying by session (or username for pre-session events) keeps each sessions
+	//  events ordered within a partition.
+	key := event.SessionID
+	if key == "" {
+		key = event.Username
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return k.writer.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(key),
+		Value: data,
+		Time:  event.Time,
+	})
+}
+
+func (k *KafkaSink) Close() error {
+	return k.writer.Close()
+}
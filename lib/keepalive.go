@@ -0,0 +1,63 @@
+package bowser
+
+import (
+	"time"
+)
+
+// Configuration for server initiated keepalives. Every interval seconds a
+// keepalive@openssh.com request is sent, and connections which leave max_missed
+// requests in a row unanswered are closed. An interval of 0 disables keepalives.
+type KeepaliveConfig struct {
+	Interval  int `json:"interval"`
+	MaxMissed int `json:"max_missed"`
+}
+
+func (k KeepaliveConfig) interval() time.Duration {
+	return time.Duration(k.Interval) * time.Second
+}
+
+// Anything that global requests can be sent over, i.e. either side of an SSH connection
+type keepaliveConn interface {
+	SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error)
+}
+
+// Sends keepalives over conn until done is closed or the connection fails. Returns true
+// if the peer stopped answering. Any reply counts, since clients reject the request.
+func sendKeepalives(conn keepaliveConn, config KeepaliveConfig, done <-chan struct{}) bool {
+	if config.Interval <= 0 {
+		return false
+	}
+
+	ticker := time.NewTicker(config.interval())
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return false
+		case <-ticker.C:
+		}
+
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+
+		select {
+		case err := <-replied:
+			if err != nil {
+				return false
+			}
+			missed = 0
+		case <-time.After(config.interval()):
+			missed++
+			if missed >= config.MaxMissed {
+				return true
+			}
+		case <-done:
+			return false
+		}
+	}
+}
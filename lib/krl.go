@@ -0,0 +1,473 @@
+package bowser
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// Constants from OpenSSH's PROTOCOL.krl
+const (
+	krlMagic              = 0x5353484b524c0a00
+	krlFormatVersion      = 1
+	krlSectionCerts       = 1
+	krlSectionCertSerials = 0x20
+)
+
+// A certificate issued within a session
+type issuedCertificate struct {
+	Serial      uint64    `json:"serial"`
+	KeyID       string    `json:"key_id"`
+	Destination string    `json:"destination"`
+	ValidBefore time.Time `json:"valid_before"`
+}
+
+// Publishes revoked certificate serials as an OpenSSH key revocation list, which
+// destinations reference with RevokedKeys. Serials are dropped once their
+// certificates expired, keeping the list short.
+type revocationList struct {
+	path    string
+	webhook string
+	caKey   ssh.PublicKey
+	log     *zap.Logger
+
+	lock    sync.Mutex
+	version uint64
+	serials map[uint64]time.Time
+}
+
+func newRevocationList(config *Config, caKey ssh.PublicKey, log *zap.Logger) *revocationList {
+	return &revocationList{
+		path:    config.KRLPath,
+		webhook: config.KRLWebhook,
+		caKey:   caKey,
+		log:     log,
+		serials: make(map[uint64]time.Time),
+	}
+}
+
+func (l *revocationList) enabled() bool {
+	return l.path != "" || l.webhook != ""
+}
+
+// Revokes the given certificates and publishes the updated list
+func (l *revocationList) revoke(sessionID, username string, certs []issuedCertificate) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	for serial, validBefore := range l.serials {
+		if validBefore.Before(now) {
+			delete(l.serials, serial)
+		}
+	}
+
+	var serials []uint64
+	for _, cert := range certs {
+		serials = append(serials, cert.Serial)
+		if cert.ValidBefore.After(now) {
+			l.serials[cert.Serial] = cert.ValidBefore
+		}
+	}
+	l.version++
+
+	if l.webhook != "" {
+		go l.notify(sessionID, username, serials, l.version)
+	}
+
+	if l.path == "" {
+		return nil
+	}
+	return l.write()
+}
+
+// Builds the KRL binary, must be called with the lock held
+func (l *revocationList) encode() []byte {
+	var serials []byte
+	for serial := range l.serials {
+		serials = appendUint64(serials, serial)
+	}
+
+	var certs []byte
+	certs = appendString(certs, l.caKey.Marshal())
+	certs = appendString(certs, nil)
+	if len(serials) > 0 {
+		certs = append(certs, krlSectionCertSerials)
+		certs = appendString(certs, serials)
+	}
+
+	var krl []byte
+	krl = appendUint64(krl, krlMagic)
+	krl = appendUint32(krl, krlFormatVersion)
+	krl = appendUint64(krl, l.version)
+	krl = appendUint64(krl, uint64(time.Now().Unix()))
+	krl = appendUint64(krl, 0)
+	krl = appendString(krl, nil)
+	krl = appendString(krl, []byte("bowser revoked certificates"))
+	krl = append(krl, krlSectionCerts)
+	return appendString(krl, certs)
+}
+
+// Replaces the KRL file atomically, so destinations never read a partial list
+func (l *revocationList) write() error {
+	temp, err := ioutil.TempFile(filepath.Dir(l.path), ".krl")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = temp.Write(l.encode())
+	if err == nil {
+		err = temp.Chmod(0644)
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), l.path)
+}
+
+func (l *revocationList) notify(sessionID, username string, serials []uint64, version uint64) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"session_id":  sessionID,
+		"username":    username,
+		"serials":     serials,
+		"krl_version": version,
+	})
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(l.webhook, "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("webhook responded with %d", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		l.log.Error("Failed to notify revocation webhook", zap.Error(err))
+	}
+}
+
+func appendUint32(buf []byte, value uint32) []byte {
+	var data [4]byte
+	binary.BigEndian.PutUint32(data[:], value)
+	return append(buf, data[:]...)
+}
+
+func appendUint64(buf []byte, value uint64) []byte {
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], value)
+	return append(buf, data[:]...)
+}
+
+func appendString(buf []byte, value []byte) []byte {
+	return append(appendUint32(buf, uint32(len(value))), value...)
+}
+
+// POST /sessions/:id/revoke-certs revokes every certificate issued in a session
+func (api *HTTPAPI) handleRevokeCerts(w http.ResponseWriter, r *http.Request, session *SSHSession) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if !api.state.revocations.enabled() {
+		writeError(w, http.StatusBadRequest, "neither krl_path nor krl_webhook is configured")
+		return
+	}
+
+	session.lock.Lock()
+	certs := append([]issuedCertificate{}, session.certificates...)
+	session.lock.Unlock()
+
+	if err := api.state.revocations.revoke(session.UUID, session.Account().Username, certs); err != nil {
+		api.state.log.Error("Failed to publish revoked certificates", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, "failed to publish revoked certificates")
+		return
+	}
+
+	session.log.Warn("Revoked session certificates on admin request", zap.Int("certificates", len(certs)))
+	api.state.audit.Emit(AuditEvent{
+		Type:      AuditAdminAction,
+		Username:  session.Account().Username,
+		SessionID: session.UUID,
+		Reason:    "certificates revoked",
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"revoked": certs})
+}
+
+// Sections only needed when reading a KRL, also from PROTOCOL.krl
+const (
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+	krlSectionCertSerialRange   = 0x21
+	krlSectionCertSerialBitmap  = 0x22
+	krlSectionCertKeyIDs        = 0x23
+)
+
+var truncatedKRLError = fmt.Errorf("truncated krl")
+
+// The certificates revoked under one CA (or every CA when caKey is empty)
+type krlCertificates struct {
+	caKey   []byte
+	serials map[uint64]bool
+	ranges  [][2]uint64
+	keyIDs  map[string]bool
+}
+
+// A key revocation list read from a file, as written by ssh-keygen -k (or bowser)
+type parsedKRL struct {
+	keys   map[string]bool
+	sha1   map[string]bool
+	sha256 map[string]bool
+	certs  []*krlCertificates
+}
+
+type krlReader struct {
+	data []byte
+}
+
+func (r *krlReader) uint64() (uint64, error) {
+	if len(r.data) < 8 {
+		return 0, truncatedKRLError
+	}
+	value := binary.BigEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return value, nil
+}
+
+func (r *krlReader) string() ([]byte, error) {
+	if len(r.data) < 4 {
+		return nil, truncatedKRLError
+	}
+	length := binary.BigEndian.Uint32(r.data)
+	if uint64(len(r.data)-4) < uint64(length) {
+		return nil, truncatedKRLError
+	}
+	value := r.data[4 : 4+length]
+	r.data = r.data[4+length:]
+	return value, nil
+}
+
+func (r *krlReader) byte() (byte, error) {
+	if len(r.data) < 1 {
+		return 0, truncatedKRLError
+	}
+	value := r.data[0]
+	r.data = r.data[1:]
+	return value, nil
+}
+
+func loadKRL(path string) (*parsedKRL, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseKRL(data)
+}
+
+func parseKRL(data []byte) (*parsedKRL, error) {
+	reader := &krlReader{data: data}
+	magic, err := reader.uint64()
+	if err != nil || magic != krlMagic {
+		return nil, fmt.Errorf("not a krl")
+	}
+
+	// Format version, krl version, generated date and flags, then reserved and comment
+	if len(reader.data) < 4 {
+		return nil, truncatedKRLError
+	}
+	reader.data = reader.data[4:]
+	for i := 0; i < 3; i++ {
+		if _, err := reader.uint64(); err != nil {
+			return nil, err
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := reader.string(); err != nil {
+			return nil, err
+		}
+	}
+
+	krl := &parsedKRL{
+		keys:   make(map[string]bool),
+		sha1:   make(map[string]bool),
+		sha256: make(map[string]bool),
+	}
+
+	for len(reader.data) > 0 {
+		sectionType, err := reader.byte()
+		if err != nil {
+			return nil, err
+		}
+
+		section, err := reader.string()
+		if err != nil {
+			return nil, err
+		}
+
+		switch sectionType {
+		case krlSectionCerts:
+			certs, err := parseKRLCertificates(section)
+			if err != nil {
+				return nil, err
+			}
+			krl.certs = append(krl.certs, certs)
+		case krlSectionExplicitKey, krlSectionFingerprintSHA1, krlSectionFingerprintSHA256:
+			target := map[byte]map[string]bool{
+				krlSectionExplicitKey:       krl.keys,
+				krlSectionFingerprintSHA1:   krl.sha1,
+				krlSectionFingerprintSHA256: krl.sha256,
+			}[sectionType]
+
+			inner := &krlReader{data: section}
+			for len(inner.data) > 0 {
+				value, err := inner.string()
+				if err != nil {
+					return nil, err
+				}
+				target[string(value)] = true
+			}
+		case krlSectionSignature:
+			// Signatures come last and aren't verified, the file is trusted as is
+			return krl, nil
+		default:
+			return nil, fmt.Errorf("unknown krl section %d", sectionType)
+		}
+	}
+
+	return krl, nil
+}
+
+func parseKRLCertificates(section []byte) (*krlCertificates, error) {
+	reader := &krlReader{data: section}
+	caKey, err := reader.string()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := reader.string(); err != nil {
+		return nil, err
+	}
+
+	certs := &krlCertificates{
+		caKey:   caKey,
+		serials: make(map[uint64]bool),
+		keyIDs:  make(map[string]bool),
+	}
+
+	for len(reader.data) > 0 {
+		certType, err := reader.byte()
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := reader.string()
+		if err != nil {
+			return nil, err
+		}
+		inner := &krlReader{data: data}
+
+		switch certType {
+		case krlSectionCertSerials:
+			for len(inner.data) > 0 {
+				serial, err := inner.uint64()
+				if err != nil {
+					return nil, err
+				}
+				certs.serials[serial] = true
+			}
+		case krlSectionCertSerialRange:
+			min, err := inner.uint64()
+			if err != nil {
+				return nil, err
+			}
+
+			max, err := inner.uint64()
+			if err != nil {
+				return nil, err
+			}
+			certs.ranges = append(certs.ranges, [2]uint64{min, max})
+		case krlSectionCertSerialBitmap:
+			offset, err := inner.uint64()
+			if err != nil {
+				return nil, err
+			}
+
+			bitmap, err := inner.string()
+			if err != nil {
+				return nil, err
+			}
+
+			// The bitmap is a big endian mpint, bit 0 of its last byte is the offset
+			for i := range bitmap {
+				for bit := uint(0); bit < 8; bit++ {
+					if bitmap[len(bitmap)-1-i]&(1<<bit) != 0 {
+						certs.serials[offset+uint64(i)*8+uint64(bit)] = true
+					}
+				}
+			}
+		case krlSectionCertKeyIDs:
+			for len(inner.data) > 0 {
+				keyID, err := inner.string()
+				if err != nil {
+					return nil, err
+				}
+				certs.keyIDs[string(keyID)] = true
+			}
+		default:
+			return nil, fmt.Errorf("unknown krl certificate section %d", certType)
+		}
+	}
+
+	return certs, nil
+}
+
+// Checks a key, or a certificate and its signing CA, against the list
+func (k *parsedKRL) revoked(key ssh.PublicKey) bool {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		caKey := cert.SignatureKey.Marshal()
+		for _, certs := range k.certs {
+			if len(certs.caKey) > 0 && !bytes.Equal(certs.caKey, caKey) {
+				continue
+			}
+
+			if certs.serials[cert.Serial] || certs.keyIDs[cert.KeyId] {
+				return true
+			}
+
+			for _, serialRange := range certs.ranges {
+				if cert.Serial >= serialRange[0] && cert.Serial <= serialRange[1] {
+					return true
+				}
+			}
+		}
+
+		// The certificate's own key can be revoked too
+		if k.revoked(cert.Key) || k.revoked(cert.SignatureKey) {
+			return true
+		}
+		return false
+	}
+
+	blob := key.Marshal()
+	sha1Sum := sha1.Sum(blob)
+	sha256Sum := sha256.Sum256(blob)
+	return k.keys[string(blob)] || k.sha1[string(sha1Sum[:])] || k.sha256[string(sha256Sum[:])]
+}
@@ -0,0 +1,63 @@
+package bowser
+
+import (
+	"fmt"
+)
+
+var tooManySessionsError = fmt.Errorf("Too many concurrent sessions")
+
+// Returns the most sessions the account may have open at once, 0 meaning no limit
+func (s *SSHDState) sessionLimit(account *Account) int {
+	if account.MaxSessions > 0 {
+		return account.MaxSessions
+	}
+	return s.Config().MaxSessionsPerAccount
+}
+
+// Returns the most forwards a session of the account may have open at once, 0 meaning
+// no limit
+func (s *SSHDState) forwardLimit(account *Account) int {
+	if account.MaxForwards > 0 {
+		return account.MaxForwards
+	}
+	return s.Config().MaxForwardsPerSession
+}
+
+// Returns the number of sessions currently open for the given username
+func (s *SSHDState) accountSessions(username string) (count int) {
+	for _, session := range s.listSessions() {
+		if session.Account().Username == username {
+			count++
+		}
+	}
+	return
+}
+
+// Takes one of the session's forward slots, returning false if the account's forward
+// limit is reached. Slots are held by the channel handler until the forward closes.
+func (r *forwardRegistry) reserve(limit int) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if limit > 0 && r.slots >= limit {
+		return false
+	}
+	r.slots++
+	return true
+}
+
+func (r *forwardRegistry) release() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.slots--
+}
+
+// Reports a connection or forward rejected for exceeding a limit
+func (s *SSHDState) limitExceeded(event AuditEvent, limit int) {
+	event.Type = AuditLimitExceeded
+	if event.Fields == nil {
+		event.Fields = make(map[string]string)
+	}
+	event.Fields["limit"] = fmt.Sprintf("%d", limit)
+	s.audit.Emit(event)
+}
@@ -0,0 +1,43 @@
+package bowser
+
+// A listener with its own bind address, host key and banner. Setting allowed_groups
+// restricts logins to accounts in at least one of those groups, e.g. so an externally
+// exposed listener only admits a subset of accounts.
+type ListenerConfig struct {
+	Bind          string   `json:"bind"`
+	HostKeyPath   string   `json:"host_key_path"`
+	Banner        string   `json:"banner"`
+	AllowedGroups []string `json:"allowed_groups"`
+}
+
+// Returns the configured listeners, or a single one built from bind and id_rsa_path
+func (c *Config) listeners() []ListenerConfig {
+	if len(c.Listeners) == 0 {
+		return []ListenerConfig{{Bind: c.Bind, HostKeyPath: c.IDRSAPath}}
+	}
+
+	listeners := make([]ListenerConfig, len(c.Listeners))
+	for i, listener := range c.Listeners {
+		if listener.HostKeyPath == "" {
+			listener.HostKeyPath = c.IDRSAPath
+		}
+		listeners[i] = listener
+	}
+	return listeners
+}
+
+// Whether an account may login through this listener
+func (l ListenerConfig) allows(account *Account) bool {
+	if len(l.AllowedGroups) == 0 {
+		return true
+	}
+
+	for _, group := range account.Groups {
+		for _, allowed := range l.AllowedGroups {
+			if group == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package bowser
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Configuration for locking accounts after repeated failed password or MFA attempts.
+// A value of 0 for max_failures disables lockouts.
+type LockoutConfig struct {
+	MaxFailures int `json:"max_failures"`
+	Window      int `json:"window"`
+	Duration    int `json:"duration"`
+}
+
+// Tracks failures and active lockouts per account
+type accountLockouts struct {
+	config   LockoutConfig
+	failures *windowCounter
+
+	lock     sync.Mutex
+	lockouts map[string]time.Time
+}
+
+func newAccountLockouts(config LockoutConfig) *accountLockouts {
+	return &accountLockouts{
+		config:   config,
+		failures: newWindowCounter(time.Duration(config.Window) * time.Second),
+		lockouts: make(map[string]time.Time),
+	}
+}
+
+// Returns when the account's lockout expires, or a zero time if it isn't locked
+func (l *accountLockouts) lockedUntil(username string) time.Time {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	until, exists := l.lockouts[username]
+	if !exists || time.Now().After(until) {
+		delete(l.lockouts, username)
+		return time.Time{}
+	}
+
+	return until
+}
+
+// Records a failure for the account, returning true if it caused a lockout
+func (l *accountLockouts) failure(username string) bool {
+	if l.config.MaxFailures <= 0 {
+		return false
+	}
+
+	if l.failures.add(username) < l.config.MaxFailures {
+		return false
+	}
+
+	l.failures.reset(username)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.lockouts[username] = time.Now().Add(time.Duration(l.config.Duration) * time.Second)
+	return true
+}
+
+// Clears any lockout and failure history for the account, returning whether it
+// was locked
+func (l *accountLockouts) unlock(username string) bool {
+	locked := !l.lockedUntil(username).IsZero()
+
+	l.failures.reset(username)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.lockouts, username)
+	return locked
+}
+
+func (l *accountLockouts) list() map[string]time.Time {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	result := make(map[string]time.Time)
+	for username, until := range l.lockouts {
+		if time.Now().Before(until) {
+			result[username] = until
+		}
+	}
+	return result
+}
+
+// GET /lockouts, lists currently locked accounts and when they unlock
+func (api *HTTPAPI) handleListLockouts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.state.lockouts.list())
+}
+
+// POST /accounts/:username/unlock, clears an accounts lockout
+func (api *HTTPAPI) handleUnlockAccount(w http.ResponseWriter, r *http.Request, username string) {
+	locked := api.state.lockouts.unlock(username)
+
+	api.state.log.Info("Account unlocked", zap.String("username", username), zap.Bool("was-locked", locked))
+	api.state.audit.Emit(AuditEvent{
+		Type:     AuditAdminAction,
+		Username: username,
+		Reason:   "account unlocked",
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"username": username, "was_locked": locked})
+}
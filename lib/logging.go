@@ -0,0 +1,71 @@
+package bowser
+
+import (
+	"fmt"
+	"os"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Builds the application logger, writing to every configured output with the
+// configured encoding, plus any extra cores. Returns the log file too (if one is used)
+// so it can be reopened.
+func newLogger(config *Config, levels *logLevels, ring *logRing, extra ...zapcore.Core) (*zap.Logger, *rotatingFile, error) {
+	encoderConfig := zap.NewProductionEncoderConfig()
+
+	var encoder zapcore.Encoder
+	switch config.LogEncoding {
+	case "", "json":
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	case "console":
+		encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	default:
+		return nil, nil, fmt.Errorf("unknown log encoding %q", config.LogEncoding)
+	}
+
+	outputs := config.LogOutputs
+	if len(outputs) == 0 {
+		outputs = []string{"stderr"}
+		if config.LogFile != "" {
+			outputs = []string{"file"}
+		}
+	}
+
+	// Levels are filtered by module in our own core, so the underlying cores log
+	//  everything they are given. Support bundles always get JSON.
+	cores := append([]zapcore.Core{
+		zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), ring, zap.DebugLevel),
+	}, extra...)
+
+	var logFile *rotatingFile
+	for _, output := range outputs {
+		var sink zapcore.WriteSyncer
+		switch output {
+		case "stderr":
+			sink = zapcore.Lock(os.Stderr)
+		case "stdout":
+			sink = zapcore.Lock(os.Stdout)
+		case "file":
+			if config.LogFile == "" {
+				return nil, nil, fmt.Errorf("the file log output requires log_file")
+			}
+
+			if logFile == nil {
+				var err error
+				if logFile, err = openRotatingFile(config.LogFile, config.LogRotation); err != nil {
+					return nil, nil, err
+				}
+			}
+			sink = logFile
+		default:
+			return nil, nil, fmt.Errorf("unknown log output %q", output)
+		}
+
+		cores = append(cores, zapcore.NewCore(encoder.Clone(), sink, zap.DebugLevel))
+	}
+
+	core := moduleCore{Core: zapcore.NewTee(cores...), levels: levels}
+	return zap.New(core, zap.AddCaller(), zap.AddStacktrace(zap.ErrorLevel)), logFile, nil
+}
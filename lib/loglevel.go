@@ -0,0 +1,193 @@
+package bowser
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// The modules whose log level can be set separately from the base level
+var logModules = map[string]bool{
+	"auth":    true,
+	"proxy":   true,
+	"ca":      true,
+	"webhook": true,
+}
+
+// Holds the base log level and any per-module overrides, all of which can change at
+// runtime. Modules without an override follow the base level.
+type logLevels struct {
+	base zap.AtomicLevel
+
+	lock    sync.RWMutex
+	modules map[string]zapcore.Level
+}
+
+func newLogLevels(level string, modules map[string]string) (*logLevels, error) {
+	levels := &logLevels{
+		base:    zap.NewAtomicLevel(),
+		modules: make(map[string]zapcore.Level),
+	}
+
+	if err := levels.set(level, modules); err != nil {
+		return nil, err
+	}
+	return levels, nil
+}
+
+// Changes the base level (unless empty) and the given modules, an empty module level
+// removes its override.
+func (l *logLevels) set(level string, modules map[string]string) error {
+	var base zapcore.Level
+	if level != "" {
+		if err := base.UnmarshalText([]byte(level)); err != nil {
+			return err
+		}
+	}
+
+	overrides := make(map[string]*zapcore.Level)
+	for module, moduleLevel := range modules {
+		if !logModules[module] {
+			return fmt.Errorf("unknown log module %q", module)
+		}
+
+		if moduleLevel == "" {
+			overrides[module] = nil
+			continue
+		}
+
+		parsed := new(zapcore.Level)
+		if err := parsed.UnmarshalText([]byte(moduleLevel)); err != nil {
+			return err
+		}
+		overrides[module] = parsed
+	}
+
+	if level != "" {
+		l.base.SetLevel(base)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for module, override := range overrides {
+		if override == nil {
+			delete(l.modules, module)
+		} else {
+			l.modules[module] = *override
+		}
+	}
+	return nil
+}
+
+func (l *logLevels) enabled(module string, level zapcore.Level) bool {
+	if module != "" {
+		l.lock.RLock()
+		override, exists := l.modules[module]
+		l.lock.RUnlock()
+
+		if exists {
+			return override.Enabled(level)
+		}
+	}
+	return l.base.Enabled(level)
+}
+
+// Describes the current levels
+type JSONLogLevels struct {
+	Level   string            `json:"level"`
+	Modules map[string]string `json:"modules"`
+}
+
+func (l *logLevels) toJSON() JSONLogLevels {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	modules := make(map[string]string)
+	for module, level := range l.modules {
+		modules[module] = level.String()
+	}
+	return JSONLogLevels{Level: l.base.Level().String(), Modules: modules}
+}
+
+// Filters entries by the level of the module they were logged in. Loggers pick their
+// module by adding a "module" field, which this core records instead of passing on, so
+// the field appears only once no matter how often a logger is re-scoped.
+type moduleCore struct {
+	zapcore.Core
+	levels *logLevels
+	module string
+}
+
+func (c moduleCore) Enabled(level zapcore.Level) bool {
+	return c.levels.enabled(c.module, level)
+}
+
+func (c moduleCore) With(fields []zapcore.Field) zapcore.Core {
+	var passed []zapcore.Field
+	for _, field := range fields {
+		if field.Key == "module" && field.Type == zapcore.StringType {
+			c.module = field.String
+			continue
+		}
+		passed = append(passed, field)
+	}
+
+	c.Core = c.Core.With(passed)
+	return c
+}
+
+func (c moduleCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c moduleCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	if c.module != "" {
+		fields = append(fields, zap.String("module", c.module))
+	}
+	return c.Core.Write(entry, fields)
+}
+
+// Toggles the base level between debug and the configured level, used for SIGUSR2
+func (s *SSHDState) toggleDebugLogging() {
+	level := zapcore.DebugLevel
+	if s.logLevels.base.Level() == zapcore.DebugLevel {
+		level.UnmarshalText([]byte(s.Config().LogLevel))
+	}
+
+	s.logLevels.base.SetLevel(level)
+	s.log.Info("Log level changed", zap.String("level", level.String()))
+}
+
+// GET /loglevel returns the current log levels, PUT /loglevel changes them with a body
+// in the same format. Modules set to an empty level follow the base level again.
+func (api *HTTPAPI) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var payload JSONLogLevels
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json body")
+			return
+		}
+
+		if err := api.state.logLevels.set(payload.Level, payload.Modules); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		api.state.log.Info("Log level changed", zap.String("level", payload.Level), zap.Any("modules", payload.Modules))
+		api.state.audit.Emit(AuditEvent{Type: AuditAdminAction, Reason: "log level changed"})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, api.state.logLevels.toJSON())
+}
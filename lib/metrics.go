@@ -0,0 +1,82 @@
+package bowser
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Writes metrics in the Prometheus text exposition format
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+func (m *metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(m, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Writes a sample, labels alternate between names and values
+func (m *metricsWriter) sample(name string, value int64, labels ...string) {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], prometheusLabelEscaper.Replace(labels[i+1])))
+	}
+
+	if len(pairs) > 0 {
+		fmt.Fprintf(m, "%s{%s} %d\n", name, strings.Join(pairs, ","), value)
+	} else {
+		fmt.Fprintf(m, "%s %d\n", name, value)
+	}
+}
+
+// Writes per key traffic counters, sorted so scrapes are stable
+func (m *metricsWriter) traffic(prefix, label string, totals map[string]trafficCounts) {
+	keys := make([]string, 0, len(totals))
+	for key := range totals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	m.header(prefix+"_bytes_total", "counter", "Bytes forwarded by closed forwards, by direction.")
+	for _, key := range keys {
+		m.sample(prefix+"_bytes_total", totals[key].sent, label, key, "direction", "sent")
+		m.sample(prefix+"_bytes_total", totals[key].received, label, key, "direction", "received")
+	}
+
+	m.header(prefix+"_forwards_total", "counter", "Closed forwards.")
+	for _, key := range keys {
+		m.sample(prefix+"_forwards_total", totals[key].forwards, label, key)
+	}
+}
+
+// GET /metrics exposes session, forward and traffic counters to Prometheus. Traffic
+// per destination and account is counted once forwards close, while
+// bowser_forwarded_bytes_total is updated live.
+func (api *HTTPAPI) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	sessions := api.state.listSessions()
+
+	forwards := 0
+	for _, session := range sessions {
+		forwards += len(session.active.list())
+	}
+
+	var m metricsWriter
+	m.header("bowser_sessions_active", "gauge", "Open SSH sessions.")
+	m.sample("bowser_sessions_active", int64(len(sessions)))
+	m.header("bowser_forwards_active", "gauge", "Open forwards.")
+	m.sample("bowser_forwards_active", int64(forwards))
+	m.header("bowser_forwarded_bytes_total", "counter", "Bytes forwarded in either direction, including open forwards.")
+	m.sample("bowser_forwarded_bytes_total", atomic.LoadInt64(&api.state.stats.bytes))
+
+	m.traffic("bowser_destination", "destination", api.state.destinationTraffic.snapshot())
+	m.traffic("bowser_account", "username", api.state.accountTraffic.snapshot())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	w.Write(m.Bytes())
+}
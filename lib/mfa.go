@@ -0,0 +1,196 @@
+package bowser
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// MFA policies, deciding whether an account needs any one or all of its factors
+const (
+	MFAPolicyAny = "any"
+	MFAPolicyAll = "all"
+)
+
+var mfaFailedError = fmt.Errorf("invalid mfa code")
+
+// Context passed to MFA providers for a single login attempt
+type MFAContext struct {
+	Conn     ssh.ConnMetadata
+	State    *SSHDState
+	Password string
+
+	// The users answer to the MFA prompt
+	Answer string
+}
+
+// An MFAProvider validates one kind of second factor
+type MFAProvider interface {
+	Name() string
+	Prompt() string
+
+	// Whether the account has this factor set up
+	Enabled(account *Account) bool
+	Validate(account *Account, ctx *MFAContext) error
+}
+
+type mfaRegistration struct {
+	provider MFAProvider
+	fallback bool
+}
+
+var mfaProviders []mfaRegistration
+
+// Registers an MFA provider. Fallback providers (like backup codes) are accepted in
+// place of any other factor, but never count as a factor on their own.
+func RegisterMFAProvider(provider MFAProvider, fallback bool) {
+	mfaProviders = append(mfaProviders, mfaRegistration{provider, fallback})
+}
+
+func init() {
+	RegisterMFAProvider(totpProvider{}, false)
+	RegisterMFAProvider(yubikeyProvider{}, false)
+	RegisterMFAProvider(backupCodeProvider{}, true)
+}
+
+// Returns the factors and fallbacks the account has set up
+func (a *Account) mfaProviders() (factors []MFAProvider, fallbacks []MFAProvider) {
+	for _, registration := range mfaProviders {
+		if !registration.provider.Enabled(a) {
+			continue
+		}
+
+		if registration.fallback {
+			fallbacks = append(fallbacks, registration.provider)
+		} else {
+			factors = append(factors, registration.provider)
+		}
+	}
+	return
+}
+
+// Whether the account requires a second factor
+func (a *Account) mfaEnabled() bool {
+	factors, _ := a.mfaProviders()
+	return len(factors) > 0
+}
+
+// Prompts for and validates the accounts second factors according to its policy,
+// returning the names of the providers which accepted them.
+func (s *SSHDState) validateMFA(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge, account *Account, password string, logger *zap.Logger) ([]string, bool) {
+	ctx := &MFAContext{Conn: conn, State: s, Password: password}
+	factors, fallbacks := account.mfaProviders()
+
+	if account.MFA.Policy == MFAPolicyAll {
+		var methods []string
+		for _, factor := range factors {
+			group := append([]MFAProvider{factor}, fallbacks...)
+			method, ok := s.promptMFA(client, account, ctx, factor.Prompt(), group, logger)
+			if !ok {
+				return nil, false
+			}
+			methods = append(methods, method)
+		}
+		return methods, true
+	}
+
+	method, ok := s.promptMFA(client, account, ctx, "MFA Code: ", append(factors, fallbacks...), logger)
+	if !ok {
+		return nil, false
+	}
+	return []string{method}, true
+}
+
+// Prompts up to three times for a code any of the given providers accepts, returning
+// the name of the provider which accepted it
+func (s *SSHDState) promptMFA(client ssh.KeyboardInteractiveChallenge, account *Account, ctx *MFAContext, prompt string, providers []MFAProvider, logger *zap.Logger) (string, bool) {
+	for i := 0; i < 3; i++ {
+		answer, err := client(ctx.Conn.User(), "", []string{prompt}, []bool{true})
+		if err != nil || len(answer) != 1 {
+			continue
+		}
+
+		ctx.Answer = answer[0]
+		for _, provider := range providers {
+			err = provider.Validate(account, ctx)
+			if err == nil {
+				return provider.Name(), true
+			}
+
+			if err != mfaFailedError {
+				logger.Warn("MFA provider failed to validate code", zap.String("provider", provider.Name()), zap.Error(err))
+			}
+		}
+
+		if s.accountFailure(account, logger) {
+			break
+		}
+	}
+
+	return "", false
+}
+
+type totpProvider struct{}
+
+func (totpProvider) Name() string   { return "totp" }
+func (totpProvider) Prompt() string { return "MFA Code: " }
+
+func (totpProvider) Enabled(account *Account) bool {
+	return account.MFA.TOTP != ""
+}
+
+func (totpProvider) Validate(account *Account, ctx *MFAContext) error {
+	mfa := account.MFA
+	encrypted, err := resolveSecret(ctx.State.Config().secrets, mfa.TOTP)
+	if err != nil {
+		return err
+	}
+
+	mfa.TOTP, err = ctx.State.Config().unsealTOTP(account.Username, encrypted)
+	if err != nil {
+		return err
+	}
+
+	secret, err := mfa.decryptTOTP([]byte(ctx.Password), []byte(account.Username))
+	if err != nil {
+		return err
+	}
+
+	if !ctx.State.validateTOTP(ctx.Answer, secret) {
+		return mfaFailedError
+	}
+	return nil
+}
+
+type yubikeyProvider struct{}
+
+func (yubikeyProvider) Name() string   { return "yubikey" }
+func (yubikeyProvider) Prompt() string { return "YubiKey: " }
+
+func (yubikeyProvider) Enabled(account *Account) bool {
+	return len(account.MFA.YubiKeys) > 0
+}
+
+func (yubikeyProvider) Validate(account *Account, ctx *MFAContext) error {
+	if !account.MFA.hasYubikey(ctx.Answer) {
+		return mfaFailedError
+	}
+	return ctx.State.yubico.verify(ctx.Answer)
+}
+
+type backupCodeProvider struct{}
+
+func (backupCodeProvider) Name() string   { return "backup" }
+func (backupCodeProvider) Prompt() string { return "Backup Code: " }
+
+func (backupCodeProvider) Enabled(account *Account) bool {
+	return len(account.MFA.BackupCodes) > 0
+}
+
+func (backupCodeProvider) Validate(account *Account, ctx *MFAContext) error {
+	if !ctx.State.consumeBackupCode(account, ctx.Answer) {
+		return mfaFailedError
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package bowser
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The variables available to the motd and listener banner templates. Banners are
+// shown before authentication, so only Username (as claimed by the client), Source
+// and Time are set for them.
+type MOTDVars struct {
+	Username            string
+	SessionID           string
+	Groups              []string
+	Destinations        []string
+	Source              string
+	Country             string
+	CertificateValidity time.Duration
+	Time                time.Time
+}
+
+// The compiled motd, replaced whenever it is reloaded
+type motd struct {
+	lock     sync.RWMutex
+	template *template.Template
+}
+
+// Reads and compiles the motd, from motd_path when set and motd otherwise. Returns
+// nil if neither is configured.
+func (c *Config) loadMOTD() (*template.Template, error) {
+	text := c.MOTD
+	if c.MOTDPath != "" {
+		data, err := ioutil.ReadFile(c.MOTDPath)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+
+	if text == "" {
+		return nil, nil
+	}
+	return template.New("motd").Parse(text)
+}
+
+// Re-reads the motd, keeping the previous one if the new one fails to load
+func (s *SSHDState) reloadMOTD() error {
+	compiled, err := s.Config().loadMOTD()
+	if err != nil {
+		s.log.Error("Failed to load motd", zap.Error(err))
+		return err
+	}
+
+	s.motd.lock.Lock()
+	s.motd.template = compiled
+	s.motd.lock.Unlock()
+	return nil
+}
+
+func (s *SSHDState) renderMOTD(vars MOTDVars) string {
+	s.motd.lock.RLock()
+	compiled := s.motd.template
+	s.motd.lock.RUnlock()
+
+	if compiled == nil {
+		return ""
+	}
+	return s.renderTemplate(compiled, vars)
+}
+
+func (s *SSHDState) renderTemplate(compiled *template.Template, vars MOTDVars) string {
+	var buf bytes.Buffer
+	if err := compiled.Execute(&buf, vars); err != nil {
+		s.log.Error("Failed to render template", zap.String("template", compiled.Name()), zap.Error(err))
+		return ""
+	}
+	return buf.String()
+}
+
+// Returns the hosts in the inventory the account may connect to. Patterns can't be
+// connected to, so only plain hostnames are listed.
+func (s *SSHDState) allowedDestinations(account *Account) []string {
+	seen := make(map[string]bool)
+	var destinations []string
+
+	for _, entry := range s.Config().Hosts {
+		if seen[entry.Host] || strings.ContainsAny(entry.Host, "*?[") {
+			continue
+		}
+		seen[entry.Host] = true
+
+		if s.canConnectTo(account, entry.Host) == nil {
+			destinations = append(destinations, entry.Host)
+		}
+	}
+
+	for name := range s.Config().Aliases {
+		if !seen[name] && s.canConnectTo(account, name) == nil {
+			seen[name] = true
+			destinations = append(destinations, name)
+		}
+	}
+
+	sort.Strings(destinations)
+	return destinations
+}
@@ -0,0 +1,74 @@
+package bowser
+
+import (
+	"net"
+	"sync"
+)
+
+// Bounds the connections which have not finished authenticating yet, both in total and
+// per source netblock, so a scan from one provider's range can't starve everyone else
+// of handshake slots. Mirrors OpenSSH's MaxStartups and PerSourceMaxStartups.
+type startupSlots struct {
+	max       int
+	perSource int
+	ipv4Mask  net.IPMask
+	ipv6Mask  net.IPMask
+
+	lock     sync.Mutex
+	total    int
+	netblock map[string]int
+}
+
+func newStartupSlots(config RateLimitConfig) *startupSlots {
+	return &startupSlots{
+		max:       config.MaxStartups,
+		perSource: config.PerSourceMaxStartups,
+		ipv4Mask:  net.CIDRMask(config.NetblockSizeIPv4, 32),
+		ipv6Mask:  net.CIDRMask(config.NetblockSizeIPv6, 128),
+		netblock:  make(map[string]int),
+	}
+}
+
+// Returns the netblock the given source IP belongs to
+func (s *startupSlots) netblockFor(source string) string {
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return source
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(s.ipv4Mask), Mask: s.ipv4Mask}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(s.ipv6Mask), Mask: s.ipv6Mask}).String()
+}
+
+// Takes a slot for a new connection from source, returning the netblock to release once
+// the connection authenticates or fails, and whether a slot was free.
+func (s *startupSlots) acquire(source string) (string, bool) {
+	block := s.netblockFor(source)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.max > 0 && s.total >= s.max {
+		return block, false
+	}
+
+	if s.perSource > 0 && s.netblock[block] >= s.perSource {
+		return block, false
+	}
+
+	s.total++
+	s.netblock[block]++
+	return block, true
+}
+
+func (s *startupSlots) release(block string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.total--
+	if s.netblock[block]--; s.netblock[block] <= 0 {
+		delete(s.netblock, block)
+	}
+}
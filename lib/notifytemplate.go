@@ -0,0 +1,104 @@
+package bowser
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+)
+
+// Every event type webhook providers are notified about
+var webhookEventTypes = map[string]bool{
+	WebhookSessionStart:       true,
+	WebhookSessionEnd:         true,
+	WebhookForwardOpen:        true,
+	WebhookForwardClose:       true,
+	WebhookACLReject:          true,
+	WebhookMFAFailure:         true,
+	WebhookSourceBanned:       true,
+	WebhookRemoteForwardOpen:  true,
+	WebhookRemoteForwardClose: true,
+}
+
+// The variables available to notification templates. PlatformID is the user's id on
+// the provider's platform (from their platform_ids), for mentioning them. StartedAt
+// is when the session or forward began, and Time when the event happened. Traffic is
+// only set when sessions end.
+type NotificationVars struct {
+	Type          string
+	User          string
+	UUID          string
+	PlatformID    string
+	Destination   string
+	Source        string
+	Country       string
+	Reason        string
+	Time          time.Time
+	StartedAt     time.Time
+	Duration      time.Duration
+	BytesSent     int64
+	BytesReceived int64
+	Destinations  []string
+	Traffic       []DestinationTraffic
+}
+
+// Compiled message templates for a provider, keyed by event type with "default"
+// used for every event type without its own
+type notificationTemplates map[string]*template.Template
+
+func compileNotificationTemplates(templates map[string]string) (notificationTemplates, error) {
+	if len(templates) == 0 {
+		return nil, nil
+	}
+
+	compiled := make(notificationTemplates)
+	for eventType, text := range templates {
+		if eventType != "default" && !webhookEventTypes[eventType] {
+			return nil, fmt.Errorf("unknown event type %s", eventType)
+		}
+
+		parsed, err := template.New(eventType).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		compiled[eventType] = parsed
+	}
+	return compiled, nil
+}
+
+// Renders the message for an event, returning false when no template applies so the
+// provider's built-in format should be used
+func (t notificationTemplates) render(event WebhookEvent, platform string) (string, bool, error) {
+	compiled, exists := t[event.Type]
+	if !exists {
+		compiled, exists = t["default"]
+	}
+
+	if !exists {
+		return "", false, nil
+	}
+
+	vars := NotificationVars{
+		Type:          event.Type,
+		User:          event.Username,
+		UUID:          event.SessionID,
+		PlatformID:    event.PlatformIDs[platform],
+		Destination:   event.Destination,
+		Source:        event.Source,
+		Country:       event.Country,
+		Reason:        event.Reason,
+		Time:          event.Time,
+		StartedAt:     event.Time.Add(-event.Duration),
+		Duration:      event.Duration,
+		BytesSent:     event.BytesSent,
+		BytesReceived: event.BytesReceived,
+		Destinations:  event.Destinations,
+		Traffic:       event.Traffic,
+	}
+
+	var buffer bytes.Buffer
+	if err := compiled.Execute(&buffer, vars); err != nil {
+		return "", true, err
+	}
+	return buffer.String(), true, nil
+}
@@ -0,0 +1,431 @@
+package bowser
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Configuration for the interactive destination picker, offered to clients which open
+// a shell on bowser instead of forwarding through it. Destination host keys are
+// checked against known_hosts_path, and destinations are logged into on port (22 by
+// default, unless an alias sets one). With forward_agent, clients requesting agent
+// forwarding get an agent on the destination which only holds the issued certificate,
+// never the keys in their own agent.
+type PickerConfig struct {
+	Enabled        bool   `json:"enabled"`
+	KnownHostsPath string `json:"known_hosts_path"`
+	Port           int    `json:"port"`
+	ForwardAgent   bool   `json:"forward_agent"`
+}
+
+type ptyRequestMsg struct {
+	Term     string
+	Columns  uint32
+	Rows     uint32
+	Width    uint32
+	Height   uint32
+	Modelist string
+}
+
+type windowChangeMsg struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+// Tracks the terminal the client asked for, and the remote session once there is one
+type pickerTerminal struct {
+	lock   sync.Mutex
+	term   string
+	rows   int
+	cols   int
+	remote *ssh.Session
+	agent  bool
+
+	shell     chan struct{}
+	shellOnce sync.Once
+}
+
+func (t *pickerTerminal) handleRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "pty-req":
+			var msg ptyRequestMsg
+			if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+
+			t.lock.Lock()
+			t.term, t.rows, t.cols = msg.Term, int(msg.Rows), int(msg.Columns)
+			t.lock.Unlock()
+			req.Reply(true, nil)
+		case "window-change":
+			var msg windowChangeMsg
+			if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+				continue
+			}
+
+			t.lock.Lock()
+			t.rows, t.cols = int(msg.Rows), int(msg.Columns)
+			if t.remote != nil {
+				t.remote.WindowChange(t.rows, t.cols)
+			}
+			t.lock.Unlock()
+		case "auth-agent-req@openssh.com":
+			t.lock.Lock()
+			t.agent = true
+			t.lock.Unlock()
+			req.Reply(true, nil)
+		case "shell":
+			req.Reply(true, nil)
+			t.shellOnce.Do(func() { close(t.shell) })
+		default:
+			// Commands, subsystems and the like only make sense on the destination
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// Reads a line from a raw terminal, echoing input back. Returns io.EOF on ^C or ^D.
+func readTerminalLine(channel ssh.Channel) (string, error) {
+	var line []byte
+	buf := make([]byte, 1)
+
+	for {
+		if _, err := channel.Read(buf); err != nil {
+			return "", err
+		}
+
+		switch buf[0] {
+		case '\r', '\n':
+			channel.Write([]byte("\r\n"))
+			return string(line), nil
+		case 3, 4:
+			channel.Write([]byte("\r\n"))
+			return "", io.EOF
+		case 127, 8:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				channel.Write([]byte("\b \b"))
+			}
+		default:
+			if buf[0] >= 32 && buf[0] < 127 {
+				line = append(line, buf[0])
+				channel.Write(buf)
+			}
+		}
+	}
+}
+
+// Asks the client which destination to connect to, returns an empty string if the
+// client gave up.
+func (s *SSHSession) pickDestination(channel ssh.Channel, destinations []string) string {
+	fmt.Fprintf(channel, "Destinations available to %s:\r\n", s.Account().Username)
+	for i, host := range destinations {
+		fmt.Fprintf(channel, "  %3d) %s\r\n", i+1, host)
+	}
+
+	for {
+		fmt.Fprint(channel, "destination> ")
+		line, err := readTerminalLine(channel)
+		if err != nil {
+			return ""
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if index, err := strconv.Atoi(line); err == nil && index >= 1 && index <= len(destinations) {
+			return destinations[index-1]
+		}
+
+		for _, host := range destinations {
+			if host == line {
+				return host
+			}
+		}
+
+		fmt.Fprintf(channel, "Unknown destination %q\r\n", line)
+	}
+}
+
+// Handles session channels by letting the client pick a destination from the host
+// inventory, then logging into it on their behalf.
+func (s *SSHSession) handleChannelSession(newChannel ssh.NewChannel) {
+	config := s.State.Config().Picker
+	if !config.Enabled {
+		s.log.Error("Rejecting session channel: the destination picker is disabled")
+		newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+		return
+	}
+
+	// Key ownership is still proven through the agent, exactly like forwards
+	if reason := s.proveKeyOwnership(); reason != "" {
+		newChannel.Reject(ssh.Prohibited, reason)
+		return
+	}
+
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		s.log.Error("Failed to accept session channel", zap.Error(err))
+		return
+	}
+	defer channel.Close()
+
+	terminal := &pickerTerminal{shell: make(chan struct{})}
+	go terminal.handleRequests(reqs)
+
+	select {
+	case <-terminal.shell:
+	case <-time.After(30 * time.Second):
+		s.log.Warn("Closing session channel which never requested a shell")
+		return
+	}
+	defer s.addTerminal(channel)()
+
+	destinations := s.State.allowedDestinations(s.Account())
+	if len(destinations) == 0 {
+		fmt.Fprint(channel, "No destinations are available to you\r\n")
+		return
+	}
+
+	host := s.pickDestination(channel, destinations)
+	if host == "" {
+		return
+	}
+
+	status := s.connectPicked(channel, channel.Stderr(), terminal, host)
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+}
+
+// Serves the destination an agent holding only the certificate issued for it, so the
+// user's own identities never leave the bastion.
+func (s *SSHSession) forwardFilteredAgent(client *ssh.Client, session *ssh.Session, cert *ssh.Certificate, privateKey *ed25519.PrivateKey) error {
+	keyring := agent.NewKeyring()
+	err := keyring.Add(agent.AddedKey{
+		PrivateKey:   *privateKey,
+		Certificate:  cert,
+		LifetimeSecs: uint32(certificateValidity / time.Second),
+		Comment:      "temporary ssh certificate",
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = agent.ForwardToAgent(client, keyring); err != nil {
+		return err
+	}
+	return agent.RequestAgentForwarding(session)
+}
+
+// Logs into the picked destination and bridges the client channel to a shell on it,
+// returning the exit status to report to the client.
+func (s *SSHSession) connectPicked(channel ssh.Channel, stderr io.Writer, terminal *pickerTerminal, host string) uint32 {
+	setupStarted := time.Now()
+	host = normalizeDestination(host)
+	target, aliasPort := s.State.Config().resolveAlias(host, uint32(s.State.Config().Picker.Port))
+	port := int(aliasPort)
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+
+	if err := s.State.canConnectTo(s.Account(), host); err != nil {
+		s.destinationRejected(host, address, err)
+		fmt.Fprint(stderr, "invalid permissions\r\n")
+		return 1
+	}
+
+	if err := s.Account().canConnectToPort(s.State.Config(), host, port); err != nil {
+		s.destinationRejected(host, address, err)
+		fmt.Fprint(stderr, "invalid permissions\r\n")
+		return 1
+	}
+
+	if err := s.Account().canConnectToTarget(s.State.Config(), host, target, port); err != nil {
+		s.destinationRejected(host, address, err)
+		fmt.Fprint(stderr, "invalid permissions\r\n")
+		return 1
+	}
+
+	if !s.reserveForward(address) {
+		fmt.Fprintf(stderr, "too many open forwards (the limit is %d)\r\n", s.State.forwardLimit(s.Account()))
+		return 1
+	}
+	defer s.active.release()
+
+	cert, privateKey, username, err := s.issueCertificate(host, address)
+	if err != nil {
+		s.log.Error("Failed to generate ssh certificate", zap.Error(err))
+		fmt.Fprint(stderr, "failed to generate ssh certificate\r\n")
+		return 1
+	}
+
+	signer, err := ssh.NewSignerFromKey(*privateKey)
+	if err == nil {
+		signer, err = ssh.NewCertSigner(cert, signer)
+	}
+	if err != nil {
+		s.log.Error("Failed to create certificate signer", zap.Error(err))
+		fmt.Fprint(stderr, "failed to generate ssh certificate\r\n")
+		return 1
+	}
+
+	hostKeys, err := knownhosts.New(s.State.Config().Picker.KnownHostsPath)
+	if err != nil {
+		s.log.Error("Failed to load known hosts", zap.Error(err))
+		fmt.Fprint(stderr, "failed to load known hosts\r\n")
+		return 1
+	}
+
+	addrs, err := s.resolveDestination(target)
+	if _, denied := err.(deniedAddressError); denied {
+		s.destinationRejected(host, address, err)
+		fmt.Fprint(stderr, "invalid permissions\r\n")
+		return 1
+	} else if err != nil {
+		s.log.Error("Failed to resolve picked host", zap.String("host", host), zap.Error(err))
+		fmt.Fprintf(stderr, "error: %v\r\n", err)
+		return 1
+	}
+
+	s.State.webhooks.Notify(s.webhookEvent(WebhookForwardOpen, host))
+	opened := s.auditEvent(AuditForwardOpen, address)
+	opened.Fields = map[string]string{"addresses": strings.Join(addrs, ",")}
+	s.State.audit.Emit(opened)
+
+	conn, err := s.dialer.dial(target, addrs, strconv.Itoa(port))
+	if err != nil {
+		s.log.Error(
+			"Failed to open TCP connection to picked host",
+			zap.String("host", address),
+			zap.Error(err))
+		fmt.Fprintf(stderr, "error: %v\r\n", err)
+		return 1
+	}
+	defer conn.Close()
+
+	clientConfig := &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeys,
+	}
+	s.State.Config().SSHAlgorithms.apply(&clientConfig.Config)
+
+	// Host keys are looked up by the real address, known_hosts doesn't know aliases
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, net.JoinHostPort(target, strconv.Itoa(port)), clientConfig)
+	if err != nil {
+		s.log.Error(
+			"Failed to log into picked host",
+			zap.String("host", address),
+			zap.Error(err))
+		fmt.Fprintf(stderr, "error: %v\r\n", err)
+		return 1
+	}
+	client := ssh.NewClient(clientConn, chans, reqs)
+	defer client.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		if sendKeepalives(client, s.State.Config().Keepalive, done) {
+			s.log.Warn("Closing picked host which stopped answering keepalives", zap.String("host", address))
+			client.Close()
+		}
+	}()
+
+	session, err := client.NewSession()
+	if err != nil {
+		s.log.Error("Failed to open session on picked host", zap.Error(err))
+		fmt.Fprintf(stderr, "error: %v\r\n", err)
+		return 1
+	}
+	s.State.stats.forwardOpened(time.Since(setupStarted))
+
+	s.lock.Lock()
+	s.destinations = append(s.destinations, address)
+	s.lock.Unlock()
+
+	forward := s.active.open(address, func() {
+		client.Close()
+		channel.Close()
+	})
+	defer s.active.remove(forward.ID)
+	startedAt := time.Now()
+
+	// Destinations which require it get the decrypted terminal output recorded
+	var stdout io.Writer = channel
+	if config := s.State.Config().Recording; config.matches(s.State.Config().destinationTags(host, target)) {
+		terminal.lock.Lock()
+		term, cols, rows := terminal.term, terminal.cols, terminal.rows
+		terminal.lock.Unlock()
+
+		title := fmt.Sprintf("%s@%s", username, host)
+		recording, err := newSessionRecording(config, s.UUID+"-"+forward.ID, title, term, cols, rows)
+		if err != nil {
+			s.log.Error("Failed to start session recording", zap.String("host", address), zap.Error(err))
+			fmt.Fprint(stderr, "failed to start session recording\r\n")
+			return 1
+		}
+		defer recording.Close()
+
+		s.log.Info("Recording session", zap.String("host", address), zap.String("path", recording.path))
+		s.lock.Lock()
+		s.recordings = append(s.recordings, recording.path)
+		s.lock.Unlock()
+
+		stdout = recordingWriter{channel, recording}
+		stderr = recordingWriter{stderr, recording}
+	}
+
+	stats := &s.State.stats.bytes
+	session.Stdin = io.TeeReader(channel, countingWriter{ioutil.Discard, []*int64{&forward.bytesSent, &s.bytesSent, stats}})
+	session.Stdout = countingWriter{stdout, []*int64{&forward.bytesReceived, &s.bytesReceived, stats}}
+	session.Stderr = countingWriter{stderr, []*int64{&forward.bytesReceived, &s.bytesReceived, stats}}
+
+	terminal.lock.Lock()
+	if terminal.agent && s.State.Config().Picker.ForwardAgent {
+		err = s.forwardFilteredAgent(client, session, cert, privateKey)
+	}
+	if err == nil && terminal.term != "" {
+		err = session.RequestPty(terminal.term, terminal.rows, terminal.cols, ssh.TerminalModes{})
+	}
+	if err == nil {
+		err = session.Shell()
+	}
+	terminal.remote = session
+	terminal.lock.Unlock()
+
+	var status uint32
+	if err == nil {
+		err = session.Wait()
+	}
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		status = uint32(exitErr.ExitStatus())
+	} else if err != nil {
+		s.log.Error("Session on picked host failed", zap.String("host", address), zap.Error(err))
+		status = 1
+	}
+
+	terminal.lock.Lock()
+	terminal.remote = nil
+	terminal.lock.Unlock()
+
+	sent, received := atomic.LoadInt64(&forward.bytesSent), atomic.LoadInt64(&forward.bytesReceived)
+	s.forwardClosed(host, address, startedAt, sent, received)
+	return status
+}
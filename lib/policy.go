@@ -0,0 +1,211 @@
+package bowser
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+var notAllowedError = fmt.Errorf("does not match whitelist or allowed tags")
+var blacklistedError = fmt.Errorf("matches blacklist")
+var deniedTagError = fmt.Errorf("matches denied tags")
+var invalidDestinationError = fmt.Errorf("invalid destination")
+var deniedNetworkError = fmt.Errorf("matches denied networks")
+var deniedPortError = fmt.Errorf("port is not allowed")
+
+// An address a destination resolved to which the account may not connect to
+type deniedAddressError struct {
+	addr string
+	err  error
+}
+
+func (e deniedAddressError) Error() string {
+	return fmt.Sprintf("resolves to %s which %v", e.addr, e.err)
+}
+
+// A PolicyDecision describes whether an account may reach a destination, and which
+// rule decided it.
+type PolicyDecision struct {
+	Host    string   `json:"host"`
+	Allowed bool     `json:"allowed"`
+	Rule    string   `json:"rule"`
+	Tags    []string `json:"tags,omitempty"`
+
+	err error
+}
+
+// Checks whether the account is allowed to open a forward to the given host. Allow
+// rules (whitelist and allow_tags) are combined, so matching any of them is enough,
+// while matching any deny rule (blacklist and deny_tags) rejects the host.
+func (a *Account) canConnectTo(config *Config, host string) error {
+	return a.evaluatePolicy(config, host).err
+}
+
+func (a *Account) evaluatePolicy(config *Config, host string) PolicyDecision {
+	host = normalizeDestination(host)
+	decision := PolicyDecision{Host: host, Tags: config.TagsFor(host)}
+	deny := func(err error, rule string) PolicyDecision {
+		decision.err = err
+		decision.Rule = rule
+		return decision
+	}
+
+	if err := validateDestination(host); err != nil {
+		return deny(invalidDestinationError, err.Error())
+	}
+
+	allowRule := "no rules configured"
+	if a.whitelistRe != nil || len(a.AllowTags) > 0 {
+		if a.whitelistRe != nil && a.whitelistRe.MatchString(host) {
+			allowRule = fmt.Sprintf("whitelist %q", a.Whitelist)
+		} else if tag := firstCommonTag(decision.Tags, a.AllowTags); tag != "" {
+			allowRule = fmt.Sprintf("allow_tags %q", tag)
+		} else {
+			return deny(notAllowedError, "no whitelist or allow_tags match")
+		}
+	}
+
+	if a.blacklistRe != nil && a.blacklistRe.MatchString(host) {
+		return deny(blacklistedError, fmt.Sprintf("blacklist %q", a.Blacklist))
+	}
+
+	if tag := firstCommonTag(decision.Tags, a.DenyTags); tag != "" {
+		return deny(deniedTagError, fmt.Sprintf("deny_tags %q", tag))
+	}
+
+	decision.Allowed = true
+	decision.Rule = allowRule
+	return decision
+}
+
+// Checks an address an allowed destination resolved to. Allow rules are written for
+// names, so only the deny rules (blacklist, deny_tags and the global deny_networks)
+// apply to addresses.
+func (a *Account) canConnectToAddress(config *Config, addr string) error {
+	if a.blacklistRe != nil && a.blacklistRe.MatchString(addr) {
+		return blacklistedError
+	}
+
+	if firstCommonTag(config.TagsFor(addr), a.DenyTags) != "" {
+		return deniedTagError
+	}
+
+	if ip := net.ParseIP(addr); ip != nil {
+		for _, network := range config.denyNetworks {
+			if network.Contains(ip) {
+				return deniedNetworkError
+			}
+		}
+	}
+	return nil
+}
+
+// Checks whether the account may forward to the given port on host. The port has to be
+// in the account's allow_ports (if set) and in the allow_ports of any matching host
+// entries which set them, and must not be in the account's deny_ports.
+func (a *Account) canConnectToPort(config *Config, host string, port int) error {
+	if len(a.AllowPorts) > 0 && !containsPort(a.AllowPorts, port) {
+		return deniedPortError
+	}
+
+	if containsPort(a.DenyPorts, port) {
+		return deniedPortError
+	}
+
+	var hostPorts []int
+	restricted := false
+	for _, entry := range config.Hosts {
+		if len(entry.AllowPorts) > 0 && hostMatches(entry.Host, host) {
+			restricted = true
+			hostPorts = append(hostPorts, entry.AllowPorts...)
+		}
+	}
+
+	if restricted && !containsPort(hostPorts, port) {
+		return deniedPortError
+	}
+	return nil
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, other := range ports {
+		if other == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluates an account's policy against a list of destinations
+func EvaluatePolicy(config *Config, account *Account, hosts []string) []PolicyDecision {
+	var decisions []PolicyDecision
+	for _, host := range hosts {
+		decisions = append(decisions, account.evaluatePolicy(config, host))
+	}
+	return decisions
+}
+
+// Returns the spelling of a destination every policy lookup uses. DNS ignores case and
+// a trailing dot, so "DB.corp." has to hit the same rules as "db.corp".
+func normalizeDestination(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// Matches a host inventory or identity mapping pattern against a destination, in the
+// destination's normalized form
+func hostMatches(pattern, host string) bool {
+	matched, _ := path.Match(strings.ToLower(pattern), normalizeDestination(host))
+	return matched
+}
+
+// Checks that a destination is an IP literal (v4 or v6) or a syntactically valid
+// hostname, since a typo'd destination can silently miss every ACL regex.
+func validateDestination(host string) error {
+	if strings.HasPrefix(host, "[") || strings.HasSuffix(host, "]") {
+		return fmt.Errorf("ipv6 literals must not be bracketed: %q", host)
+	}
+
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+
+	if strings.Contains(host, ":") {
+		return fmt.Errorf("invalid ipv6 literal: %q", host)
+	}
+
+	name := strings.TrimSuffix(host, ".")
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("invalid hostname length: %q", host)
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return fmt.Errorf("invalid hostname label in %q", host)
+		}
+
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("hostname labels can't start or end with a dash: %q", host)
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return fmt.Errorf("invalid character %q in hostname %q", c, host)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the first tag present in both lists, or an empty string
+func firstCommonTag(tags, wanted []string) string {
+	for _, tag := range tags {
+		for _, other := range wanted {
+			if tag == other {
+				return tag
+			}
+		}
+	}
+	return ""
+}
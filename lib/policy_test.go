@@ -0,0 +1,34 @@
+package bowser
+
+import "testing"
+
+func TestDeniedTagsIgnoreDestinationSpelling(t *testing.T) {
+	config := &Config{Hosts: []Host{{Host: "*.pci.corp", Tags: []string{"pci"}}}}
+	account := &Account{Username: "test", DenyTags: []string{"pci"}}
+
+	for _, host := range []string{"db.pci.corp", "DB.PCI.corp", "db.pci.corp.", "Db.Pci.Corp."} {
+		if err := account.canConnectTo(config, host); err != deniedTagError {
+			t.Errorf("canConnectTo(%q) = %v, want %v", host, err, deniedTagError)
+		}
+	}
+
+	if err := account.canConnectTo(config, "db.other.corp"); err != nil {
+		t.Errorf("canConnectTo(%q) = %v, want nil", "db.other.corp", err)
+	}
+}
+
+func TestNormalizeDestination(t *testing.T) {
+	cases := map[string]string{
+		"db.pci.corp":  "db.pci.corp",
+		"DB.PCI.corp":  "db.pci.corp",
+		"db.pci.corp.": "db.pci.corp",
+		"10.0.0.1":     "10.0.0.1",
+		"FE80::1":      "fe80::1",
+	}
+
+	for host, want := range cases {
+		if got := normalizeDestination(host); got != want {
+			t.Errorf("normalizeDestination(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
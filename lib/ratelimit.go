@@ -0,0 +1,166 @@
+package bowser
+
+import (
+	"sync"
+	"time"
+)
+
+// A windowCounter counts occurrences per key within a sliding time window
+type windowCounter struct {
+	window time.Duration
+
+	lock   sync.Mutex
+	events map[string][]time.Time
+}
+
+func newWindowCounter(window time.Duration) *windowCounter {
+	return &windowCounter{
+		window: window,
+		events: make(map[string][]time.Time),
+	}
+}
+
+// Records an occurrence for key and returns how many occurred within the window
+func (w *windowCounter) add(key string) int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	now := time.Now()
+	recent := w.trim(w.events[key], now)
+	recent = append(recent, now)
+	w.events[key] = recent
+	return len(recent)
+}
+
+func (w *windowCounter) reset(key string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.events, key)
+}
+
+func (w *windowCounter) trim(events []time.Time, now time.Time) []time.Time {
+	cutoff := now.Add(-w.window)
+
+	var recent []time.Time
+	for _, at := range events {
+		if at.After(cutoff) {
+			recent = append(recent, at)
+		}
+	}
+	return recent
+}
+
+// Drops keys which have no occurrences left within the window
+func (w *windowCounter) prune() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	now := time.Now()
+	for key, events := range w.events {
+		if recent := w.trim(events, now); len(recent) > 0 {
+			w.events[key] = recent
+		} else {
+			delete(w.events, key)
+		}
+	}
+}
+
+// Configuration for per source IP rate limiting. Sources exceeding either limit
+// within the window are banned for the ban duration. A limit of 0 disables it.
+// MaxStartups and PerSourceMaxStartups bound unauthenticated connections in total
+// and per netblock, netblocks being sized by the IPv4 and IPv6 prefix lengths.
+type RateLimitConfig struct {
+	Window               int `json:"window"`
+	ConnectionsPerWindow int `json:"connections_per_window"`
+	AuthFailures         int `json:"auth_failures"`
+	BanDuration          int `json:"ban_duration"`
+	MaxStartups          int `json:"max_startups"`
+	PerSourceMaxStartups int `json:"per_source_max_startups"`
+	NetblockSizeIPv4     int `json:"netblock_size_ipv4"`
+	NetblockSizeIPv6     int `json:"netblock_size_ipv6"`
+}
+
+type rateLimiter struct {
+	config      RateLimitConfig
+	connections *windowCounter
+	failures    *windowCounter
+	startups    *startupSlots
+
+	lock sync.Mutex
+	bans map[string]time.Time
+}
+
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	window := time.Duration(config.Window) * time.Second
+
+	limiter := &rateLimiter{
+		config:      config,
+		connections: newWindowCounter(window),
+		failures:    newWindowCounter(window),
+		startups:    newStartupSlots(config),
+		bans:        make(map[string]time.Time),
+	}
+
+	go limiter.run()
+	return limiter
+}
+
+func (r *rateLimiter) run() {
+	for range time.Tick(time.Minute) {
+		r.connections.prune()
+		r.failures.prune()
+
+		r.lock.Lock()
+		for source, until := range r.bans {
+			if time.Now().After(until) {
+				delete(r.bans, source)
+			}
+		}
+		r.lock.Unlock()
+	}
+}
+
+func (r *rateLimiter) banned(source string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	until, exists := r.bans[source]
+	return exists && time.Now().Before(until)
+}
+
+func (r *rateLimiter) ban(source string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.bans[source] = time.Now().Add(time.Duration(r.config.BanDuration) * time.Second)
+}
+
+// Records a new connection from source, returning whether it should be accepted
+// and whether this connection caused the source to be banned.
+func (r *rateLimiter) allowConnection(source string) (allowed bool, banned bool) {
+	if r.banned(source) {
+		return false, false
+	}
+
+	if r.config.ConnectionsPerWindow > 0 && r.connections.add(source) > r.config.ConnectionsPerWindow {
+		r.ban(source)
+		return false, true
+	}
+
+	return true, false
+}
+
+// Records a failed authentication attempt, returning true if it caused the source
+// to be banned.
+func (r *rateLimiter) authFailure(source string) bool {
+	if r.config.AuthFailures <= 0 || r.banned(source) {
+		return false
+	}
+
+	if r.failures.add(source) >= r.config.AuthFailures {
+		r.failures.reset(source)
+		r.ban(source)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,105 @@
+package bowser
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var recordingRequiredError = fmt.Errorf("must be reached through the destination picker to be recorded")
+
+// Configuration for recording terminal sessions to destinations carrying any of the
+// given host inventory tags. Bowser can only see inside sessions it logs into itself,
+// so these destinations are only reachable through the destination picker.
+type RecordingConfig struct {
+	Directory string   `json:"directory"`
+	Tags      []string `json:"tags"`
+}
+
+func (c RecordingConfig) matches(tags []string) bool {
+	return c.Directory != "" && firstCommonTag(tags, c.Tags) != ""
+}
+
+// The header line of an asciicast v2 recording
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Records the output of a terminal session in the asciicast v2 format, which can be
+// replayed with asciinema
+type sessionRecording struct {
+	lock      sync.Mutex
+	file      *os.File
+	path      string
+	startedAt time.Time
+}
+
+func newSessionRecording(config RecordingConfig, name, title, term string, width, height int) (*sessionRecording, error) {
+	path := filepath.Join(config.Directory, name+".cast")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	startedAt := time.Now()
+	header := asciicastHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: startedAt.Unix(),
+		Title:     title,
+	}
+	if term != "" {
+		header.Env = map[string]string{"TERM": term}
+	}
+
+	data, err := json.Marshal(header)
+	if err == nil {
+		_, err = file.Write(append(data, '\n'))
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &sessionRecording{file: file, path: path, startedAt: startedAt}, nil
+}
+
+func (r *sessionRecording) output(data []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	elapsed := time.Since(r.startedAt).Seconds()
+	line, err := json.Marshal([]interface{}{elapsed, "o", string(data)})
+	if err != nil {
+		return
+	}
+	r.file.Write(append(line, '\n'))
+}
+
+func (r *sessionRecording) Close() error {
+	return r.file.Close()
+}
+
+// Writes through to w, recording everything written as terminal output
+type recordingWriter struct {
+	w         io.Writer
+	recording *sessionRecording
+}
+
+func (r recordingWriter) Write(p []byte) (int, error) {
+	n, err := r.w.Write(p)
+	if n > 0 {
+		r.recording.output(p[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,158 @@
+package bowser
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// The difference between the active accounts and the ones a reload would apply
+type AccountsDiff struct {
+	Added   []string        `json:"added"`
+	Removed []string        `json:"removed"`
+	Changed []AccountChange `json:"changed"`
+}
+
+// Describes how a single account would change, keys are listed by fingerprint
+type AccountChange struct {
+	Username    string   `json:"username"`
+	Fields      []string `json:"fields,omitempty"`
+	KeysAdded   []string `json:"keys_added,omitempty"`
+	KeysRemoved []string `json:"keys_removed,omitempty"`
+}
+
+// The settings compared between account versions, secrets are compared but never
+// included in the diff.
+var accountDiffFields = map[string]func(a *Account) interface{}{
+	"password":        func(a *Account) interface{} { return a.Password },
+	"mfa":             func(a *Account) interface{} { return a.MFA },
+	"whitelist":       func(a *Account) interface{} { return a.Whitelist },
+	"blacklist":       func(a *Account) interface{} { return a.Blacklist },
+	"allow_tags":      func(a *Account) interface{} { return a.AllowTags },
+	"deny_tags":       func(a *Account) interface{} { return a.DenyTags },
+	"groups":          func(a *Account) interface{} { return a.Groups },
+	"principals":      func(a *Account) interface{} { return a.Principals },
+	"force_user":      func(a *Account) interface{} { return a.ForceUser },
+	"force_command":   func(a *Account) interface{} { return a.ForceCommand },
+	"max_sessions":    func(a *Account) interface{} { return a.MaxSessions },
+	"max_forwards":    func(a *Account) interface{} { return a.MaxForwards },
+	"allow_ports":     func(a *Account) interface{} { return a.AllowPorts },
+	"deny_ports":      func(a *Account) interface{} { return a.DenyPorts },
+	"expires_at":      func(a *Account) interface{} { return a.ExpiresAt },
+	"platform_ids":    func(a *Account) interface{} { return a.PlatformIDs },
+	"allow_countries": func(a *Account) interface{} { return a.AllowCountries },
+	"deny_countries":  func(a *Account) interface{} { return a.DenyCountries },
+
+	"remote_forward_ports": func(a *Account) interface{} { return a.RemoteForwardPorts },
+	"bandwidth":            func(a *Account) interface{} { return a.Bandwidth },
+}
+
+func keyFingerprints(account *Account) map[string]bool {
+	fingerprints := make(map[string]bool)
+	for _, raw := range account.SSHKeysRaw {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(raw))
+		if err == nil {
+			fingerprints[ssh.FingerprintSHA256(key)] = true
+		}
+	}
+	return fingerprints
+}
+
+func sortedDifference(a, b map[string]bool) []string {
+	var result []string
+	for value := range a {
+		if !b[value] {
+			result = append(result, value)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func diffAccounts(current, next map[string]*Account) AccountsDiff {
+	diff := AccountsDiff{Added: []string{}, Removed: []string{}, Changed: []AccountChange{}}
+
+	for username := range next {
+		if _, exists := current[username]; !exists {
+			diff.Added = append(diff.Added, username)
+		}
+	}
+
+	for username, old := range current {
+		updated, exists := next[username]
+		if !exists {
+			diff.Removed = append(diff.Removed, username)
+			continue
+		}
+
+		change := AccountChange{Username: username}
+		for field, value := range accountDiffFields {
+			before, _ := json.Marshal(value(old))
+			after, _ := json.Marshal(value(updated))
+			if string(before) != string(after) {
+				change.Fields = append(change.Fields, field)
+			}
+		}
+		sort.Strings(change.Fields)
+
+		oldKeys, newKeys := keyFingerprints(old), keyFingerprints(updated)
+		change.KeysAdded = sortedDifference(newKeys, oldKeys)
+		change.KeysRemoved = sortedDifference(oldKeys, newKeys)
+
+		if len(change.Fields) > 0 || len(change.KeysAdded) > 0 || len(change.KeysRemoved) > 0 {
+			diff.Changed = append(diff.Changed, change)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool {
+		return diff.Changed[i].Username < diff.Changed[j].Username
+	})
+	return diff
+}
+
+// POST /reload reloads accounts, returning what changed. With ?dry_run=true the
+// accounts are only loaded, validated and diffed.
+func (api *HTTPAPI) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	if !dryRun && api.state.Config().APIReadOnly {
+		writeError(w, http.StatusForbidden, "api is in read-only mode")
+		return
+	}
+
+	accounts, _, err := api.state.loadAccountSet()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	active, _ := api.state.accountSet()
+	diff := diffAccounts(active, accounts)
+	if !dryRun {
+		api.state.reloadMOTD()
+		if err = api.state.reloadAccounts(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		api.state.log.Info("Reloaded accounts through the API",
+			zap.Int("added", len(diff.Added)),
+			zap.Int("removed", len(diff.Removed)),
+			zap.Int("changed", len(diff.Changed)))
+		api.state.audit.Emit(AuditEvent{Type: AuditAdminAction, Reason: "accounts reloaded"})
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		DryRun bool `json:"dry_run"`
+		AccountsDiff
+	}{dryRun, diff})
+}
@@ -0,0 +1,261 @@
+package bowser
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+var remoteForwardNotAllowedError = fmt.Errorf("remote forwarding to this port is not allowed")
+
+// The payload of tcpip-forward and cancel-tcpip-forward requests
+type tcpipForwardMsg struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// The payload of forwarded-tcpip channels opened to the client
+type forwardedTCPIPMsg struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// A port listening on the bastion on behalf of a client (ssh -R)
+type remoteForward struct {
+	listener net.Listener
+	forward  *Forward
+}
+
+// Handles global requests from the client, of which only remote forwarding is
+// supported
+func (s *SSHSession) handleGlobalRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			s.handleTCPIPForward(req)
+		case "cancel-tcpip-forward":
+			s.handleCancelTCPIPForward(req)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// Whether the account may have the bastion listen on the given port
+func (a *Account) canRemoteForward(port uint32) bool {
+	for _, allowed := range a.RemoteForwardPorts {
+		if uint32(allowed) == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SSHSession) handleTCPIPForward(req *ssh.Request) {
+	var msg tcpipForwardMsg
+	if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+
+	// Whatever the client asked to bind to, ports are only opened on the configured
+	//  address so they can't be exposed wider than intended.
+	bind := net.JoinHostPort(s.State.Config().RemoteForwardBind, strconv.Itoa(int(msg.BindPort)))
+	if !s.Account().canRemoteForward(msg.BindPort) {
+		s.remoteForwardRejected(bind, remoteForwardNotAllowedError.Error())
+		req.Reply(false, nil)
+		return
+	}
+
+	if reason := s.proveKeyOwnership(); reason != "" {
+		s.remoteForwardRejected(bind, reason)
+		req.Reply(false, nil)
+		return
+	}
+
+	if !s.reserveForward(bind) {
+		req.Reply(false, nil)
+		return
+	}
+
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		s.active.release()
+		s.log.Error("Failed to listen for remote forward", zap.String("bind", bind), zap.Error(err))
+		req.Reply(false, nil)
+		return
+	}
+
+	s.lock.Lock()
+	if s.remoteForwards == nil {
+		s.remoteForwards = make(map[uint32]*remoteForward)
+	}
+	if _, exists := s.remoteForwards[msg.BindPort]; exists {
+		s.lock.Unlock()
+		listener.Close()
+		s.active.release()
+		req.Reply(false, nil)
+		return
+	}
+
+	remote := &remoteForward{listener: listener}
+	remote.forward = s.active.open("remote:"+bind, func() { listener.Close() })
+	s.remoteForwards[msg.BindPort] = remote
+	s.lock.Unlock()
+
+	s.log.Info(
+		"Opened remote forward",
+		zap.String("bind", bind),
+		zap.String("requested-bind", msg.BindAddr))
+	s.State.webhooks.Notify(s.webhookEvent(WebhookRemoteForwardOpen, bind))
+	s.State.audit.Emit(s.auditEvent(AuditRemoteForwardOpen, bind))
+
+	req.Reply(true, nil)
+
+	s.forwards.Add(1)
+	go s.serveRemoteForward(remote, msg)
+}
+
+func (s *SSHSession) handleCancelTCPIPForward(req *ssh.Request) {
+	var msg tcpipForwardMsg
+	if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+
+	s.lock.Lock()
+	remote, exists := s.remoteForwards[msg.BindPort]
+	s.lock.Unlock()
+
+	if !exists {
+		req.Reply(false, nil)
+		return
+	}
+
+	remote.listener.Close()
+	req.Reply(true, nil)
+}
+
+// Closes the ports opened for the session, once it ended
+func (s *SSHSession) closeRemoteForwards() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, remote := range s.remoteForwards {
+		remote.listener.Close()
+	}
+}
+
+// Accepts connections on a remote forward until it's closed, bridging each one to a
+// forwarded-tcpip channel on the client.
+func (s *SSHSession) serveRemoteForward(remote *remoteForward, msg tcpipForwardMsg) {
+	defer s.forwards.Done()
+	defer s.active.release()
+
+	forward := remote.forward
+	startedAt := time.Now()
+
+	var conns sync.WaitGroup
+	for {
+		conn, err := remote.listener.Accept()
+		if err != nil {
+			break
+		}
+
+		conns.Add(1)
+		go func() {
+			s.handleRemoteConnection(conn, forward, msg)
+			conns.Done()
+		}()
+	}
+
+	s.lock.Lock()
+	delete(s.remoteForwards, msg.BindPort)
+	s.lock.Unlock()
+
+	// The listener is gone, but connections it accepted are left to finish
+	conns.Wait()
+	s.active.remove(forward.ID)
+
+	sent, received := atomic.LoadInt64(&forward.bytesSent), atomic.LoadInt64(&forward.bytesReceived)
+	duration := time.Since(startedAt)
+	s.log.Info(
+		"Remote forward closed",
+		zap.String("bind", remote.listener.Addr().String()),
+		zap.Duration("duration", duration),
+		zap.Int64("bytes-sent", sent),
+		zap.Int64("bytes-received", received))
+	s.recordTraffic(forward.Destination, sent, received)
+
+	event := s.webhookEvent(WebhookRemoteForwardClose, forward.Destination)
+	event.Duration = duration
+	event.BytesSent = sent
+	event.BytesReceived = received
+	s.State.webhooks.Notify(event)
+
+	closed := s.auditEvent(AuditRemoteForwardClose, forward.Destination)
+	closed.Fields = map[string]string{
+		"duration":       duration.String(),
+		"bytes_sent":     fmt.Sprintf("%d", sent),
+		"bytes_received": fmt.Sprintf("%d", received),
+	}
+	s.State.audit.Emit(closed)
+}
+
+func (s *SSHSession) handleRemoteConnection(conn net.Conn, forward *Forward, msg tcpipForwardMsg) {
+	defer conn.Close()
+
+	originHost, originPort, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	port, _ := strconv.Atoi(originPort)
+
+	channel, reqs, err := s.Conn.OpenChannel("forwarded-tcpip", ssh.Marshal(forwardedTCPIPMsg{
+		Addr:       msg.BindAddr,
+		Port:       msg.BindPort,
+		OriginAddr: originHost,
+		OriginPort: uint32(port),
+	}))
+	if err != nil {
+		s.log.Warn("Client refused remote forward connection", zap.String("origin", conn.RemoteAddr().String()), zap.Error(err))
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+
+	s.log.Debug("Accepted remote forward connection", zap.String("origin", conn.RemoteAddr().String()))
+
+	// Data arriving on the bastion goes to the client, so it counts as received
+	stats := &s.State.stats.bytes
+	done := make(chan struct{})
+	go func() {
+		io.Copy(countingWriter{throttle(channel, s.download), []*int64{&forward.bytesReceived, &s.bytesReceived, stats}}, conn)
+		channel.CloseWrite()
+		close(done)
+	}()
+
+	io.Copy(countingWriter{throttle(conn, s.upload), []*int64{&forward.bytesSent, &s.bytesSent, stats}}, channel)
+	conn.Close()
+	<-done
+}
+
+func (s *SSHSession) remoteForwardRejected(bind, reason string) {
+	s.log.Warn("Rejecting remote forward: "+reason, zap.String("bind", bind))
+
+	event := s.webhookEvent(WebhookACLReject, bind)
+	event.Reason = reason
+	s.State.webhooks.Notify(event)
+
+	rejected := s.auditEvent(AuditRemoteForwardReject, bind)
+	rejected.Reason = reason
+	s.State.audit.Emit(rejected)
+}
@@ -0,0 +1,176 @@
+package bowser
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Configuration for rotating a log file by size (in megabytes) and age (in hours),
+// keeping max_backups rotated files, optionally gzip compressed. Limits of 0 disable
+// the respective rotation or pruning.
+type LogRotationConfig struct {
+	MaxSize    int  `json:"max_size"`
+	MaxAge     int  `json:"max_age"`
+	MaxBackups int  `json:"max_backups"`
+	Compress   bool `json:"compress"`
+}
+
+// An append-only file which is rotated once it grows or ages past its limits. Rotated
+// files get a timestamp suffix and only the newest maxBackups of them are kept.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func openRotatingFile(path string, config LogRotationConfig) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       path,
+		maxSize:    int64(config.MaxSize) * 1024 * 1024,
+		maxAge:     time.Duration(config.MaxAge) * time.Hour,
+		maxBackups: config.MaxBackups,
+		compress:   config.Compress,
+	}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file, r.size, r.openedAt = file, info.Size(), time.Now()
+	return nil
+}
+
+// Closes and reopens the file, for when it was moved away by e.g. logrotate
+func (r *rotatingFile) Reopen() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.file.Close()
+	return r.open()
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	tooBig := r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize
+	tooOld := r.maxAge > 0 && time.Since(r.openedAt) > r.maxAge
+	if r.size > 0 && (tooBig || tooOld) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Moves the current file aside and starts a new one, must be called with the lock held
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+
+	rotated := fmt.Sprintf("%s.%s", r.path, time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	if r.compress {
+		go compressRotated(rotated)
+	}
+
+	r.prune()
+	return nil
+}
+
+// Replaces a rotated file with a gzip compressed copy
+func compressRotated(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := gzip.NewWriter(out)
+	_, err = io.Copy(writer, in)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Removes the oldest rotated files beyond maxBackups
+func (r *rotatingFile) prune() {
+	if r.maxBackups <= 0 {
+		return
+	}
+
+	rotated, err := filepath.Glob(r.path + ".*")
+	if err != nil || len(rotated) <= r.maxBackups {
+		return
+	}
+
+	// The timestamp suffixes sort chronologically, compressed or not
+	sort.Strings(rotated)
+	for _, path := range rotated[:len(rotated)-r.maxBackups] {
+		os.Remove(path)
+	}
+}
+
+func (r *rotatingFile) Sync() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.file.Sync()
+}
+
+func (r *rotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.file.Close()
+}
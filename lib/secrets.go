@@ -0,0 +1,326 @@
+package bowser
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+const secretReferencePrefix = "secret://"
+
+var noSecretsBackendError = fmt.Errorf("secret referenced but no secrets backend is configured")
+
+// Configuration for fetching secrets from an external store. Config values, account
+// TOTP secrets and ca_key can then be written as `secret://<name>` (or
+// `secret://<name>#<field>` to pick a field of a json secret) instead of in plaintext.
+// Values are cached for cache_ttl seconds, and the cached value keeps being used if
+// the backend becomes unreachable.
+type SecretsConfig struct {
+	Backend  string             `json:"backend"`
+	CacheTTL int                `json:"cache_ttl"`
+	Vault    VaultSecretsConfig `json:"vault"`
+	AWS      AWSSecretsConfig   `json:"aws"`
+	File     FileSecretsConfig  `json:"file"`
+}
+
+// Reads secrets from a Vault KV version 2 engine. Secrets without a field use their
+// "value" field.
+type VaultSecretsConfig struct {
+	Address string `json:"address"`
+	Token   string `json:"token"`
+	Mount   string `json:"mount"`
+}
+
+// Reads secrets from AWS Secrets Manager, credentials come from the standard AWS
+// environment/instance profile chain
+type AWSSecretsConfig struct {
+	Region string `json:"region"`
+}
+
+// Reads secrets from a json object of names to values, encrypted with AES-GCM the
+// same way accounts backups are. Files can be written with `bowser secrets encrypt`.
+type FileSecretsConfig struct {
+	Path          string `json:"path"`
+	EncryptionKey string `json:"encryption_key"`
+}
+
+type secretsProvider interface {
+	get(name, field string) (string, error)
+}
+
+func newSecretsProvider(config SecretsConfig) (secretsProvider, error) {
+	var provider secretsProvider
+	switch config.Backend {
+	case "":
+		return nil, nil
+	case "vault":
+		if config.Vault.Address == "" {
+			return nil, fmt.Errorf("vault secrets backend requires an address")
+		}
+
+		if config.Vault.Mount == "" {
+			config.Vault.Mount = "secret"
+		}
+		provider = vaultSecrets{config: config.Vault, client: &http.Client{Timeout: 10 * time.Second}}
+	case "aws":
+		awsConfig := aws.NewConfig()
+		if config.AWS.Region != "" {
+			awsConfig = awsConfig.WithRegion(config.AWS.Region)
+		}
+
+		sess, err := session.NewSession(awsConfig)
+		if err != nil {
+			return nil, err
+		}
+		provider = awsSecrets{client: secretsmanager.New(sess)}
+	case "file":
+		key, err := secretsFileKey(config.File)
+		if err != nil {
+			return nil, err
+		}
+		provider = fileSecrets{path: config.File.Path, key: key}
+	default:
+		return nil, fmt.Errorf("unknown secrets backend %s", config.Backend)
+	}
+
+	ttl := config.CacheTTL
+	if ttl == 0 {
+		ttl = 300
+	}
+
+	return &cachedSecrets{
+		provider: provider,
+		ttl:      time.Duration(ttl) * time.Second,
+		entries:  make(map[string]cachedSecret),
+	}, nil
+}
+
+// Builds the secrets provider from the secrets section of a raw config file, which can
+// itself only reference the environment and files.
+func loadSecretsProvider(data []byte) (secretsProvider, error) {
+	var raw struct {
+		Secrets json.RawMessage `json:"secrets"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil || raw.Secrets == nil {
+		return nil, err
+	}
+
+	resolved, err := interpolateConfig(raw.Secrets, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var config SecretsConfig
+	if err := json.Unmarshal(resolved, &config); err != nil {
+		return nil, err
+	}
+	return newSecretsProvider(config)
+}
+
+// Resolves a `secret://` reference, returning anything else unchanged
+func resolveSecret(secrets secretsProvider, value string) (string, error) {
+	if !strings.HasPrefix(value, secretReferencePrefix) {
+		return value, nil
+	}
+
+	if secrets == nil {
+		return "", noSecretsBackendError
+	}
+
+	name := strings.TrimPrefix(value, secretReferencePrefix)
+	var field string
+	if index := strings.Index(name, "#"); index != -1 {
+		name, field = name[:index], name[index+1:]
+	}
+
+	resolved, err := secrets.get(name, field)
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %v", name, err)
+	}
+	return resolved, nil
+}
+
+// Picks a field out of a secret holding a json object
+func secretField(value, field string) (string, error) {
+	if field == "" {
+		return value, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return "", fmt.Errorf("secret is not a json object")
+	}
+	return stringSecret(fields, field)
+}
+
+func stringSecret(fields map[string]interface{}, field string) (string, error) {
+	value, exists := fields[field]
+	if !exists {
+		return "", fmt.Errorf("no field %s", field)
+	}
+
+	text, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("field %s is not a string", field)
+	}
+	return text, nil
+}
+
+type cachedSecret struct {
+	value     string
+	fetchedAt time.Time
+}
+
+type cachedSecrets struct {
+	provider secretsProvider
+	ttl      time.Duration
+
+	lock    sync.Mutex
+	entries map[string]cachedSecret
+}
+
+func (c *cachedSecrets) get(name, field string) (string, error) {
+	key := name + "#" + field
+
+	c.lock.Lock()
+	cached, exists := c.entries[key]
+	c.lock.Unlock()
+
+	if exists && time.Since(cached.fetchedAt) < c.ttl {
+		return cached.value, nil
+	}
+
+	value, err := c.provider.get(name, field)
+	if err != nil {
+		if exists {
+			return cached.value, nil
+		}
+		return "", err
+	}
+
+	c.lock.Lock()
+	c.entries[key] = cachedSecret{value: value, fetchedAt: time.Now()}
+	c.lock.Unlock()
+	return value, nil
+}
+
+type vaultSecrets struct {
+	config VaultSecretsConfig
+	client *http.Client
+}
+
+func (v vaultSecrets) get(name, field string) (string, error) {
+	url := fmt.Sprintf("%s/v1/%s/data/%s", strings.TrimRight(v.config.Address, "/"), v.config.Mount, name)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.config.Token)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault responded with %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	if field == "" {
+		field = "value"
+	}
+	return stringSecret(body.Data.Data, field)
+}
+
+type awsSecrets struct {
+	client *secretsmanager.SecretsManager
+}
+
+func (a awsSecrets) get(name, field string) (string, error) {
+	output, err := a.client.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if output.SecretString == nil {
+		return "", fmt.Errorf("secret is not a string")
+	}
+	return secretField(*output.SecretString, field)
+}
+
+// The file is read on every fetch (the cache in front of it still applies), so it can
+// be replaced without a restart.
+type fileSecrets struct {
+	path string
+	key  []byte
+}
+
+func (f fileSecrets) get(name, field string) (string, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := decryptBackup(f.key, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %v", f.path, err)
+	}
+
+	var secrets map[string]interface{}
+	if err := json.Unmarshal(plaintext, &secrets); err != nil {
+		return "", err
+	}
+
+	if fields, ok := secrets[name].(map[string]interface{}); ok && field != "" {
+		return stringSecret(fields, field)
+	}
+
+	value, err := stringSecret(secrets, name)
+	if err != nil {
+		return "", err
+	}
+	return secretField(value, field)
+}
+
+func secretsFileKey(config FileSecretsConfig) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(config.EncryptionKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("secrets file encryption_key must be 32 base64 encoded bytes")
+	}
+	return key, nil
+}
+
+// Encrypts a json object of secrets for the file secrets backend
+func EncryptSecretsFile(config SecretsConfig, data []byte) ([]byte, error) {
+	key, err := secretsFileKey(config.File)
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets map[string]interface{}
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("secrets must be a json object: %v", err)
+	}
+	return encryptBackup(key, data)
+}
@@ -0,0 +1,226 @@
+package bowser
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Configuration for reporting errors and panics to Sentry (or anything speaking its
+// store API). Disabled unless sentry_dsn is set.
+type ErrorReportingConfig struct {
+	SentryDSN   string `json:"sentry_dsn"`
+	Environment string `json:"environment"`
+	QueueSize   int    `json:"queue_size"`
+}
+
+// Log fields which become searchable tags on reported events
+var errorReportTags = map[string]string{
+	"id":       "session_id",
+	"username": "username",
+	"host":     "host",
+	"module":   "module",
+}
+
+type sentryEvent struct {
+	EventID     string                 `json:"event_id"`
+	Timestamp   string                 `json:"timestamp"`
+	Level       string                 `json:"level"`
+	Logger      string                 `json:"logger"`
+	Platform    string                 `json:"platform"`
+	Message     string                 `json:"message"`
+	Release     string                 `json:"release"`
+	Environment string                 `json:"environment,omitempty"`
+	ServerName  string                 `json:"server_name,omitempty"`
+	Tags        map[string]string      `json:"tags,omitempty"`
+	Extra       map[string]interface{} `json:"extra,omitempty"`
+}
+
+// Reports events to Sentry from a background worker, dropping them when the queue is
+// full so a burst of errors never blocks the code logging them.
+type errorReporter struct {
+	storeURL    string
+	auth        string
+	environment string
+	client      *http.Client
+	events      chan sentryEvent
+}
+
+func newErrorReporter(config ErrorReportingConfig) (*errorReporter, error) {
+	if config.SentryDSN == "" {
+		return nil, nil
+	}
+
+	// DSNs look like https://<key>@<host>/<project>
+	dsn, err := url.Parse(config.SentryDSN)
+	if err != nil {
+		return nil, err
+	}
+
+	project := strings.Trim(dsn.Path, "/")
+	if dsn.User == nil || project == "" {
+		return nil, fmt.Errorf("invalid sentry dsn")
+	}
+
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = 64
+	}
+
+	reporter := &errorReporter{
+		storeURL:    fmt.Sprintf("%s://%s/api/%s/store/", dsn.Scheme, dsn.Host, project),
+		auth:        fmt.Sprintf("Sentry sentry_version=7, sentry_client=bowser/%s, sentry_key=%s", VERSION, dsn.User.Username()),
+		environment: config.Environment,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		events:      make(chan sentryEvent, queueSize),
+	}
+
+	go reporter.run()
+	return reporter, nil
+}
+
+func (r *errorReporter) run() {
+	for event := range r.events {
+		r.send(event)
+	}
+}
+
+func (r *errorReporter) send(event sentryEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", r.storeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sentry responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (r *errorReporter) event(level, message string, fields map[string]interface{}) sentryEvent {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	event := sentryEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   time.Now().UTC().Format("2006-01-02T15:04:05"),
+		Level:       level,
+		Logger:      "bowser",
+		Platform:    "go",
+		Message:     message,
+		Release:     VERSION,
+		Environment: r.environment,
+		Tags:        make(map[string]string),
+		Extra:       make(map[string]interface{}),
+	}
+
+	for key, value := range fields {
+		if tag, exists := errorReportTags[key]; exists {
+			event.Tags[tag] = fmt.Sprint(value)
+		} else {
+			event.Extra[key] = value
+		}
+	}
+	return event
+}
+
+// Reports a recovered panic, waiting for it to be delivered since the process is
+// likely about to exit.
+func (r *errorReporter) reportPanic(recovered interface{}, fields map[string]interface{}) {
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+	fields["stacktrace"] = string(debug.Stack())
+
+	r.send(r.event("fatal", fmt.Sprintf("panic: %v", recovered), fields))
+}
+
+// A zap core reporting entries at error level and above
+type errorReportCore struct {
+	reporter *errorReporter
+	fields   []zapcore.Field
+}
+
+func (c errorReportCore) Enabled(level zapcore.Level) bool {
+	return level >= zapcore.ErrorLevel
+}
+
+func (c errorReportCore) With(fields []zapcore.Field) zapcore.Core {
+	c.fields = append(append([]zapcore.Field{}, c.fields...), fields...)
+	return c
+}
+
+func (c errorReportCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c errorReportCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	encoder := zapcore.NewMapObjectEncoder()
+	for _, field := range append(c.fields, fields...) {
+		field.AddTo(encoder)
+	}
+
+	level := "error"
+	if entry.Level > zapcore.ErrorLevel {
+		level = "fatal"
+	}
+
+	event := c.reporter.event(level, entry.Message, encoder.Fields)
+	if entry.Stack != "" {
+		event.Extra["stacktrace"] = entry.Stack
+	}
+
+	select {
+	case c.reporter.events <- event:
+	default:
+	}
+	return nil
+}
+
+func (c errorReportCore) Sync() error {
+	return nil
+}
+
+// Deferred at the top of goroutines handling connections, reporting panics before
+// letting them crash the process as they always have.
+func (s *SSHDState) reportPanics(fields ...zap.Field) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	if s.errors != nil {
+		encoder := zapcore.NewMapObjectEncoder()
+		for _, field := range fields {
+			field.AddTo(encoder)
+		}
+		s.errors.reportPanic(recovered, encoder.Fields)
+	}
+	panic(recovered)
+}
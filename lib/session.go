@@ -5,20 +5,26 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
 // An account key represents a mapping of ssh public key to account
 type AccountKey struct {
-	Account *Account
-	Key     ssh.PublicKey
-	Comment string
-	Options []string
+	Account   *Account
+	Key       ssh.PublicKey
+	Comment   string
+	Options   []string
+	ExpiresAt time.Time
 }
 
 func NewAccountKey(account *Account, rawKey []byte) (*AccountKey, error) {
@@ -27,11 +33,17 @@ func NewAccountKey(account *Account, rawKey []byte) (*AccountKey, error) {
 		return nil, err
 	}
 
+	expiresAt, err := parseKeyExpiry(options)
+	if err != nil {
+		return nil, err
+	}
+
 	return &AccountKey{
-		Account: account,
-		Key:     key,
-		Comment: comment,
-		Options: options,
+		Account:   account,
+		Key:       key,
+		Comment:   comment,
+		Options:   options,
+		ExpiresAt: expiresAt,
 	}, nil
 }
 
@@ -41,58 +53,210 @@ func (key *AccountKey) ID() string {
 
 // An SSHSession represents one TCP connection, with one or more direct-tcpip channels
 type SSHSession struct {
-	UUID    string
-	State   *SSHDState
-	Account *Account
-	Conn    *ssh.ServerConn
+	// Total bytes sent to and received from destinations over all forwards. These
+	//  are updated atomically and must stay first for 64-bit alignment.
+	bytesSent     int64
+	bytesReceived int64
+
+	UUID      string
+	State     *SSHDState
+	Conn      *ssh.ServerConn
+	StartedAt time.Time
+	Country   string
+
+	// The MFA providers which accepted the login's second factors, if any
+	MFAMethods []string
+
+	// The *Account, swapped by account reloads while forwards read it
+	account atomic.Value
 
 	verified bool
 	log      *zap.Logger
+	dialer   *dialCache
+	done     chan struct{}
+
+	// Tracks channels still being handled, the forwards currently open, and
+	//  every destination visited
+	forwards     sync.WaitGroup
+	active       *forwardRegistry
+	lock         sync.Mutex
+	destinations []string
+
+	// Ports listening on the bastion for the client, by port
+	remoteForwards map[uint32]*remoteForward
+
+	// Every certificate issued in this session, so they can be revoked
+	certificates []issuedCertificate
+
+	// Interactive channels, which admin broadcasts are written to
+	terminals []ssh.Channel
+
+	// Bandwidth shared by all forwards of the session, nil when unlimited
+	upload   *bandwidthLimiter
+	download *bandwidthLimiter
+
+	// Traffic of the session's closed forwards by destination
+	traffic trafficTotals
+
+	// Paths of the terminal recordings made in this session
+	recordings []string
 }
 
 func NewSSHSession(state *SSHDState, conn *ssh.ServerConn) *SSHSession {
-	id := uuid.NewV4()
+	// Normally picked during authentication, see the keyboard interactive callback
+	var strID string
+	var mfaMethods []string
+	if conn.Permissions != nil {
+		strID = conn.Permissions.Extensions["session-uuid"]
+		if methods := conn.Permissions.Extensions["mfa-methods"]; methods != "" {
+			mfaMethods = strings.Split(methods, ",")
+		}
+	}
+	if strID == "" {
+		strID = uuid.NewV4().String()
+	}
 
-	strID, _ := id.MarshalText()
+	// Every log line for this session carries these correlation fields
+	country := state.geoip.country(conn.RemoteAddr())
+	sessionLog := state.connLog(conn).With(
+		zap.String("id", strID),
+		zap.String("country", country),
+		zap.String("module", "proxy"))
 
-	state.log.Info(
+	sessionLog.Info(
 		"New SSH session created",
-		zap.String("id", string(strID)),
-		zap.String("username", conn.User()),
 		zap.String("session-id", string(conn.SessionID())),
-		zap.String("client-version", string(conn.ClientVersion())),
-		zap.String("remote-addr", conn.RemoteAddr().String()))
-
-	return &SSHSession{
-		UUID:    string(strID),
-		State:   state,
-		Account: state.accounts[conn.User()],
-		Conn:    conn,
-		log:     state.log,
+		zap.String("client-version", string(conn.ClientVersion())))
+
+	accounts, _ := state.accountSet()
+	account := accounts[conn.User()]
+	bandwidth := state.Config().Bandwidth.forAccount(account)
+
+	session := &SSHSession{
+		UUID:       strID,
+		State:      state,
+		Conn:       conn,
+		StartedAt:  time.Now().UTC(),
+		Country:    country,
+		log:        sessionLog,
+		MFAMethods: mfaMethods,
+		dialer:     newDialCache(state.Config().DialCacheTTL, state.Config().Keepalive.interval()),
+		done:       make(chan struct{}),
+		active:     newForwardRegistry(),
+		upload:     newBandwidthLimiter(bandwidth.Upload),
+		download:   newBandwidthLimiter(bandwidth.Download),
 	}
+	session.setAccount(account)
+	return session
+}
+
+// Returns the session's account, which account reloads replace
+func (s *SSHSession) Account() *Account {
+	return s.account.Load().(*Account)
+}
+
+func (s *SSHSession) setAccount(account *Account) {
+	s.account.Store(account)
 }
 
 func (s *SSHSession) handleChannels(chans <-chan ssh.NewChannel) {
+	go s.keepalive()
+
 	for newChannel := range chans {
+		s.forwards.Add(1)
 		go s.handleChannel(newChannel)
 	}
+	close(s.done)
+	s.closeRemoteForwards()
+
+	// Let in-flight forwards finish so our totals are complete
+	s.forwards.Wait()
+	s.State.removeSession(s.UUID)
+
+	duration := time.Since(s.StartedAt)
+	sent, received := atomic.LoadInt64(&s.bytesSent), atomic.LoadInt64(&s.bytesReceived)
+
+	s.lock.Lock()
+	destinations := s.destinations
+	s.lock.Unlock()
+
+	s.log.Info(
+		"SSH session ended",
+		zap.Duration("duration", duration),
+		zap.Int64("bytes-sent", sent),
+		zap.Int64("bytes-received", received))
+
+	event := s.webhookEvent(WebhookSessionEnd, "")
+	event.Duration = duration
+	event.BytesSent = sent
+	event.BytesReceived = received
+	event.Destinations = destinations
+	event.Traffic = s.trafficByDestination()
+	s.State.webhooks.Notify(event)
+
+	ended := s.auditEvent(AuditSessionEnd, "")
+	ended.Fields = map[string]string{
+		"duration":       duration.String(),
+		"bytes_sent":     fmt.Sprintf("%d", sent),
+		"bytes_received": fmt.Sprintf("%d", received),
+		"destinations":   strings.Join(destinations, ","),
+	}
+	s.State.audit.Emit(ended)
+}
+
+// Builds a webhook event for this session, destination may be empty
+func (s *SSHSession) webhookEvent(eventType, destination string) WebhookEvent {
+	return WebhookEvent{
+		Type:        eventType,
+		Username:    s.Conn.User(),
+		PlatformIDs: s.Account().PlatformIDs,
+		SessionID:   s.UUID,
+		Destination: destination,
+		Source:      s.Conn.RemoteAddr().String(),
+		Country:     s.Country,
+	}
+}
 
-	delete(s.State.sessions, s.UUID)
+// Builds an audit event for this session, destination may be empty
+func (s *SSHSession) auditEvent(eventType, destination string) AuditEvent {
+	return AuditEvent{
+		Type:        eventType,
+		Username:    s.Conn.User(),
+		SessionID:   s.UUID,
+		Source:      s.Conn.RemoteAddr().String(),
+		Country:     s.Country,
+		Destination: destination,
+	}
+}
+
+// Reaps the session once the client stops answering keepalives, e.g. a laptop which
+// roamed away leaving a half-open connection behind.
+func (s *SSHSession) keepalive() {
+	config := s.State.Config().Keepalive
+	if sendKeepalives(s.Conn, config, s.done) {
+		s.log.Warn("Closing session which stopped answering keepalives", zap.Int("missed", config.MaxMissed))
+		s.Close()
+	}
 }
 
 func (s *SSHSession) Close() {
+	s.active.closeAll()
 	s.Conn.Close()
 }
 
 func (s *SSHSession) handleChannel(newChannel ssh.NewChannel) {
+	defer s.forwards.Done()
+	defer s.State.reportPanics(zap.String("id", s.UUID), zap.String("username", s.Account().Username))
+
 	switch newChannel.ChannelType() {
 	case "direct-tcpip":
 		s.handleChannelForward(newChannel)
+	case "session":
+		s.handleChannelSession(newChannel)
 	default:
 		s.log.Error(
 			"Rejecting channel with invalid channel type",
-			zap.String("type", newChannel.ChannelType()),
-			zap.String("id", s.UUID))
+			zap.String("type", newChannel.ChannelType()))
 		newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type"))
 		return
 	}
@@ -105,181 +269,237 @@ type channelOpenDirectMsg struct {
 	LPort uint32
 }
 
-func (s *SSHSession) handleChannelForward(newChannel ssh.NewChannel) {
-	// Attempt to open a channel to the auth agent
+// Opens the client's agent to verify the session owns its account key, for requests
+// which don't carry an agent channel of their own. Returns the reason to reject the
+// request with, or an empty string once verified.
+func (s *SSHSession) proveKeyOwnership() string {
 	agentChan, agentReqs, err := s.Conn.OpenChannel("auth-agent@openssh.com", nil)
 	if err != nil {
-		s.log.Error(
-			"Rejecting forward: failed to open ssh agent",
-			zap.String("id", s.UUID),
-			zap.Error(err))
-		newChannel.Reject(ssh.Prohibited, "you must have an ssh agent open and forwarded")
-		return
+		s.log.Error("Failed to open ssh agent", zap.Error(err))
+		return "you must have an ssh agent open and forwarded"
 	}
-
-	// Just discard further requests
 	go ssh.DiscardRequests(agentReqs)
+	defer agentChan.Close()
 
-	// Open an agent on the channel
-	ag := agent.NewClient(agentChan)
+	reason := s.verifyAgent(agent.NewClient(agentChan))
+	if reason == "" && !s.verified {
+		reason = "none of the keys in your agent belong to your account"
+	}
+	return reason
+}
 
+// Verifies the session owns its account key by having the agent sign random data.
+// Returns the reason to reject the channel with, or an empty string once verified.
+func (s *SSHSession) verifyAgent(ag agent.Agent) string {
 	// If the session has not been verified yet, we must do that now by taking a
 	//  random string, requesting their agent encrypt it with a known public key,
 	//  and validating the results. This verifies ownership of the public key, even
 	//  though it is not used as the primary authentication scheme for the session.
-	if !s.verified {
-		signers, err := ag.Signers()
-		if err != nil {
-			s.log.Error(
-				"Rejecting forward: failed to get list of signers from agent",
-				zap.String("id", s.UUID),
-				zap.Error(err))
-			newChannel.Reject(ssh.Prohibited, "agent will not give us a list of signers")
-			return
-		}
+	if s.verified {
+		return ""
+	}
 
-		// Iterate over all signers to find one with a valid publick ey
-		for _, signer := range signers {
-			// Check if the public key exists
-			accountKey, exists := s.State.keys[string(signer.PublicKey().Marshal())]
+	signers, err := ag.Signers()
+	if err != nil {
+		s.log.Error(
+			"Rejecting channel: failed to get list of signers from agent",
+			zap.Error(err))
+		return "agent will not give us a list of signers"
+	}
+
+	authorities := s.State.trustedUserCAs()
+	_, keys := s.State.accountSet()
+
+	// Iterate over all signers to find one with a valid publick ey
+	for _, signer := range signers {
+		publicKey := signer.PublicKey()
+
+		// Check if the public key exists, or is a certificate valid for this account
+		if cert, ok := publicKey.(*ssh.Certificate); ok && authorities != nil {
+			if _, err := authorities.check(cert, s.Account().Username, s.Conn.RemoteAddr()); err != nil {
+				continue
+			}
+		} else {
+			accountKey, exists := keys[string(publicKey.Marshal())]
 			if !exists {
 				continue
 			}
 
 			// Verify whether the public key is for the current sessions account
-			if accountKey.Account != s.Account {
+			if accountKey.Account != s.Account() {
 				continue
 			}
+		}
 
-			// If it is, validate a random string
-			randomToken := make([]byte, 128)
-			_, err := rand.Read(randomToken)
-			if err != nil {
-				s.log.Error(
-					"Rejecting forward: failed to generate random token",
-					zap.String("id", s.UUID),
-					zap.Error(err))
-				newChannel.Reject(ssh.Prohibited, "cannot generate random token")
-				return
-			}
+		// If it is, validate a random string
+		randomToken := make([]byte, 128)
+		_, err := rand.Read(randomToken)
+		if err != nil {
+			s.log.Error(
+				"Rejecting channel: failed to generate random token",
+				zap.Error(err))
+			return "cannot generate random token"
+		}
 
-			// Sign the random token with the signer
-			sig, err := signer.Sign(rand.Reader, randomToken)
-			if err != nil {
-				s.log.Error(
-					"Rejecting forward: failed to sign random token",
-					zap.String("id", s.UUID),
-					zap.Error(err))
-				newChannel.Reject(ssh.Prohibited, "cannot sign random token")
-				return
-			}
+		// Sign the random token with the signer
+		sig, err := signer.Sign(rand.Reader, randomToken)
+		if err != nil {
+			s.log.Error(
+				"Rejecting channel: failed to sign random token",
+				zap.Error(err))
+			return "cannot sign random token"
+		}
 
-			// Verify the signature
-			err = accountKey.Key.Verify(randomToken, sig)
-			if err != nil {
-				s.log.Error(
-					"Rejecting forward: failed to verify random token signature",
-					zap.String("id", s.UUID),
-					zap.Error(err))
-				newChannel.Reject(ssh.Prohibited, "signature verification failed")
-				return
-			}
+		// Verify the signature
+		err = publicKey.Verify(randomToken, sig)
+		if err != nil {
+			s.log.Error(
+				"Rejecting channel: failed to verify random token signature",
+				zap.Error(err))
+			return "signature verification failed"
+		}
+
+		s.log.Info("Public key verification completed")
+		s.lock.Lock()
+		s.verified = true
+		s.lock.Unlock()
+		break
+	}
 
-			s.log.Info("Public key verification completed", zap.String("id", s.UUID))
-			s.verified = true
-			break
+	return ""
+}
+
+func (s *SSHSession) handleChannelForward(newChannel ssh.NewChannel) {
+	setupStarted := time.Now()
+
+	// Attempt to open a channel to the auth agent
+	agentChan, agentReqs, err := s.Conn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		s.log.Error(
+			"Rejecting forward: failed to open ssh agent",
+			zap.Error(err))
+		newChannel.Reject(ssh.Prohibited, "you must have an ssh agent open and forwarded")
+		return
+	}
+
+	// Just discard further requests
+	go ssh.DiscardRequests(agentReqs)
+
+	// Once accepted the forward closes the agent channel, every rejection has to
+	accepted := false
+	defer func() {
+		if !accepted {
+			agentChan.Close()
 		}
+	}()
+
+	// Open an agent on the channel
+	ag := agent.NewClient(agentChan)
+
+	if reason := s.verifyAgent(ag); reason != "" {
+		newChannel.Reject(ssh.Prohibited, reason)
+		return
 	}
 
-	// Now that we're verified, we must ask the SSH-CA to generate and sign a valid
-	//  SSH key/cert that we can use to login.
-	var username string
-	if s.State.Config.ForceUser != "" {
-		username = s.State.Config.ForceUser
-	} else {
-		username = s.Account.Username
+	// Find out where the client wants to go, the destination decides which user and
+	//  command the certificate may be forced to.
+	var msg channelOpenDirectMsg
+	ssh.Unmarshal(newChannel.ExtraData(), &msg)
+
+	// Every check, event and certificate sees the destination in one spelling
+	host := normalizeDestination(msg.RAddr)
+
+	// Aliases are checked and reported by their name, only their target is dialed
+	var target string
+	target, msg.RPort = s.State.Config().resolveAlias(host, msg.RPort)
+	address := fmt.Sprintf("%s:%d", host, msg.RPort)
+
+	// The destination has to pass the account ACLs (and a forward slot has to be
+	//  free) before a certificate is issued for it, as the certificate carries the
+	//  destinations principal and command.
+	if err := s.State.canConnectTo(s.Account(), host); err != nil {
+		s.destinationRejected(host, address, err)
+		newChannel.Reject(ssh.ConnectionFailed, "invalid permissions")
+		return
 	}
 
-	var principals []string
-	if len(s.Account.Principals) > 0 {
-		principals = s.Account.Principals
-	} else {
-		principals = append(principals, username)
+	if err := s.Account().canConnectToPort(s.State.Config(), host, int(msg.RPort)); err != nil {
+		s.destinationRejected(host, address, err)
+		newChannel.Reject(ssh.ConnectionFailed, "invalid permissions")
+		return
 	}
 
-	keyID := fmt.Sprintf("user[%s] / session[%s]", s.Account.Username, s.UUID)
-	cert, privateKey, err := s.State.ca.Generate(
-		keyID,
-		s.State.Config.ForceCommand,
-		principals,
-		s.State.Config.PermittedSourceAddresses,
-	)
+	if err := s.Account().canConnectToTarget(s.State.Config(), host, target, int(msg.RPort)); err != nil {
+		s.destinationRejected(host, address, err)
+		newChannel.Reject(ssh.ConnectionFailed, "invalid permissions")
+		return
+	}
+
+	// Forwards are end to end encrypted, so recorded destinations can't be forwarded to
+	if s.State.Config().Recording.matches(s.State.Config().destinationTags(host, target)) {
+		s.destinationRejected(host, address, recordingRequiredError)
+		newChannel.Reject(ssh.Prohibited, "this destination "+recordingRequiredError.Error())
+		return
+	}
+
+	if !s.reserveForward(address) {
+		newChannel.Reject(ssh.ResourceShortage, fmt.Sprintf("too many open forwards (the limit is %d)", s.State.forwardLimit(s.Account())))
+		return
+	}
+	defer s.active.release()
+
+	// The name passed the ACLs, but it could still resolve anywhere
+	addrs, err := s.resolveDestination(target)
+	if _, denied := err.(deniedAddressError); denied {
+		s.destinationRejected(host, address, err)
+		newChannel.Reject(ssh.ConnectionFailed, "invalid permissions")
+		return
+	} else if err != nil {
+		s.log.Error(
+			"Rejecting forward: failed to resolve remote host",
+			zap.String("host", target),
+			zap.Error(err))
+		newChannel.Reject(ssh.ConnectionFailed, fmt.Sprintf("error: %v", err))
+		return
+	}
+
+	// Now that we're verified and allowed there, we must ask the SSH-CA to generate
+	//  and sign a valid SSH key/cert that we can use to login.
+	cert, privateKey, _, err := s.issueCertificate(host, address)
 	if err != nil {
 		s.log.Error(
 			"Rejecting forward: failed to generate ssh certificate",
-			zap.String("id", s.UUID),
 			zap.Error(err))
 		newChannel.Reject(ssh.Prohibited, "failed to generate ssh certificate")
 		return
 	}
 
-	// Now we add the generated key and certificate to the users agent
+	// Now we add the generated key and certificate to the users agent, and we're
+	//  finally ready to redirect the client to where it wants to go
 	err = ag.Add(agent.AddedKey{
 		PrivateKey:   privateKey,
 		Certificate:  cert,
-		LifetimeSecs: 60,
+		LifetimeSecs: uint32(certificateValidity / time.Second),
 		Comment:      "temporary ssh certificate",
 	})
 
 	if err != nil {
 		s.log.Error(
 			"Rejecting forward: failed to add ssh key/cert to agent",
-			zap.String("id", s.UUID),
 			zap.Error(err))
 		newChannel.Reject(ssh.Prohibited, "failed to add ssh key/cert to agent")
 		return
 	}
 
-	// Finally, we're ready to find out where the client wants to go, and redirect
-	//  them properly.
-	var msg channelOpenDirectMsg
-	ssh.Unmarshal(newChannel.ExtraData(), &msg)
-	address := fmt.Sprintf("%s:%d", msg.RAddr, msg.RPort)
-
-	// Check the whitelist first
-	if s.Account.whitelistRe != nil {
-		if !s.Account.whitelistRe.Match([]byte(msg.RAddr)) {
-			s.log.Error(
-				"Rejecting forward: does not match whitelist",
-				zap.String("id", s.UUID),
-				zap.String("host", msg.RAddr))
-			newChannel.Reject(ssh.ConnectionFailed, "invalid permissions")
-			return
-		}
-	}
-
-	// Then check against blacklist
-	if s.Account.blacklistRe != nil {
-		if s.Account.blacklistRe.Match([]byte(msg.RAddr)) {
-			s.log.Error(
-				"Rejecting forward: matches blacklist",
-				zap.String("id", s.UUID),
-				zap.String("host", msg.RAddr))
-			newChannel.Reject(ssh.ConnectionFailed, "invalid permissions")
-			return
-		}
-	}
-
-	for _, wp := range s.State.WebhookProviders {
-		platformID := s.Account.PlatformIDs[wp.PlatformName()]
-		wp.NotifySessionStart(platformID, s.Conn.User(), s.UUID, msg.RAddr, fmt.Sprintf("%s", s.Conn.RemoteAddr()))
-	}
+	s.State.webhooks.Notify(s.webhookEvent(WebhookForwardOpen, host))
+	opened := s.auditEvent(AuditForwardOpen, address)
+	opened.Fields = map[string]string{"addresses": strings.Join(addrs, ",")}
+	s.State.audit.Emit(opened)
 
-	conn, err := net.Dial("tcp", address)
+	conn, err := s.dialer.dial(target, addrs, strconv.Itoa(int(msg.RPort)))
 	if err != nil {
 		s.log.Error(
 			"Rejecting forward: failed to open TCP connection to remote host",
-			zap.String("id", s.UUID),
 			zap.String("host", address),
 			zap.Error(err))
 		newChannel.Reject(ssh.ConnectionFailed, fmt.Sprintf("error: %v", err))
@@ -287,22 +507,259 @@ func (s *SSHSession) handleChannelForward(newChannel ssh.NewChannel) {
 	}
 
 	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		s.log.Error("Failed to accept forward channel", zap.Error(err))
+		conn.Close()
+		return
+	}
+	accepted = true
+	s.State.stats.forwardOpened(time.Since(setupStarted))
+	s.log.Info(
+		"Opened forward",
+		zap.String("host", address),
+		zap.String("ip", conn.RemoteAddr().String()))
+
+	s.lock.Lock()
+	s.destinations = append(s.destinations, address)
+	s.lock.Unlock()
 
 	go ssh.DiscardRequests(reqs)
 	var closer sync.Once
 	closeFunc := func() {
-		agentChan.Close()
-		channel.Close()
-		conn.Close()
+		closer.Do(func() {
+			agentChan.Close()
+			channel.Close()
+			conn.Close()
+		})
+	}
+
+	forward := s.active.open(address, closeFunc)
+	defer s.active.remove(forward.ID)
+
+	// Forwards to some destinations have their raw bytes recorded
+	var toClient, toDestination io.Writer = channel, conn
+	if config := s.State.Config().Capture; config.matches(s.State.Config().destinationTags(host, target)) {
+		capture, err := newForwardCapture(config, captureHeader{
+			SessionID:   s.UUID,
+			ForwardID:   forward.ID,
+			Username:    s.Account().Username,
+			Source:      s.Conn.RemoteAddr().String(),
+			Destination: address,
+			OpenedAt:    forward.OpenedAt,
+		})
+		if err != nil {
+			s.log.Error("Failed to start forward capture", zap.String("host", address), zap.Error(err))
+		} else {
+			s.log.Info("Capturing forward", zap.String("host", address), zap.String("path", capture.path))
+			defer capture.Close()
+			toClient = captureWriter{channel, capture, captureReceived}
+			toDestination = captureWriter{conn, capture, captureSent}
+		}
 	}
 
+	var copies sync.WaitGroup
+	copies.Add(2)
+	startedAt := time.Now()
+
+	// Both directions are throttled by the session's limits and the destination's
+	limit := s.State.Config().Bandwidth.forTags(s.State.Config().destinationTags(host, target))
+	toClient = throttle(toClient, s.download, newBandwidthLimiter(limit.Download))
+	toDestination = throttle(toDestination, s.upload, newBandwidthLimiter(limit.Upload))
+
+	// Bytes are counted as they are copied, so open forwards report live totals
+	stats := &s.State.stats.bytes
 	go func() {
-		io.Copy(channel, conn)
-		closer.Do(closeFunc)
+		io.Copy(countingWriter{toClient, []*int64{&forward.bytesReceived, &s.bytesReceived, stats}}, conn)
+		closeFunc()
+		copies.Done()
 	}()
 
 	go func() {
-		io.Copy(conn, channel)
-		closer.Do(closeFunc)
+		io.Copy(countingWriter{toDestination, []*int64{&forward.bytesSent, &s.bytesSent, stats}}, channel)
+		closeFunc()
+		copies.Done()
 	}()
+
+	// Once both directions are done, report the forward as closed
+	copies.Wait()
+	sent, received := atomic.LoadInt64(&forward.bytesSent), atomic.LoadInt64(&forward.bytesReceived)
+
+	s.forwardClosed(host, address, startedAt, sent, received)
+}
+
+// Generates a short lived certificate for logging into the given destination, with the
+// user and command forced for it. Returns the certificate, its key and the login user.
+func (s *SSHSession) issueCertificate(host, address string) (*ssh.Certificate, *ed25519.PrivateKey, string, error) {
+	username, forceCommand := s.State.Config().forcedLogin(s.Account(), host)
+	if username == "" {
+		username = s.Account().Username
+	}
+
+	var principals []string
+	if len(s.Account().Principals) > 0 {
+		principals = s.Account().Principals
+	} else {
+		principals = append(principals, username)
+	}
+
+	caLog := s.log.With(zap.String("module", "ca"))
+	caLog.Debug(
+		"Issuing certificate",
+		zap.String("host", address),
+		zap.Strings("principals", principals),
+		zap.String("force-command", forceCommand))
+
+	keyID := fmt.Sprintf("user[%s] / session[%s] / identity[%s]", s.Account().Username, s.UUID, username)
+	cert, privateKey, err := s.State.ca.Generate(
+		keyID,
+		forceCommand,
+		principals,
+		s.State.Config().PermittedSourceAddresses,
+	)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	s.State.stats.certSigned()
+
+	// A certificate that can't be recorded isn't handed out
+	err = s.State.certLog.add(CertificateRecord{
+		Serial:       cert.Serial,
+		KeyID:        cert.KeyId,
+		Principals:   cert.ValidPrincipals,
+		Username:     s.Account().Username,
+		SessionID:    s.UUID,
+		Destination:  address,
+		Source:       s.Conn.RemoteAddr().String(),
+		ForceCommand: forceCommand,
+		IssuedAt:     time.Now().UTC(),
+		ValidAfter:   time.Unix(int64(cert.ValidAfter), 0).UTC(),
+		ValidBefore:  time.Unix(int64(cert.ValidBefore), 0).UTC(),
+	})
+	if err != nil {
+		caLog.Error("Failed to record issued certificate", zap.Error(err))
+		return nil, nil, "", err
+	}
+
+	s.lock.Lock()
+	s.certificates = append(s.certificates, issuedCertificate{
+		Serial:      cert.Serial,
+		KeyID:       cert.KeyId,
+		Destination: address,
+		ValidBefore: time.Unix(int64(cert.ValidBefore), 0).UTC(),
+	})
+	s.lock.Unlock()
+	caLog.Debug("Issued certificate", zap.String("key-id", cert.KeyId), zap.Uint64("valid-before", cert.ValidBefore))
+
+	issued := s.auditEvent(AuditCertIssued, address)
+	issued.Fields = map[string]string{
+		"key_id":       cert.KeyId,
+		"serial":       fmt.Sprintf("%d", cert.Serial),
+		"principals":   strings.Join(cert.ValidPrincipals, ","),
+		"valid_before": time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339),
+		"user":         username,
+	}
+	if forceCommand != "" {
+		issued.Fields["force_command"] = forceCommand
+	}
+	s.State.audit.Emit(issued)
+
+	return cert, privateKey, username, nil
+}
+
+// Reports a finished forward to the logs, webhooks, history and audit sinks
+func (s *SSHSession) forwardClosed(host, address string, startedAt time.Time, sent, received int64) {
+	duration := time.Since(startedAt)
+	s.log.Info(
+		"Forward closed",
+		zap.String("host", address),
+		zap.Duration("duration", duration),
+		zap.Int64("bytes-sent", sent),
+		zap.Int64("bytes-received", received))
+	s.recordTraffic(address, sent, received)
+
+	event := s.webhookEvent(WebhookForwardClose, host)
+	event.Duration = duration
+	event.BytesSent = sent
+	event.BytesReceived = received
+	s.State.webhooks.Notify(event)
+
+	if s.State.features.Enabled("forward-history") {
+		s.State.history.add(ForwardRecord{
+			Username:      s.Account().Username,
+			SessionID:     s.UUID,
+			Destination:   address,
+			StartedAt:     startedAt.UTC(),
+			EndedAt:       time.Now().UTC(),
+			BytesSent:     sent,
+			BytesReceived: received,
+		})
+	}
+
+	closed := s.auditEvent(AuditForwardClose, address)
+	closed.Fields = map[string]string{
+		"duration":       duration.String(),
+		"bytes_sent":     fmt.Sprintf("%d", sent),
+		"bytes_received": fmt.Sprintf("%d", received),
+	}
+	s.State.audit.Emit(closed)
+}
+
+// Takes a forward slot for a forward to address, reporting it if the limit is reached
+func (s *SSHSession) reserveForward(address string) bool {
+	limit := s.State.forwardLimit(s.Account())
+	if s.active.reserve(limit) {
+		return true
+	}
+
+	s.log.Warn("Rejecting forward over the account forward limit", zap.String("host", address), zap.Int("limit", limit))
+	event := s.auditEvent("", address)
+	event.Reason = "too many open forwards"
+	s.State.limitExceeded(event, limit)
+	return false
+}
+
+// Resolves a destination and checks every address it resolves to, returning a
+// deniedAddressError if any of them is denied.
+func (s *SSHSession) resolveDestination(host string) ([]string, error) {
+	addrs, err := s.dialer.resolve(host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		if err := s.Account().canConnectToAddress(s.State.Config(), addr); err != nil {
+			return nil, deniedAddressError{addr, err}
+		}
+	}
+	return addrs, nil
+}
+
+// Reports a destination the account ACLs did not allow
+func (s *SSHSession) destinationRejected(host, address string, err error) {
+	s.log.Error(
+		"Rejecting forward: "+err.Error(),
+		zap.String("host", host))
+
+	event := s.webhookEvent(WebhookACLReject, host)
+	event.Reason = err.Error()
+	s.State.webhooks.Notify(event)
+
+	rejected := s.auditEvent(AuditForwardReject, address)
+	rejected.Reason = err.Error()
+	if err == deniedPortError {
+		if _, port, splitErr := net.SplitHostPort(address); splitErr == nil {
+			rejected.Fields = map[string]string{"port": port}
+		}
+	}
+
+	// Explicitly denied destinations are worth waking somebody up for
+	cause := err
+	if denied, ok := err.(deniedAddressError); ok {
+		cause = denied.err
+	}
+	if cause == blacklistedError || cause == deniedTagError || cause == deniedNetworkError {
+		rejected.Severity = AuditSeverityCritical
+		s.State.alerts.DeniedDestination(s.Account().Username, s.UUID, host)
+	}
+	s.State.audit.Emit(rejected)
 }
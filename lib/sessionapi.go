@@ -0,0 +1,336 @@
+package bowser
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The JSON representation of a session for the HTTP API
+type JSONSession struct {
+	ID            string        `json:"id"`
+	Username      string        `json:"username"`
+	Source        string        `json:"source"`
+	Country       string        `json:"country"`
+	ClientVersion string        `json:"client_version"`
+	StartedAt     time.Time     `json:"started_at"`
+	Verified      bool          `json:"verified"`
+	MFAMethods    []string      `json:"mfa_methods"`
+	BytesSent     int64         `json:"bytes_sent"`
+	BytesReceived int64         `json:"bytes_received"`
+	Forwards      []JSONForward `json:"forwards"`
+
+	// Traffic per destination, including forwards which already closed
+	Traffic []DestinationTraffic `json:"traffic"`
+
+	// Paths of terminal recordings made in the session, on the bastion
+	Recordings []string `json:"recordings"`
+}
+
+func (s *SSHSession) toJSON() JSONSession {
+	forwards := []JSONForward{}
+	for _, forward := range s.active.list() {
+		forwards = append(forwards, forward.toJSON())
+	}
+
+	mfaMethods := s.MFAMethods
+	if mfaMethods == nil {
+		mfaMethods = []string{}
+	}
+
+	s.lock.Lock()
+	verified := s.verified
+	recordings := append([]string{}, s.recordings...)
+	s.lock.Unlock()
+
+	return JSONSession{
+		ID:            s.UUID,
+		Username:      s.Conn.User(),
+		Source:        s.Conn.RemoteAddr().String(),
+		Country:       s.Country,
+		ClientVersion: string(s.Conn.ClientVersion()),
+		StartedAt:     s.StartedAt,
+		Verified:      verified,
+		MFAMethods:    mfaMethods,
+		Recordings:    recordings,
+		BytesSent:     atomic.LoadInt64(&s.bytesSent),
+		BytesReceived: atomic.LoadInt64(&s.bytesReceived),
+		Forwards:      forwards,
+		Traffic:       s.trafficByDestination(),
+	}
+}
+
+// The keys sessions can be sorted by, each producing a string which sorts the same way
+var sessionSortKeys = map[string]func(session JSONSession) string{
+	"started_at": func(session JSONSession) string {
+		return session.StartedAt.UTC().Format("2006-01-02T15:04:05.000000000Z")
+	},
+	"username": func(session JSONSession) string { return session.Username },
+	"bytes":    func(session JSONSession) string { return fmt.Sprintf("%020d", session.BytesSent+session.BytesReceived) },
+}
+
+// Points after the last session of a page, by its sort key and ID so pages stay
+// stable while sessions come and go
+type sessionCursor struct {
+	Key string `json:"k"`
+	ID  string `json:"i"`
+}
+
+func encodeSessionCursor(cursor sessionCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSessionCursor(value string) (sessionCursor, error) {
+	var cursor sessionCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err == nil {
+		err = json.Unmarshal(data, &cursor)
+	}
+	return cursor, err
+}
+
+// Returns every destination the session visited or has open
+func (s *SSHSession) visited() []string {
+	s.lock.Lock()
+	destinations := append([]string{}, s.destinations...)
+	s.lock.Unlock()
+
+	for _, forward := range s.active.list() {
+		destinations = append(destinations, forward.Destination)
+	}
+	return destinations
+}
+
+// Filters for GET /sessions, empty fields match everything
+type sessionFilter struct {
+	username    string
+	destination string
+	source      *net.IPNet
+	since       time.Time
+	until       time.Time
+}
+
+func parseSessionFilter(query url.Values) (sessionFilter, error) {
+	now := time.Now().UTC()
+	filter := sessionFilter{
+		username:    query.Get("username"),
+		destination: query.Get("destination"),
+	}
+
+	var err error
+	if filter.since, err = parseTimeParam(query.Get("since"), time.Time{}, now); err != nil {
+		return filter, fmt.Errorf("invalid since")
+	}
+	if filter.until, err = parseTimeParam(query.Get("until"), time.Time{}, now); err != nil {
+		return filter, fmt.Errorf("invalid until")
+	}
+
+	// Sources are either a single IP or a CIDR
+	if source := query.Get("source"); source != "" {
+		if !strings.Contains(source, "/") {
+			if strings.Contains(source, ":") {
+				source += "/128"
+			} else {
+				source += "/32"
+			}
+		}
+
+		if _, filter.source, err = net.ParseCIDR(source); err != nil {
+			return filter, fmt.Errorf("invalid source")
+		}
+	}
+	return filter, nil
+}
+
+func (f sessionFilter) matches(session *SSHSession, view JSONSession) bool {
+	if f.username != "" && view.Username != f.username {
+		return false
+	}
+
+	if !f.since.IsZero() && view.StartedAt.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && view.StartedAt.After(f.until) {
+		return false
+	}
+
+	if f.source != nil {
+		host, _, err := net.SplitHostPort(view.Source)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !f.source.Contains(ip) {
+			return false
+		}
+	}
+
+	if f.destination != "" {
+		for _, destination := range session.visited() {
+			if destination == f.destination || strings.HasPrefix(destination, f.destination+":") {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// GET /sessions, lists active sessions with their open forwards. Sessions can be
+// filtered by username, destination (visited or open, with or without a port), source
+// (an IP or CIDR) and started_at with since and until. sort is one of started_at (the
+// default), username or bytes, optionally prefixed with a - to reverse it. With limit
+// set, the cursor for the next page is returned in the X-Next-Cursor header.
+func (api *HTTPAPI) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseSessionFilter(query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sortBy := query.Get("sort")
+	if sortBy == "" {
+		sortBy = "started_at"
+	}
+	descending := strings.HasPrefix(sortBy, "-")
+	key, exists := sessionSortKeys[strings.TrimPrefix(sortBy, "-")]
+	if !exists {
+		writeError(w, http.StatusBadRequest, "invalid sort")
+		return
+	}
+
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+
+	var cursor *sessionCursor
+	if value := query.Get("cursor"); value != "" {
+		decoded, err := decodeSessionCursor(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		cursor = &decoded
+	}
+
+	// Orders sessions by their sort key, breaking ties by ID
+	before := func(a, b sessionCursor) bool {
+		if a.Key != b.Key {
+			return (a.Key < b.Key) != descending
+		}
+		return (a.ID < b.ID) != descending
+	}
+
+	sessions := []JSONSession{}
+	for _, session := range api.state.listSessions() {
+		view := session.toJSON()
+		if !filter.matches(session, view) {
+			continue
+		}
+
+		if cursor != nil && !before(*cursor, sessionCursor{key(view), view.ID}) {
+			continue
+		}
+		sessions = append(sessions, view)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return before(sessionCursor{key(sessions[i]), sessions[i].ID}, sessionCursor{key(sessions[j]), sessions[j].ID})
+	})
+
+	if limit > 0 && len(sessions) > limit {
+		sessions = sessions[:limit]
+		last := sessions[limit-1]
+		w.Header().Set("X-Next-Cursor", encodeSessionCursor(sessionCursor{key(last), last.ID}))
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// GET /sessions/:id returns a session, DELETE /sessions/:id closes it and all of
+// its forwards
+func (api *HTTPAPI) handleSession(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/", 2)
+	session := api.state.getSession(parts[0])
+	if session == nil {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	if len(parts) == 2 {
+		if strings.HasPrefix(parts[1], "forwards/") {
+			api.handleSessionForward(w, r, session, strings.TrimPrefix(parts[1], "forwards/"))
+			return
+		}
+
+		switch parts[1] {
+		case "revoke-certs":
+			api.handleRevokeCerts(w, r, session)
+		case "jump":
+			api.handleJump(w, r, session)
+		default:
+			writeError(w, http.StatusNotFound, "not found")
+		}
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, session.toJSON())
+	case "DELETE":
+		session.log.Info("Closing session on admin request")
+		api.state.audit.Emit(AuditEvent{
+			Type:      AuditAdminAction,
+			Username:  session.Conn.User(),
+			SessionID: session.UUID,
+			Reason:    "session closed",
+		})
+		session.Close()
+		writeJSON(w, http.StatusOK, session.toJSON())
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// GET /sessions/:id/forwards/:forward returns an open forward, DELETE closes just that
+// forward and leaves the rest of the session alone
+func (api *HTTPAPI) handleSessionForward(w http.ResponseWriter, r *http.Request, session *SSHSession, id string) {
+	forward := session.active.get(id)
+	if forward == nil {
+		writeError(w, http.StatusNotFound, "forward not found")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, forward.toJSON())
+	case "DELETE":
+		session.log.Info(
+			"Closing forward on admin request",
+			zap.String("forward", forward.ID),
+			zap.String("destination", forward.Destination))
+		api.state.audit.Emit(AuditEvent{
+			Type:        AuditAdminAction,
+			Username:    session.Conn.User(),
+			SessionID:   session.UUID,
+			Destination: forward.Destination,
+			Reason:      "forward closed",
+			Fields:      map[string]string{"forward_id": forward.ID},
+		})
+		forward.close()
+		writeJSON(w, http.StatusOK, forward.toJSON())
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
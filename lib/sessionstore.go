@@ -0,0 +1,283 @@
+package bowser
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema migrations for the session store, applied in order like sqlMigrations
+var sessionMigrations = []string{
+	`CREATE TABLE sessions (
+		id TEXT PRIMARY KEY,
+		username TEXT NOT NULL,
+		source TEXT NOT NULL,
+		country TEXT NOT NULL,
+		started_at TEXT NOT NULL,
+		ended_at TEXT,
+		end_reason TEXT NOT NULL DEFAULT '',
+		bytes_sent INTEGER NOT NULL DEFAULT 0,
+		bytes_received INTEGER NOT NULL DEFAULT 0,
+		destinations TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX sessions_started_at ON sessions (started_at)`,
+	`CREATE TABLE session_events (
+		session_id TEXT NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+		time TEXT NOT NULL,
+		type TEXT NOT NULL,
+		destination TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		fields TEXT NOT NULL
+	)`,
+	`CREATE INDEX session_events_session_id ON session_events (session_id)`,
+}
+
+// Times are stored as fixed width UTC text, so they compare correctly as strings in
+// every database
+const sessionStoreTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// A StoredSession is a session as recorded in the session store, ended or not
+type StoredSession struct {
+	ID            string     `json:"id"`
+	Username      string     `json:"username"`
+	Source        string     `json:"source"`
+	Country       string     `json:"country"`
+	StartedAt     time.Time  `json:"started_at"`
+	EndedAt       *time.Time `json:"ended_at"`
+	EndReason     string     `json:"end_reason,omitempty"`
+	BytesSent     int64      `json:"bytes_sent"`
+	BytesReceived int64      `json:"bytes_received"`
+	Destinations  []string   `json:"destinations"`
+
+	Events []AuditEvent `json:"events,omitempty"`
+}
+
+// Records session metadata and every audit event belonging to a session in a SQL
+// database, so past sessions can be queried after a restart. It's fed by the auditor
+// like any other audit sink.
+type sessionStore struct {
+	db *sql.DB
+}
+
+func openSessionStore(config *SQLStoreConfig) (*sessionStore, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	if config.Driver != "sqlite3" && config.Driver != "postgres" {
+		return nil, fmt.Errorf("unsupported sql driver %s", config.Driver)
+	}
+
+	db, err := sql.Open(config.Driver, config.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrateSQL(db, "session_schema_migrations", sessionMigrations); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate session database: %v", err)
+	}
+
+	// Sessions still open in the store were cut off by the previous process exiting
+	_, err = db.Exec(
+		`UPDATE sessions SET ended_at = $1, end_reason = 'interrupted' WHERE ended_at IS NULL`,
+		time.Now().UTC().Format(sessionStoreTimeFormat))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sessionStore{db: db}, nil
+}
+
+func (s *sessionStore) Name() string {
+	return "sessions"
+}
+
+func (s *sessionStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sessionStore) Emit(event AuditEvent) error {
+	if event.SessionID == "" {
+		return nil
+	}
+
+	at := event.Time.UTC().Format(sessionStoreTimeFormat)
+	switch event.Type {
+	case AuditSessionStart:
+		_, err := s.db.Exec(
+			`INSERT INTO sessions (id, username, source, country, started_at) VALUES ($1, $2, $3, $4, $5)`,
+			event.SessionID, event.Username, event.Source, event.Country, at)
+		if err != nil {
+			return err
+		}
+	case AuditSessionEnd:
+		sent, _ := strconv.ParseInt(event.Fields["bytes_sent"], 10, 64)
+		received, _ := strconv.ParseInt(event.Fields["bytes_received"], 10, 64)
+		_, err := s.db.Exec(
+			`UPDATE sessions SET ended_at = $1, end_reason = 'closed', bytes_sent = $2, bytes_received = $3, destinations = $4 WHERE id = $5`,
+			at, sent, received, event.Fields["destinations"], event.SessionID)
+		if err != nil {
+			return err
+		}
+	}
+
+	fields, err := json.Marshal(event.Fields)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		`INSERT INTO session_events (session_id, time, type, destination, reason, fields) VALUES ($1, $2, $3, $4, $5, $6)`,
+		event.SessionID, at, event.Type, event.Destination, event.Reason, string(fields))
+	return err
+}
+
+func parseStoredTime(value string) time.Time {
+	parsed, _ := time.Parse(sessionStoreTimeFormat, value)
+	return parsed
+}
+
+const storedSessionColumns = `id, username, source, country, started_at, ended_at, end_reason, bytes_sent, bytes_received, destinations`
+
+// Lists sessions started within [since, until], newest first
+func (s *sessionStore) list(since, until time.Time, username string, limit int) ([]StoredSession, error) {
+	query := `SELECT ` + storedSessionColumns + ` FROM sessions WHERE started_at >= $1 AND started_at <= $2`
+	args := []interface{}{since.UTC().Format(sessionStoreTimeFormat), until.UTC().Format(sessionStoreTimeFormat)}
+	if username != "" {
+		query += ` AND username = $3`
+		args = append(args, username)
+	}
+	query += fmt.Sprintf(` ORDER BY started_at DESC LIMIT %d`, limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanStoredSessions(rows)
+}
+
+func scanStoredSessions(rows *sql.Rows) ([]StoredSession, error) {
+	defer rows.Close()
+
+	sessions := []StoredSession{}
+	for rows.Next() {
+		var session StoredSession
+		var startedAt, destinations string
+		var endedAt sql.NullString
+		err := rows.Scan(&session.ID, &session.Username, &session.Source, &session.Country, &startedAt,
+			&endedAt, &session.EndReason, &session.BytesSent, &session.BytesReceived, &destinations)
+		if err != nil {
+			return nil, err
+		}
+
+		session.StartedAt = parseStoredTime(startedAt)
+		if endedAt.Valid {
+			ended := parseStoredTime(endedAt.String)
+			session.EndedAt = &ended
+		}
+
+		session.Destinations = []string{}
+		if destinations != "" {
+			session.Destinations = strings.Split(destinations, ",")
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// Returns a stored session along with its events, or nil if it isn't known
+func (s *sessionStore) get(id string) (*StoredSession, error) {
+	rows, err := s.db.Query(`SELECT `+storedSessionColumns+` FROM sessions WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := scanStoredSessions(rows)
+	if err != nil || len(sessions) == 0 {
+		return nil, err
+	}
+	session := &sessions[0]
+
+	rows, err = s.db.Query(
+		`SELECT time, type, destination, reason, fields FROM session_events WHERE session_id = $1 ORDER BY time`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var at, fields string
+		event := AuditEvent{SessionID: id, Username: session.Username, Source: session.Source, Country: session.Country}
+		if err := rows.Scan(&at, &event.Type, &event.Destination, &event.Reason, &fields); err != nil {
+			return nil, err
+		}
+
+		event.Time = parseStoredTime(at)
+		json.Unmarshal([]byte(fields), &event.Fields)
+		session.Events = append(session.Events, event)
+	}
+	return session, rows.Err()
+}
+
+// GET /history/sessions lists recorded sessions, newest first, filtered by username
+// and since/until (on the session start, as RFC3339 times or durations ago, the last
+// 24 hours by default). limit defaults to 100. GET /history/sessions/<id> returns one
+// session along with its events.
+func (api *HTTPAPI) handleSessionHistory(w http.ResponseWriter, r *http.Request) {
+	store := api.state.sessionStore
+	if store == nil {
+		writeError(w, http.StatusNotFound, "session store is not enabled")
+		return
+	}
+
+	if id := strings.TrimPrefix(r.URL.Path, "/history/sessions/"); id != r.URL.Path && id != "" {
+		session, err := store.get(id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if session == nil {
+			writeError(w, http.StatusNotFound, "session not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, session)
+		return
+	}
+
+	now := time.Now()
+	query := r.URL.Query()
+	since, err := parseTimeParam(query.Get("since"), now.Add(-24*time.Hour), now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid since")
+		return
+	}
+
+	until, err := parseTimeParam(query.Get("until"), now, now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid until")
+		return
+	}
+
+	limit := 100
+	if raw := query.Get("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+
+	sessions, err := store.list(since, until, query.Get("username"), limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package bowser
+
+import (
+	"os"
+	"syscall"
+)
+
+// The signals used to control a running bastion
+var (
+	reloadSignal     os.Signal = syscall.SIGHUP
+	reopenLogsSignal os.Signal = syscall.SIGUSR1
+	debugSignal      os.Signal = syscall.SIGUSR2
+)
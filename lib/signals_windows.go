@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package bowser
+
+import "os"
+
+// Windows has no equivalent signals, so reloads and log level changes go through the
+// HTTP API instead
+var (
+	reloadSignal     os.Signal
+	reopenLogsSignal os.Signal
+	debugSignal      os.Signal
+)
@@ -0,0 +1,189 @@
+package bowser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Configuration for a Slack provider, which can either post to an incoming webhook
+// URL or use a bot token with chat.postMessage.
+type SlackConfig struct {
+	WebhookURL string `json:"webhook_url"`
+	Token      string `json:"token"`
+
+	// The default channel to post in, and per event type overrides. Incoming
+	//  webhooks are bound to a channel already, so these may be left empty for
+	//  them. Events routed to no channel (with a bot token) are not sent.
+	Channel  string            `json:"channel"`
+	Channels map[string]string `json:"channels"`
+
+	// Templates replace the attachment with a plain (mrkdwn) message, per event type
+	//  or "default". See NotificationVars for the variables available.
+	Templates map[string]string `json:"templates"`
+}
+
+type SlackWebhookProvider struct {
+	Config SlackConfig
+
+	templates notificationTemplates
+}
+
+type slackAttachment struct {
+	Color    string   `json:"color"`
+	Title    string   `json:"title"`
+	Text     string   `json:"text"`
+	MrkdwnIn []string `json:"mrkdwn_in"`
+}
+
+type slackMessage struct {
+	Channel     string            `json:"channel,omitempty"`
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments,omitempty"`
+}
+
+func (s SlackWebhookProvider) PlatformName() string {
+	return "slack"
+}
+
+func (s SlackWebhookProvider) Notify(event WebhookEvent) error {
+	channel := s.Config.Channels[event.Type]
+	if channel == "" {
+		channel = s.Config.Channel
+	}
+
+	if channel == "" && s.Config.WebhookURL == "" {
+		return nil
+	}
+
+	if text, templated, err := s.templates.render(event, s.PlatformName()); templated {
+		if err != nil {
+			return err
+		}
+		return s.send(slackMessage{Channel: channel, Text: text})
+	}
+
+	var title, color string
+	switch event.Type {
+	case WebhookSessionStart:
+		title, color = fmt.Sprintf("%s connected", event.Username), "#3aa3e3"
+	case WebhookSessionEnd:
+		title, color = fmt.Sprintf("%s disconnected", event.Username), "#3aa3e3"
+	case WebhookForwardOpen:
+		title, color = fmt.Sprintf("%s@%s", event.Username, event.Destination), "good"
+	case WebhookForwardClose:
+		title, color = fmt.Sprintf("%s@%s closed", event.Username, event.Destination), "#999999"
+	case WebhookRemoteForwardOpen:
+		title, color = fmt.Sprintf("%s exposed %s", event.Username, event.Destination), "good"
+	case WebhookRemoteForwardClose:
+		title, color = fmt.Sprintf("%s closed %s", event.Username, event.Destination), "#999999"
+	case WebhookACLReject:
+		title, color = fmt.Sprintf("%s was denied access to %s", event.Username, event.Destination), "warning"
+	case WebhookMFAFailure:
+		title, color = fmt.Sprintf("%s failed MFA", event.Username), "danger"
+	case WebhookSourceBanned:
+		title, color = fmt.Sprintf("%s was temporarily banned", event.Source), "danger"
+	default:
+		return nil
+	}
+
+	var text []string
+	if platformID := event.PlatformIDs[s.PlatformName()]; platformID != "" {
+		text = append(text, fmt.Sprintf("*User:* <@%s>", platformID))
+	} else if event.Username != "" {
+		text = append(text, fmt.Sprintf("*User:* %s", event.Username))
+	}
+
+	if event.Destination != "" {
+		text = append(text, fmt.Sprintf("*Host:* %s", event.Destination))
+	}
+
+	if event.Country != "" {
+		text = append(text, fmt.Sprintf("*Source:* %s (%s)", event.Source, event.Country))
+	} else {
+		text = append(text, fmt.Sprintf("*Source:* %s", event.Source))
+	}
+
+	if event.SessionID != "" {
+		text = append(text, fmt.Sprintf("*Session:* %s", event.SessionID))
+	}
+
+	if event.Reason != "" {
+		text = append(text, fmt.Sprintf("*Reason:* %s", event.Reason))
+	}
+
+	if event.Type == WebhookSessionEnd || event.Type == WebhookForwardClose || event.Type == WebhookRemoteForwardClose {
+		text = append(text, fmt.Sprintf("*Duration:* %s", event.Duration))
+		text = append(text, fmt.Sprintf("*Transferred:* %d bytes sent, %d bytes received", event.BytesSent, event.BytesReceived))
+	}
+
+	if len(event.Traffic) > 0 {
+		text = append(text, fmt.Sprintf("*Traffic:*\n%s", formatTraffic(event.Traffic)))
+	} else if len(event.Destinations) > 0 {
+		text = append(text, fmt.Sprintf("*Destinations:* %s", strings.Join(event.Destinations, ", ")))
+	}
+
+	return s.send(slackMessage{
+		Channel: channel,
+		Attachments: []slackAttachment{slackAttachment{
+			Color:    color,
+			Title:    title,
+			Text:     strings.Join(text, "\n"),
+			MrkdwnIn: []string{"text"},
+		}},
+	})
+}
+
+func (s SlackWebhookProvider) send(message slackMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	url := s.Config.WebhookURL
+	if s.Config.Token != "" {
+		url = "https://slack.com/api/chat.postMessage"
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if s.Config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Config.Token)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack returned status %d", resp.StatusCode)
+	}
+
+	// The Web API always returns 200, and reports failures in the body
+	if s.Config.Token != "" {
+		var result struct {
+			OK    bool   `json:"ok"`
+			Error string `json:"error"`
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return err
+		}
+
+		if !result.OK {
+			return fmt.Errorf("slack returned error: %s", result.Error)
+		}
+	}
+
+	return nil
+}
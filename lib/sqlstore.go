@@ -0,0 +1,293 @@
+package bowser
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Configuration for keeping accounts in a SQL database, so several bastions can
+// share them. The driver is either sqlite3 or postgres.
+type SQLStoreConfig struct {
+	Driver string `json:"driver"`
+	DSN    string `json:"dsn"`
+}
+
+// Schema migrations, applied in order. Never edit one which has been released, add
+// a new one instead.
+var sqlMigrations = []string{
+	`CREATE TABLE account_groups (
+		name TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	)`,
+	`CREATE TABLE accounts (
+		username TEXT PRIMARY KEY,
+		position INTEGER NOT NULL,
+		data TEXT NOT NULL
+	)`,
+	`CREATE TABLE account_keys (
+		username TEXT NOT NULL REFERENCES accounts (username) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		public_key TEXT NOT NULL,
+		PRIMARY KEY (username, position)
+	)`,
+	`CREATE TABLE account_mfa (
+		username TEXT PRIMARY KEY REFERENCES accounts (username) ON DELETE CASCADE,
+		totp TEXT NOT NULL,
+		backup_codes TEXT NOT NULL,
+		yubikeys TEXT NOT NULL,
+		policy TEXT NOT NULL
+	)`,
+}
+
+type sqlAccountStore struct {
+	db *sql.DB
+}
+
+func openSQLAccountStore(config SQLStoreConfig) (*sqlAccountStore, error) {
+	if config.Driver != "sqlite3" && config.Driver != "postgres" {
+		return nil, fmt.Errorf("unsupported sql driver %s", config.Driver)
+	}
+
+	db, err := sql.Open(config.Driver, config.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &sqlAccountStore{db: db}
+	err = store.migrate()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate accounts database: %v", err)
+	}
+
+	return store, nil
+}
+
+func (s *sqlAccountStore) migrate() error {
+	return migrateSQL(s.db, "schema_migrations", sqlMigrations)
+}
+
+// Applies the migrations not yet recorded in the given version table
+func migrateSQL(db *sql.DB, table string, migrations []string) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + table + ` (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM ` + table).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(migrations[i]); err == nil {
+			_, err = tx.Exec(`INSERT INTO `+table+` (version) VALUES ($1)`, i+1)
+		}
+
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *sqlAccountStore) load() (*accountsFile, error) {
+	var file accountsFile
+
+	rows, err := s.db.Query(`SELECT data FROM account_groups ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data string
+		var group Group
+		if err = rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(data), &group); err != nil {
+			return nil, err
+		}
+		file.Groups = append(file.Groups, group)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	accounts, err := s.db.Query(`
+		SELECT a.username, a.data, COALESCE(m.totp, ''), COALESCE(m.backup_codes, '[]'),
+			COALESCE(m.yubikeys, '[]'), COALESCE(m.policy, '')
+		FROM accounts a LEFT JOIN account_mfa m ON m.username = a.username
+		ORDER BY a.position`)
+	if err != nil {
+		return nil, err
+	}
+	defer accounts.Close()
+
+	index := make(map[string]int)
+	for accounts.Next() {
+		var username, data, backupCodes, yubikeys string
+		var account Account
+		var mfa AccountMFA
+		err = accounts.Scan(&username, &data, &mfa.TOTP, &backupCodes, &yubikeys, &mfa.Policy)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = json.Unmarshal([]byte(data), &account); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(backupCodes), &mfa.BackupCodes); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(yubikeys), &mfa.YubiKeys); err != nil {
+			return nil, err
+		}
+
+		account.Username = username
+		account.MFA = mfa
+		account.SSHKeysRaw = nil
+		index[username] = len(file.Accounts)
+		file.Accounts = append(file.Accounts, account)
+	}
+	if err = accounts.Err(); err != nil {
+		return nil, err
+	}
+
+	keys, err := s.db.Query(`SELECT username, public_key FROM account_keys ORDER BY username, position`)
+	if err != nil {
+		return nil, err
+	}
+	defer keys.Close()
+
+	for keys.Next() {
+		var username, key string
+		if err = keys.Scan(&username, &key); err != nil {
+			return nil, err
+		}
+
+		if i, exists := index[username]; exists {
+			file.Accounts[i].SSHKeysRaw = append(file.Accounts[i].SSHKeysRaw, key)
+		}
+	}
+
+	return &file, keys.Err()
+}
+
+func (s *sqlAccountStore) save(accounts []Account) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = s.replaceAccounts(tx, accounts)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlAccountStore) replaceAccounts(tx *sql.Tx, accounts []Account) error {
+	for _, table := range []string{"account_keys", "account_mfa", "accounts"} {
+		if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+			return err
+		}
+	}
+
+	for position, account := range accounts {
+		// Keys and MFA secrets live in their own tables
+		keys, mfa := account.SSHKeysRaw, account.MFA
+		account.SSHKeysRaw = nil
+		account.MFA = AccountMFA{}
+
+		data, err := json.Marshal(account)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO accounts (username, position, data) VALUES ($1, $2, $3)`, account.Username, position, string(data))
+		if err != nil {
+			return err
+		}
+
+		for i, key := range keys {
+			_, err = tx.Exec(`INSERT INTO account_keys (username, position, public_key) VALUES ($1, $2, $3)`, account.Username, i, key)
+			if err != nil {
+				return err
+			}
+		}
+
+		backupCodes, _ := json.Marshal(mfa.BackupCodes)
+		yubikeys, _ := json.Marshal(mfa.YubiKeys)
+		_, err = tx.Exec(
+			`INSERT INTO account_mfa (username, totp, backup_codes, yubikeys, policy) VALUES ($1, $2, $3, $4, $5)`,
+			account.Username, mfa.TOTP, string(backupCodes), string(yubikeys), mfa.Policy)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *sqlAccountStore) saveGroups(groups []Group) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = s.replaceGroups(tx, groups)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlAccountStore) replaceGroups(tx *sql.Tx, groups []Group) error {
+	if _, err := tx.Exec(`DELETE FROM account_groups`); err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		data, err := json.Marshal(group)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO account_groups (name, data) VALUES ($1, $2)`, group.Name, string(data))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *sqlAccountStore) snapshot() ([]byte, error) {
+	file, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(file, "", "  ")
+}
@@ -7,11 +7,17 @@ import (
 	"net"
 	"os"
 	"os/signal"
-	"regexp"
+	"strings"
+	"sync"
 	"syscall"
+	"text/template"
+	"time"
 
+	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
+	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/ssh"
 )
@@ -21,17 +27,93 @@ const (
 )
 
 type SSHDState struct {
-	Config *Config
-
+	// Replaced by config and account reloads while everything else reads them, so
+	//  only accessed with liveLock held (see Config and accountSet)
+	liveLock         sync.RWMutex
+	config           *Config
 	WebhookProviders []WebhookProvider
-	ca               *CertificateAuthority
-	log              *zap.Logger
 	accounts         map[string]*Account
 	keys             map[string]*AccountKey
-	sessions         map[string]*SSHSession
+	aclCache         *aclCache
+	userCAs          *userCertAuthorities
+
+	// Serializes config and account reloads
+	reloadLock sync.Mutex
+
+	webhooks     *WebhookQueue
+	alerts       *Alerter
+	audit        *Auditor
+	limiter      *rateLimiter
+	stats        *rollingStats
+	capacity     *capacity
+	history      *forwardHistory
+	geoip        *geoIP
+	features     *FeatureFlags
+	lockouts     *accountLockouts
+	yubico       *yubicoClient
+	backup       *accountsBackup
+	logs         *logRing
+	logLevels    *logLevels
+	logFile      *rotatingFile
+	errors       *errorReporter
+	ca           *CertificateAuthority
+	log          *zap.Logger
+	sessions     map[string]*SSHSession
+	sessionsLock sync.Mutex
+	enrollments  *enrollmentStore
 
-	// Caches a session ID, to the validity state
+	// Serializes changes to the accounts file
+	accountsLock sync.Mutex
+
+	// Caches a session ID, to the validity state. Written by concurrent handshakes,
+	//  and each entry is only needed until keyboard interactive auth is over.
 	sessionValidityCache map[string]*Account
+	validityLock         sync.Mutex
+
+	// Tracks the state /readyz reports on
+	healthLock       sync.Mutex
+	listenerErrors   map[string]error
+	accountsLoadedAt time.Time
+
+	motd        motd
+	revocations *revocationList
+	configPath  string
+	certLog     *certificateLog
+
+	// Keeps session history across restarts, nil unless session_store is set
+	sessionStore *sessionStore
+
+	// Audit events for clients of /events/stream
+	events *eventStream
+
+	// Traffic of closed forwards since startup, reported in /metrics
+	destinationTraffic trafficTotals
+	accountTraffic     trafficTotals
+}
+
+// Builds the webhook providers configured. Their templates were checked when the
+// config was loaded.
+func webhookProviders(config *Config) []WebhookProvider {
+	providers := make([]WebhookProvider, 0)
+	// Plain webhook URLs keep their original behaviour of only announcing forwards
+	for _, url := range config.DiscordWebhooks {
+		providers = append(providers, DiscordWebhookProvider{URL: url, Events: []string{WebhookForwardOpen}})
+	}
+
+	for _, discordConfig := range config.Discord {
+		providers = append(providers, NewDiscordWebhookProvider(discordConfig))
+	}
+
+	for _, slackConfig := range config.SlackWebhooks {
+		templates, _ := compileNotificationTemplates(slackConfig.Templates)
+		providers = append(providers, SlackWebhookProvider{Config: slackConfig, templates: templates})
+	}
+
+	for _, teamsConfig := range config.Teams {
+		templates, _ := compileNotificationTemplates(teamsConfig.Templates)
+		providers = append(providers, TeamsWebhookProvider{Config: teamsConfig, templates: templates})
+	}
+	return providers
 }
 
 func NewSSHDState(configPath string) *SSHDState {
@@ -42,69 +124,172 @@ func NewSSHDState(configPath string) *SSHDState {
 	}
 
 	// Load our SSH CA
-	ca, err := NewCertificateAuthority(config.CAKeyPath)
+	ca, err := config.loadCertificateAuthority()
 	if err != nil {
 		log.Panicf("Failed to load CA key file: %v", err)
 	}
 
-	// Load all the webhook providers
-	providers := make([]WebhookProvider, 0)
-	for _, url := range config.DiscordWebhooks {
-		providers = append(providers, DiscordWebhookProvider{URL: url})
+	providers := webhookProviders(config)
+
+	logLevels, err := newLogLevels(config.LogLevel, config.LogModules)
+	if err != nil {
+		log.Panicf("Failed to parse log levels: %v", err)
 	}
 
-	zaplog, err := zap.NewProduction()
+	reporter, err := newErrorReporter(config.ErrorReporting)
+	if err != nil {
+		log.Panicf("Failed to configure error reporting: %v", err)
+	}
+
+	var reportCores []zapcore.Core
+	if reporter != nil {
+		reportCores = append(reportCores, errorReportCore{reporter: reporter})
+	}
+
+	// Besides the regular outputs, keep recent log lines around for support bundles
+	logs := newLogRing(1000)
+	zaplog, logFile, err := newLogger(config, logLevels, logs, reportCores...)
 	if err != nil {
 		log.Panicf("Failed to create logger: %v", err)
 	}
 
+	sessionStore, err := openSessionStore(config.SessionStore)
+	if err != nil {
+		log.Panicf("Failed to open session store: %v", err)
+	}
+
+	events := newEventStream()
+	sinks := []AuditSink{events}
+	if sessionStore != nil {
+		sinks = append(sinks, sessionStore)
+	}
+
+	alerter := NewAlerter(config.Alerts, zaplog)
+	auditor, err := NewAuditor(config.Audit, alerter, zaplog, sinks...)
+	if err != nil {
+		log.Panicf("Failed to create audit sinks: %v", err)
+	}
+
+	geoip, err := newGeoIP(config.GeoIP)
+	if err != nil {
+		log.Panicf("Failed to open GeoIP database: %v", err)
+	}
+
+	yubico, err := newYubicoClient(config.Yubico)
+	if err != nil {
+		log.Panicf("Failed to create yubico client: %v", err)
+	}
+
+	backup, err := newAccountsBackup(config.Backup, zaplog)
+	if err != nil {
+		log.Panicf("Failed to configure accounts backup: %v", err)
+	}
+
+	features, err := NewFeatureFlags(config.FeatureFlags)
+	if err != nil {
+		log.Panicf("Failed to load feature flags: %v", err)
+	}
+
 	state := SSHDState{
-		Config:               config,
+		config:               config,
 		WebhookProviders:     providers,
+		webhooks:             NewWebhookQueue(providers, config.WebhookQueueSize, zaplog.With(zap.String("module", "webhook"))),
+		alerts:               alerter,
+		audit:                auditor,
+		limiter:              newRateLimiter(config.RateLimit),
+		stats:                newRollingStats(),
+		capacity:             newCapacity(config.Capacity),
+		history:              newForwardHistory(config.ForwardHistorySize),
+		geoip:                geoip,
+		features:             features,
+		lockouts:             newAccountLockouts(config.MFALockout),
+		yubico:               yubico,
+		backup:               backup,
+		logs:                 logs,
 		ca:                   ca,
 		log:                  zaplog,
+		logLevels:            logLevels,
+		logFile:              logFile,
+		errors:               reporter,
 		sessionValidityCache: make(map[string]*Account),
 		sessions:             make(map[string]*SSHSession),
+		listenerErrors:       make(map[string]error),
+		enrollments:          newEnrollmentStore(),
+		sessionStore:         sessionStore,
+		events:               events,
+	}
+
+	state.configPath = configPath
+	state.revocations = newRevocationList(config, ca.signer.PublicKey(), zaplog)
+
+	if err := state.reloadMOTD(); err != nil {
+		log.Panicf("Failed to load motd: %v", err)
+	}
+
+	if err := state.reloadUserCAs(); err != nil {
+		log.Panicf("Failed to load trusted user cas: %v", err)
+	}
+
+	state.certLog, err = openCertificateLog(config.CertLogPath)
+	if err != nil {
+		log.Panicf("Failed to open certificate log: %v", err)
 	}
 
 	state.reloadAccounts()
 	return &state
 }
 
-func (s *SSHDState) reloadAccounts() {
-	rawAccounts, err := s.Config.LoadAccounts()
+// Returns the current config. Reloads replace it rather than change it, so callers
+// see a consistent config for as long as they hold on to it.
+func (s *SSHDState) Config() *Config {
+	s.liveLock.RLock()
+	defer s.liveLock.RUnlock()
+	return s.config
+}
+
+// Returns the active accounts by username and keys by ID. Reloads replace both
+// rather than change them, so they must not be modified.
+func (s *SSHDState) accountSet() (map[string]*Account, map[string]*AccountKey) {
+	s.liveLock.RLock()
+	defer s.liveLock.RUnlock()
+	return s.accounts, s.keys
+}
+
+// Loads and compiles every active account and key, without applying them
+func (s *SSHDState) loadAccountSet() (map[string]*Account, map[string]*AccountKey, error) {
+	rawAccounts, err := s.Config().LoadResolvedAccounts()
 	if err != nil {
-		s.log.Error("Failed to load accounts", zap.Error(err))
-		return
+		return nil, nil, err
 	}
+	return s.compileAccountSet(rawAccounts)
+}
 
+// Compiles resolved accounts into the active accounts and keys, failing on anything
+// that would stop them from loading
+func (s *SSHDState) compileAccountSet(rawAccounts []Account) (map[string]*Account, map[string]*AccountKey, error) {
+	var err error
 	accounts := make(map[string]*Account)
 	keys := make(map[string]*AccountKey)
+	archived := make(map[string]bool)
 
 	for aid := range rawAccounts {
 		account := rawAccounts[aid]
 
-		if _, exists := accounts[account.Username]; exists {
-			s.log.Error("Duplicate username", zap.String("username", account.Username))
-			return
+		if _, exists := accounts[account.Username]; exists || archived[account.Username] {
+			return nil, nil, fmt.Errorf("duplicate username %s", account.Username)
 		}
 
-		accounts[account.Username] = &account
-
-		if account.Whitelist != "" {
-			account.whitelistRe, err = regexp.Compile(account.Whitelist)
-			if err != nil {
-				s.log.Error("Failed to parse whitelist regex", zap.String("regex", account.Whitelist))
-				return
-			}
+		// Archived accounts stay in the file, but can't login
+		if account.ArchivedAt != nil {
+			archived[account.Username] = true
+			continue
 		}
 
-		if account.Blacklist != "" {
-			account.blacklistRe, err = regexp.Compile(account.Blacklist)
-			if err != nil {
-				s.log.Error("Failed to parse blacklist regex", zap.String("regex", account.Blacklist))
-				return
-			}
+		accounts[account.Username] = &account
+
+		err = account.compile()
+		if err != nil {
+			return nil, nil, fmt.Errorf("account %s: %v", account.Username, err)
 		}
 
 		for _, key := range account.SSHKeysRaw {
@@ -119,64 +304,391 @@ func (s *SSHDState) reloadAccounts() {
 
 			other, exists := keys[key.ID()]
 			if exists {
-				s.log.Error("Duplicate key", zap.String("account a", other.Account.Username), zap.String("account b", other.Account.Username))
-				return
+				return nil, nil, fmt.Errorf("duplicate key for accounts %s and %s", other.Account.Username, account.Username)
 			}
 
 			keys[key.ID()] = key
 		}
+	}
+
+	return accounts, keys, nil
+}
 
+func (s *SSHDState) reloadAccounts() error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	accounts, keys, err := s.loadAccountSet()
+	if err != nil {
+		s.log.Error("Failed to load accounts", zap.Error(err))
+		return err
+	}
+
+	// Picks up changes to the revocation list along with the accounts
+	if err := s.reloadUserCAs(); err != nil {
+		return err
 	}
 
+	s.liveLock.Lock()
 	s.accounts = accounts
 	s.keys = keys
+	s.aclCache = newACLCache(s.config.ACLCacheSize)
+	s.liveLock.Unlock()
+
+	s.healthLock.Lock()
+	s.accountsLoadedAt = time.Now()
+	s.healthLock.Unlock()
+
+	// Every successfully loaded version of the accounts is backed up
+	if data, err := s.Config().accountStore().snapshot(); err == nil {
+		s.backup.snapshot(data)
+	}
 
 	// Now, iterate over all active sessions and update them, closing any sessions
 	//  that point to now-invalid accounts.
+	for _, session := range s.listSessions() {
+		account := accounts[session.Account().Username]
+
+		// Sessions being closed keep their old account, so anything still running in
+		//  them never sees a nil account
+		if account == nil {
+			session.log.Warn("Closing session for user that was deleted or archived")
+			session.Close()
+			continue
+		}
+		session.setAccount(account)
+	}
+
+	return nil
+}
+
+func (s *SSHDState) addSession(session *SSHSession) {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+	s.sessions[session.UUID] = session
+}
+
+func (s *SSHDState) removeSession(id string) {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+	delete(s.sessions, id)
+}
+
+func (s *SSHDState) getSession(id string) *SSHSession {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+	return s.sessions[id]
+}
+
+// Returns a snapshot of the active sessions
+func (s *SSHDState) listSessions() []*SSHSession {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+
+	sessions := make([]*SSHSession, 0, len(s.sessions))
 	for _, session := range s.sessions {
-		session.Account = accounts[session.Account.Username]
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
 
-		if session.Account == nil {
-			s.log.Warn(
-				"Closing session for user that was deleted from accounts",
-				zap.String("username", session.Account.Username),
-				zap.String("session", session.UUID))
+// Checks whether an account may forward to the given host, memoizing the decision
+// until the next account reload.
+func (s *SSHDState) canConnectTo(account *Account, host string) error {
+	if !s.features.Enabled("acl-cache") {
+		return account.canConnectTo(s.Config(), host)
+	}
 
-			session.Close()
+	s.liveLock.RLock()
+	config, cache := s.config, s.aclCache
+	s.liveLock.RUnlock()
+
+	key := account.Username + "\x00" + host
+	if entry := cache.get(key); entry != nil {
+		return entry.err
+	}
+
+	err := account.canConnectTo(config, host)
+	cache.put(key, err)
+	return err
+}
+
+// Appends a new account to the accounts file and reloads, making it active immediately
+func (s *SSHDState) addAccount(account Account) error {
+	s.accountsLock.Lock()
+	defer s.accountsLock.Unlock()
+
+	file, err := s.Config().loadAccountsFile()
+	if err != nil {
+		return err
+	}
+
+	for _, existing := range file.Accounts {
+		if existing.Username == account.Username {
+			return fmt.Errorf("account %s already exists", account.Username)
+		}
+	}
+
+	accounts := append(append([]Account{}, file.Accounts...), account)
+
+	// Never write a file which would fail to load (and block every reload after it)
+	candidate := accountsFile{Groups: file.Groups, Accounts: append([]Account{}, accounts...)}
+	resolved, err := candidate.resolve()
+	if err == nil {
+		_, _, err = s.compileAccountSet(resolved)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = s.Config().SaveAccounts(accounts)
+	if err != nil {
+		return err
+	}
+
+	s.reloadAccounts()
+	return nil
+}
+
+// Records a failed password or MFA attempt against the account, locking it once it
+// crosses the threshold. Returns whether the account is now locked.
+func (s *SSHDState) accountFailure(account *Account, logger *zap.Logger) bool {
+	if !s.lockouts.failure(account.Username) {
+		return false
+	}
+
+	until := s.lockouts.lockedUntil(account.Username)
+	logger.Warn("Locking account after too many failed attempts", zap.Time("locked-until", until))
+	s.audit.Emit(AuditEvent{
+		Type:     AuditAccountLocked,
+		Username: account.Username,
+		Reason:   "too many failed authentication attempts",
+		Fields:   map[string]string{"locked_until": until.UTC().Format(time.RFC3339)},
+	})
+	return true
+}
+
+// Returns just the IP portion of a remote address
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Returns a logger carrying the correlation fields for a (possibly not yet
+// authenticated) connection
+func (s *SSHDState) connLog(conn ssh.ConnMetadata) *zap.Logger {
+	return s.log.With(
+		zap.String("username", conn.User()),
+		zap.String("remote-addr", conn.RemoteAddr().String()))
+}
+
+// Records a failed authentication attempt, banning the source if it has failed too
+// many times recently.
+func (s *SSHDState) authFailure(conn ssh.ConnMetadata, reason string) {
+	s.audit.Emit(AuditEvent{
+		Type:     AuditAuthFailure,
+		Username: conn.User(),
+		Source:   conn.RemoteAddr().String(),
+		Country:  s.geoip.country(conn.RemoteAddr()),
+		Reason:   reason,
+	})
+
+	if s.features.Enabled("rate-limiting") && s.limiter.authFailure(remoteIP(conn.RemoteAddr())) {
+		s.sourceBanned(remoteIP(conn.RemoteAddr()), "too many authentication failures")
+	}
+}
+
+func (s *SSHDState) sourceBanned(source, reason string) {
+	s.log.Warn(
+		"Temporarily banning source",
+		zap.String("source", source),
+		zap.String("reason", reason),
+		zap.Int("duration", s.Config().RateLimit.BanDuration))
+
+	s.webhooks.Notify(WebhookEvent{
+		Type:   WebhookSourceBanned,
+		Source: source,
+		Reason: reason,
+	})
+
+	s.audit.Emit(AuditEvent{
+		Type:   AuditSourceBanned,
+		Source: source,
+		Reason: reason,
+	})
+}
+
+func (s *SSHDState) validateTOTP(code, secret string) bool {
+	valid, _ := totp.ValidateCustom(code, secret, time.Now().UTC(), totp.ValidateOpts{
+		Period:    s.Config().TOTP.Period,
+		Skew:      s.Config().TOTP.Skew,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	})
+	return valid
+}
+
+// Checks a backup code for the account, and if it matches removes it from the
+// accounts file so it can't be used again. Fails closed if the removal can't be
+// persisted.
+func (s *SSHDState) consumeBackupCode(account *Account, code string) bool {
+	hash := account.MFA.matchBackupCode(code)
+	if hash == "" {
+		return false
+	}
+
+	s.accountsLock.Lock()
+	defer s.accountsLock.Unlock()
+
+	accounts, err := s.Config().LoadAccounts()
+	if err != nil {
+		s.log.Error("Failed to load accounts to consume backup code", zap.Error(err))
+		return false
+	}
+
+	found := false
+	var remaining []string
+	for i := range accounts {
+		if accounts[i].Username != account.Username {
+			continue
 		}
+
+		for _, other := range accounts[i].MFA.BackupCodes {
+			if other == hash {
+				found = true
+				continue
+			}
+			remaining = append(remaining, other)
+		}
+		accounts[i].MFA.BackupCodes = remaining
+	}
+
+	// Somebody else (e.g. a concurrent login) already used it
+	if !found {
+		return false
 	}
+
+	err = s.Config().SaveAccounts(accounts)
+	if err != nil {
+		s.log.Error("Failed to save accounts to consume backup code", zap.Error(err))
+		return false
+	}
+
+	s.log.Warn(
+		"Consumed MFA backup code",
+		zap.String("username", account.Username),
+		zap.Int("remaining", len(remaining)))
+
+	s.reloadAccounts()
+	return true
 }
 
 var badKeyError = fmt.Errorf("Invalid SSH key")
 var badPasswordError = fmt.Errorf("Invalid password")
 var badMFAError = fmt.Errorf("Invalid MFA code")
 
-func (s *SSHDState) Run() {
+// Builds the SSH server configuration for a listener
+func (s *SSHDState) serverConfig(listener ListenerConfig) *ssh.ServerConfig {
+	var banner *template.Template
+	if listener.Banner != "" {
+		var err error
+		banner, err = template.New("banner").Parse(listener.Banner)
+		if err != nil {
+			log.Fatalf("Failed to parse banner for %s (%v)", listener.Bind, err)
+		}
+	}
+
 	sshConfig := &ssh.ServerConfig{
 		NoClientAuth: false,
 
 		ServerVersion: fmt.Sprintf("SSH-2.0-bowser-%s", VERSION),
 
+		BannerCallback: func(conn ssh.ConnMetadata) string {
+			if banner == nil {
+				return ""
+			}
+
+			return s.renderTemplate(banner, MOTDVars{
+				Username: conn.User(),
+				Source:   conn.RemoteAddr().String(),
+				Time:     time.Now().UTC(),
+			})
+		},
+
 		// Function to handle public key verification
 		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			accountKey, exists := s.keys[string(key.Marshal())]
+			logger := s.connLog(conn).With(zap.String("module", "auth"))
+			now := time.Now().UTC()
 
-			// If the key doesn't exist, just break
-			if !exists {
+			var account *Account
+			if cert, ok := key.(*ssh.Certificate); ok && s.trustedUserCAs() != nil {
+				// Certificates from a trusted CA stand in for the account's keys
+				account = s.certificateAccount(conn, cert, logger)
+				if account == nil {
+					s.alerts.BadKey(remoteIP(conn.RemoteAddr()))
+					s.authFailure(conn, "invalid user certificate")
+					return nil, badKeyError
+				}
+			} else {
+				_, keys := s.accountSet()
+				accountKey, exists := keys[string(key.Marshal())]
+
+				// If the key doesn't exist, just break
+				if !exists {
+					s.alerts.BadKey(remoteIP(conn.RemoteAddr()))
+					s.authFailure(conn, "unknown ssh key")
+					return nil, badKeyError
+				}
+
+				// If the username doesn't match, break
+				if conn.User() != accountKey.Account.Username {
+					logger.Warn(
+						"Username did not match SSH key",
+						zap.String("key-username", accountKey.Account.Username))
+					s.authFailure(conn, "username did not match ssh key")
+					return nil, badKeyError
+				}
+
+				if accountKey.expired(now) {
+					logger.Warn(
+						"Rejecting expired SSH key",
+						zap.Time("expired-at", accountKey.ExpiresAt),
+						zap.String("key-comment", accountKey.Comment))
+					s.authFailure(conn, "ssh key expired")
+					return nil, badKeyError
+				}
+				account = accountKey.Account
+			}
+
+			if !listener.allows(account) {
+				logger.Warn("Rejecting account not allowed on this listener", zap.String("listener", listener.Bind))
+				s.authFailure(conn, "account is not allowed on this listener")
 				return nil, badKeyError
 			}
 
-			// If the username doesn't match, break
-			if conn.User() != accountKey.Account.Username {
-				s.log.Warn(
-					"Username did not match SSH key",
-					zap.String("conn-username", conn.User()),
-					zap.String("key-username", accountKey.Account.Username))
+			if account.expired(now) {
+				logger.Warn("Rejecting expired account", zap.Time("expired-at", *account.ExpiresAt))
+				s.authFailure(conn, "account expired")
+				return nil, badKeyError
+			}
+
+			// Check the source country against the global and account restrictions
+			country := s.geoip.country(conn.RemoteAddr())
+			geoipConfig := s.Config().GeoIP
+			if s.features.Enabled("geoip-restrictions") && (!countryAllowed(country, geoipConfig.AllowCountries, geoipConfig.DenyCountries) ||
+				!countryAllowed(country, account.AllowCountries, account.DenyCountries)) {
+				logger.Warn("Rejecting connection from restricted country", zap.String("country", country))
+				s.authFailure(conn, "source country "+country+" is not allowed")
 				return nil, badKeyError
 			}
 
 			// Mark that this sessions SSH key was validated in the cache
-			s.sessionValidityCache[string(conn.SessionID())] = accountKey.Account
+			s.validityLock.Lock()
+			s.sessionValidityCache[string(conn.SessionID())] = account
+			s.validityLock.Unlock()
 
 			// Finally, even though we've validated a public key for this session, we
 			//  return an error as if we had not. This forces the client to authenticate
@@ -188,10 +700,16 @@ func (s *SSHDState) Run() {
 		},
 
 		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
-			// Make sure their SSH key was previously validated
+			logger := s.connLog(conn).With(zap.String("module", "auth"))
+
+			// Make sure their SSH key was previously validated, the key has to be
+			//  validated again before another keyboard interactive attempt
+			s.validityLock.Lock()
 			account, exists := s.sessionValidityCache[string(conn.SessionID())]
+			delete(s.sessionValidityCache, string(conn.SessionID()))
+			s.validityLock.Unlock()
 			if !exists {
-				s.log.Warn(
+				logger.Warn(
 					"Could not find session in validity cache",
 					zap.String("session-id", string(conn.SessionID())))
 				return nil, badKeyError
@@ -200,65 +718,93 @@ func (s *SSHDState) Run() {
 			// Request and validate the clients password
 			passwordAnswer, err := client(conn.User(), "", []string{"Password: "}, []bool{false})
 			if err != nil {
-				s.log.Warn(
+				logger.Warn(
 					"SSH Client did not accept our keyboard interactive request",
-					zap.String("username", conn.User()),
 					zap.Error(err))
 				return nil, badPasswordError
 			}
 
+			if until := s.lockouts.lockedUntil(account.Username); !until.IsZero() {
+				logger.Warn("Rejecting login for locked account", zap.Time("locked-until", until))
+				s.authFailure(conn, "account is locked")
+				return nil, badPasswordError
+			}
+
 			// Check if the password matches
 			err = bcrypt.CompareHashAndPassword([]byte(account.Password), []byte(passwordAnswer[0]))
 			if err != nil {
-				s.log.Warn(
-					"Incorrect password",
-					zap.String("username", conn.User()))
+				logger.Warn("Incorrect password")
+				s.accountFailure(account, logger)
+				s.authFailure(conn, "incorrect password")
 				return nil, badPasswordError
 			}
 
 			// If the user has MFA enabled, request and validate their MFA code/token
-			if account.MFA.TOTP != "" {
-				var verified bool
-
-				decryptedTOTP, err := account.MFA.decryptTOTP([]byte(passwordAnswer[0]), []byte(account.Username))
-				if err != nil {
-					s.log.Warn(
-						"Failed to decrypt TOTP token",
-						zap.String("username", conn.User()),
-						zap.Error(err))
-					return nil, badPasswordError
+			var mfaMethods []string
+			if account.mfaEnabled() {
+				var ok bool
+				if mfaMethods, ok = s.validateMFA(conn, client, account, passwordAnswer[0], logger); !ok {
+					logger.Warn("Incorrect MFA code")
+					s.webhooks.Notify(WebhookEvent{
+						Type:        WebhookMFAFailure,
+						Username:    conn.User(),
+						PlatformIDs: account.PlatformIDs,
+						Source:      conn.RemoteAddr().String(),
+						Country:     s.geoip.country(conn.RemoteAddr()),
+						Reason:      "incorrect mfa code",
+					})
+					s.alerts.MFAFailure(conn.User(), conn.RemoteAddr().String())
+					s.authFailure(conn, "incorrect mfa code")
+					return nil, badMFAError
 				}
+			}
 
-				for i := 0; i < 3; i++ {
-					mfaAnswer, err := client(conn.User(), "", []string{"MFA Code: "}, []bool{true})
-
-					if err != nil {
-						continue
-					}
+			// Contain runaway automation before it gets another session
+			if limit := s.sessionLimit(account); limit > 0 && s.accountSessions(account.Username) >= limit {
+				logger.Warn("Rejecting session over the account session limit", zap.Int("limit", limit))
+				client(conn.User(), fmt.Sprintf("Too many concurrent sessions (the limit is %d)", limit), nil, nil)
+				s.limitExceeded(AuditEvent{
+					Username: conn.User(),
+					Source:   conn.RemoteAddr().String(),
+					Reason:   "too many concurrent sessions",
+				}, limit)
+				return nil, tooManySessionsError
+			}
 
-					if totp.Validate(mfaAnswer[0], decryptedTOTP) {
-						verified = true
-						break
-					}
-				}
+			logger.Info("Completed basic authentication checks")
+			s.audit.Emit(AuditEvent{
+				Type:     AuditAuthSuccess,
+				Username: conn.User(),
+				Source:   conn.RemoteAddr().String(),
+			})
 
-				if !verified {
-					s.log.Warn(
-						"Incorrect MFA code",
-						zap.String("username", conn.User()))
-					return nil, badMFAError
-				}
+			// The session ID is picked now so the motd can show it
+			sessionID := uuid.NewV4().String()
+			message := s.renderMOTD(MOTDVars{
+				Username:            account.Username,
+				SessionID:           sessionID,
+				Groups:              account.Groups,
+				Destinations:        s.allowedDestinations(account),
+				Source:              conn.RemoteAddr().String(),
+				Country:             s.geoip.country(conn.RemoteAddr()),
+				CertificateValidity: certificateValidity,
+				Time:                time.Now().UTC(),
+			})
+			if message != "" {
+				client(conn.User(), message, nil, nil)
 			}
 
-			s.log.Info("Completed basic authentication checks", zap.String("username", conn.User()))
-			return nil, nil
+			return &ssh.Permissions{Extensions: map[string]string{
+				"session-uuid": sessionID,
+				"mfa-methods":  strings.Join(mfaMethods, ","),
+			}}, nil
 		},
 	}
 
-	// Load our ID-RSA private key into memory
-	privateBytes, err := ioutil.ReadFile(s.Config.IDRSAPath)
+	// Load the listeners host key into memory
+	privateBytes, err := ioutil.ReadFile(listener.HostKeyPath)
 	if err != nil {
-		log.Fatalf("Failed to load private key (%v)", s.Config.IDRSAPath)
+		log.Fatalf("Failed to load private key (%v)", listener.HostKeyPath)
 	}
 
 	// Parse the private key
@@ -269,66 +815,240 @@ func (s *SSHDState) Run() {
 
 	// Add it to our SSHD configuration
 	sshConfig.AddHostKey(private)
+	s.Config().SSHAlgorithms.apply(&sshConfig.Config)
+	return sshConfig
+}
 
-	// Open a TCP listener on the bind address requested
-	listener, err := net.Listen("tcp", s.Config.Bind)
+func (s *SSHDState) Run() {
+	// Start listening for SIGHUP (e.g. reload accounts)
+	go s.handleSignals()
+	go s.runArchivePurger()
+
+	if remote, ok := s.Config().accountStore().(*httpAccountStore); ok {
+		go s.refreshRemoteAccounts(remote)
+	}
+
+	if s.Config().WatchFiles {
+		go s.watchFiles()
+	}
+
+	// Start the HTTP API if its enabled
+	if s.Config().APIBind != "" {
+		go func() {
+			err := NewHTTPAPI(s).Run()
+			if err != nil {
+				log.Fatalf("Failed to run HTTP API: %s", err)
+			}
+		}()
+	}
+
+	// Sockets passed by systemd stay open across restarts, so prefer those
+	activated, err := systemdListeners()
 	if err != nil {
-		log.Fatalf("Failed to listen on %s: %s", s.Config.Bind, err)
+		log.Fatalf("Failed to use systemd sockets: %s", err)
 	}
 
-	// Start listening for SIGHUP (e.g. reload accounts)
-	go s.handleSignals()
+	// Open a TCP listener on every bind address requested
+	listenerConfigs := s.Config().listeners()
+	for _, listenerConfig := range listenerConfigs {
+		listener := pickSystemdListener(activated, listenerConfig.Bind, len(listenerConfigs) == 1)
+		if listener != nil {
+			log.Printf("Using systemd socket %v for %v", listener.Addr(), listenerConfig.Bind)
+		} else if listener, err = net.Listen("tcp", listenerConfig.Bind); err != nil {
+			log.Fatalf("Failed to listen on %s: %s", listenerConfig.Bind, err)
+		}
 
-	// Begin listening and accepting connections
-	log.Printf("Listening on %v", s.Config.Bind)
+		log.Printf("Listening on %v", listenerConfig.Bind)
+		s.setListenerHealth(listenerConfig.Bind, nil)
+		go s.serve(listenerConfig.Bind, listener, s.serverConfig(listenerConfig))
+	}
+
+	for name := range activated {
+		log.Printf("Ignoring systemd socket %s which matches no listener", name)
+	}
+
+	sdNotify("READY=1")
+
+	select {}
+}
+
+// Begin accepting connections on a listener
+func (s *SSHDState) serve(bind string, listener net.Listener, sshConfig *ssh.ServerConfig) {
 	for {
+		// When applying backpressure, don't accept until there is room for it
+		if s.capacity.block {
+			s.capacity.wait()
+		}
+
 		tcpConn, err := listener.Accept()
+		s.setListenerHealth(bind, err)
 		if err != nil {
 			log.Printf("Failed to accept incoming connection (%s)", err)
+			if s.capacity.block {
+				s.capacity.handshakeDone()
+				s.capacity.connectionDone()
+			}
+			continue
+		}
+
+		if !s.capacity.block && !s.capacity.tryAcquire() {
+			s.log.Warn("Rejecting connection, at capacity", zap.String("remote-addr", tcpConn.RemoteAddr().String()))
+			s.capacity.reject(tcpConn)
 			continue
 		}
 
-		go s.handleNewConnection(tcpConn, sshConfig)
+		// Drop connections from banned or overly eager sources before the handshake
+		var slots *startupSlots
+		var netblock string
+		if s.features.Enabled("rate-limiting") {
+			source := remoteIP(tcpConn.RemoteAddr())
+			allowed, banned := s.limiter.allowConnection(source)
+			if banned {
+				s.sourceBanned(source, "too many connections")
+			}
+
+			if !allowed {
+				s.dropConnection(tcpConn)
+				continue
+			}
+
+			// Hold a handshake slot for the source netblock until authentication is over
+			var free bool
+			netblock, free = s.limiter.startups.acquire(source)
+			if !free {
+				s.log.Debug("Dropping connection, no free startup slots", zap.String("netblock", netblock))
+				s.dropConnection(tcpConn)
+				continue
+			}
+			slots = s.limiter.startups
+		}
+
+		go func() {
+			defer s.reportPanics(zap.String("remote-addr", tcpConn.RemoteAddr().String()))
+
+			sshConn := s.handleNewConnection(tcpConn, sshConfig)
+			if slots != nil {
+				slots.release(netblock)
+			}
+			s.capacity.handshakeDone()
+
+			// The connection slot is held for as long as the connection is open
+			if sshConn != nil {
+				sshConn.Wait()
+			}
+			s.capacity.connectionDone()
+		}()
 	}
 }
 
-func (s *SSHDState) handleNewConnection(tcpConn net.Conn, sshConfig *ssh.ServerConfig) {
+// Closes a connection turned away before its handshake, giving back its capacity
+func (s *SSHDState) dropConnection(tcpConn net.Conn) {
+	tcpConn.Close()
+	s.capacity.handshakeDone()
+	s.capacity.connectionDone()
+}
+
+// Performs the handshake and starts the session for a new connection, returning nil if
+// the handshake or authentication failed.
+func (s *SSHDState) handleNewConnection(tcpConn net.Conn, sshConfig *ssh.ServerConfig) *ssh.ServerConn {
+	// Clients sitting at the password or MFA prompt would otherwise hold their
+	//  connection (and handshake slot) open forever.
+	if s.Config().AuthTimeout > 0 {
+		tcpConn.SetDeadline(time.Now().Add(time.Duration(s.Config().AuthTimeout) * time.Second))
+	}
+
 	// After opening the connection, attempt a handshake
 	sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, sshConfig)
 	if err != nil {
-		s.log.Warn("Failed to handshake", zap.Error(err))
-		return
+		s.log.Warn("Failed to handshake", zap.String("remote-addr", tcpConn.RemoteAddr().String()), zap.Error(err))
+		return nil
 	}
+	tcpConn.SetDeadline(time.Time{})
 
 	// Open the SSH session for the connection, and track it in our sessions mapping
 	session := NewSSHSession(s, sshConn)
-	s.sessions[session.UUID] = session
+	s.addSession(session)
+	s.stats.sessionStarted()
 
-	s.log.Info(
-		"New SSH connection",
-		zap.String("remote", sshConn.RemoteAddr().String()),
-		zap.String("version", string(sshConn.ClientVersion())))
+	s.webhooks.Notify(session.webhookEvent(WebhookSessionStart, ""))
+	s.audit.Emit(session.auditEvent(AuditSessionStart, ""))
 
-	// Discard all global out-of-band Requests
-	go ssh.DiscardRequests(reqs)
+	session.log.Info("New SSH connection")
+
+	// Global requests are only used for remote forwarding
+	go session.handleGlobalRequests(reqs)
 
 	// Run the core loop which handles channels
 	go session.handleChannels(chans)
+	return sshConn
 }
 
-// TODO: close stuff cleanly
 func (s *SSHDState) handleSignals() {
+	notify := []os.Signal{os.Interrupt, syscall.SIGTERM}
+	for _, sig := range []os.Signal{reloadSignal, reopenLogsSignal, debugSignal} {
+		if sig != nil {
+			notify = append(notify, sig)
+		}
+	}
+
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGHUP)
+	signal.Notify(signals, notify...)
 
 	go func() {
 		for {
 			sig := <-signals
 
-			if sig == syscall.SIGHUP {
+			switch sig {
+			case reloadSignal:
 				s.log.Info("Reloading accounts")
+				sdNotify("RELOADING=1")
+				s.reloadMOTD()
 				s.reloadAccounts()
+				sdNotify("READY=1")
+			case reopenLogsSignal:
+				s.reopenLogs()
+			case debugSignal:
+				s.toggleDebugLogging()
+			case os.Interrupt, syscall.SIGTERM:
+				s.Shutdown()
+				os.Exit(0)
 			}
 		}
 	}()
 }
+
+// Reopens the log file and file backed audit sinks, so logrotate can move them away
+func (s *SSHDState) reopenLogs() {
+	if s.logFile != nil {
+		if err := s.logFile.Reopen(); err != nil {
+			log.Printf("Failed to reopen log file (%s)", err)
+		}
+	}
+
+	s.audit.Reopen()
+	s.log.Info("Reopened log files")
+}
+
+// Flush any pending webhook deliveries and audit events (bounded by the configured shutdown timeout),
+// and report anything that had to be dropped.
+func (s *SSHDState) Shutdown() {
+	timeout := time.Duration(s.Config().ShutdownTimeout) * time.Second
+	s.log.Info("Shutting down", zap.Duration("timeout", timeout))
+	sdNotify("STOPPING=1")
+
+	dropped := s.webhooks.Close(timeout)
+	if dropped > 0 {
+		s.log.Error("Dropped webhook deliveries during shutdown", zap.Int("count", dropped))
+	}
+
+	if !s.alerts.Close(timeout) {
+		s.log.Error("Timed out delivering alerts during shutdown")
+	}
+
+	dropped = s.audit.Close(timeout)
+	if dropped > 0 {
+		s.log.Error("Dropped audit events during shutdown", zap.Int("count", dropped))
+	}
+
+	s.log.Sync()
+}
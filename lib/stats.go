@@ -0,0 +1,167 @@
+package bowser
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	statsBucketSize = 10 * time.Second
+	statsBucketKeep = 360
+
+	// Bounds the forward setup latencies kept per bucket
+	statsMaxLatencies = 1024
+)
+
+// The rollup windows reported by /stats
+var statsWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+}
+
+type statsBucket struct {
+	index     int64
+	sessions  int64
+	forwards  int64
+	bytes     int64
+	signs     int64
+	latencies []time.Duration
+}
+
+// Keeps an hour of activity in 10 second buckets, enough to roll up the last minute,
+// five minutes and hour for capacity planning without an external metrics system.
+type rollingStats struct {
+	// Total bytes forwarded in either direction, updated atomically while forwards
+	//  are open. Must stay first for 64-bit alignment.
+	bytes int64
+
+	lock      sync.Mutex
+	buckets   [statsBucketKeep]statsBucket
+	lastBytes int64
+}
+
+func newRollingStats() *rollingStats {
+	stats := &rollingStats{}
+	go stats.run()
+	return stats
+}
+
+// Attributes bytes forwarded since the last tick to the current bucket
+func (r *rollingStats) run() {
+	for range time.Tick(statsBucketSize) {
+		total := atomic.LoadInt64(&r.bytes)
+
+		r.lock.Lock()
+		r.bucket(time.Now()).bytes += total - r.lastBytes
+		r.lastBytes = total
+		r.lock.Unlock()
+	}
+}
+
+// Returns the bucket for the given time, must be called with the lock held
+func (r *rollingStats) bucket(now time.Time) *statsBucket {
+	index := now.UnixNano() / int64(statsBucketSize)
+	bucket := &r.buckets[index%statsBucketKeep]
+	if bucket.index != index {
+		*bucket = statsBucket{index: index}
+	}
+	return bucket
+}
+
+func (r *rollingStats) sessionStarted() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.bucket(time.Now()).sessions++
+}
+
+func (r *rollingStats) certSigned() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.bucket(time.Now()).signs++
+}
+
+// Records an opened forward along with how long it took to set up
+func (r *rollingStats) forwardOpened(latency time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	bucket := r.bucket(time.Now())
+	bucket.forwards++
+	if len(bucket.latencies) < statsMaxLatencies {
+		bucket.latencies = append(bucket.latencies, latency)
+	}
+}
+
+// Aggregates over a rollup window
+type JSONStatsWindow struct {
+	NewSessions       int64   `json:"new_sessions"`
+	ForwardsOpened    int64   `json:"forwards_opened"`
+	BytesPerSecond    float64 `json:"bytes_per_sec"`
+	CASignsPerSecond  float64 `json:"ca_signs_per_sec"`
+	ForwardSetupP99MS float64 `json:"forward_setup_p99_ms"`
+}
+
+func (r *rollingStats) window(now time.Time, duration time.Duration) JSONStatsWindow {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	current := now.UnixNano() / int64(statsBucketSize)
+	oldest := current - int64(duration/statsBucketSize)
+
+	var result JSONStatsWindow
+	var bytes, signs int64
+	var latencies []time.Duration
+	for i := range r.buckets {
+		bucket := &r.buckets[i]
+		if bucket.index <= oldest || bucket.index > current {
+			continue
+		}
+
+		result.NewSessions += bucket.sessions
+		result.ForwardsOpened += bucket.forwards
+		bytes += bucket.bytes
+		signs += bucket.signs
+		latencies = append(latencies, bucket.latencies...)
+	}
+
+	seconds := duration.Seconds()
+	result.BytesPerSecond = float64(bytes) / seconds
+	result.CASignsPerSecond = float64(signs) / seconds
+
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		index := (len(latencies)*99+99)/100 - 1
+		result.ForwardSetupP99MS = float64(latencies[index]) / float64(time.Millisecond)
+	}
+
+	return result
+}
+
+// GET /stats, rolling activity aggregates for sizing bastion hosts
+func (api *HTTPAPI) handleStats(w http.ResponseWriter, r *http.Request) {
+	sessions := api.state.listSessions()
+
+	forwards := 0
+	for _, session := range sessions {
+		forwards += len(session.active.list())
+	}
+
+	now := time.Now()
+	windows := make(map[string]JSONStatsWindow)
+	for _, window := range statsWindows {
+		windows[window.name] = api.state.stats.window(now, window.duration)
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		ActiveSessions int                        `json:"active_sessions"`
+		ActiveForwards int                        `json:"active_forwards"`
+		Windows        map[string]JSONStatsWindow `json:"windows"`
+	}{len(sessions), forwards, windows})
+}
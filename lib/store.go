@@ -0,0 +1,116 @@
+package bowser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// An accountStore is where accounts (and groups) are kept
+type accountStore interface {
+	load() (*accountsFile, error)
+
+	// Replaces every account, leaving groups untouched
+	save(accounts []Account) error
+	saveGroups(groups []Group) error
+
+	// A serialized copy of everything in the store, for backups
+	snapshot() ([]byte, error)
+}
+
+func openAccountStore(config *Config) (accountStore, error) {
+	switch config.AccountsBackend {
+	case "", "file":
+		if strings.HasPrefix(config.AccountsPath, "https://") {
+			return newHTTPAccountStore(config)
+		}
+		return fileAccountStore{path: config.AccountsPath}, nil
+	case "sql":
+		return openSQLAccountStore(config.AccountsSQL)
+	default:
+		return nil, fmt.Errorf("unknown accounts backend %s", config.AccountsBackend)
+	}
+}
+
+func (c *Config) accountStore() accountStore {
+	if c.store == nil {
+		c.store = fileAccountStore{path: c.AccountsPath}
+	}
+	return c.store
+}
+
+// Stores accounts in a json file
+type fileAccountStore struct {
+	path string
+}
+
+func (f fileAccountStore) load() (*accountsFile, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	return parseAccountsFile(data)
+}
+
+func parseAccountsFile(data []byte) (*accountsFile, error) {
+	// Older accounts files are just a list of accounts
+	var file accountsFile
+	var err error
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(data, &file.Accounts)
+	} else {
+		err = json.Unmarshal(data, &file)
+	}
+	return &file, err
+}
+
+func (f fileAccountStore) save(accounts []Account) (err error) {
+	var data []byte
+	if file, _ := f.load(); file != nil && len(file.Groups) > 0 {
+		data, err = json.MarshalIndent(accountsFile{Groups: file.Groups, Accounts: accounts}, "", "  ")
+	} else {
+		data, err = json.MarshalIndent(accounts, "", "  ")
+	}
+	if err != nil {
+		return
+	}
+
+	// TODO: consider adding sanity checks here
+
+	err = ioutil.WriteFile(f.path, data, 644)
+	return
+}
+
+func (f fileAccountStore) saveGroups(groups []Group) error {
+	file, err := f.load()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(accountsFile{Groups: groups, Accounts: file.Accounts}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f.path, data, 644)
+}
+
+// Copies the groups and accounts from an accounts file into the configured store,
+// e.g. when moving to the sql backend.
+func (c *Config) ImportAccounts(path string) error {
+	file, err := fileAccountStore{path: path}.load()
+	if err != nil {
+		return err
+	}
+
+	err = c.accountStore().save(file.Accounts)
+	if err != nil {
+		return err
+	}
+	return c.accountStore().saveGroups(file.Groups)
+}
+
+func (f fileAccountStore) snapshot() ([]byte, error) {
+	return ioutil.ReadFile(f.path)
+}
@@ -0,0 +1,211 @@
+package bowser
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Whether a config key holds something secret. Paths are never considered secret.
+func isSecretConfigKey(key string) bool {
+	key = strings.ToLower(key)
+	if strings.HasSuffix(key, "_path") {
+		return false
+	}
+
+	for _, marker := range []string{"token", "password", "secret", "webhook", "_key", "dsn"} {
+		if strings.Contains(key, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a value is a URL carrying credentials, like "postgres://user:pass@db/bowser"
+func hasURLCredentials(value string) bool {
+	parsed, err := url.Parse(value)
+	return err == nil && parsed.User != nil
+}
+
+// Replaces the values of every secret key (and URLs with credentials) in a decoded
+// json document
+func redactConfig(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, inner := range v {
+			if isSecretConfigKey(key) {
+				v[key] = "[redacted]"
+			} else {
+				v[key] = redactConfig(inner)
+			}
+		}
+	case []interface{}:
+		for i, inner := range v {
+			v[i] = redactConfig(inner)
+		}
+	case string:
+		if hasURLCredentials(v) {
+			return "[redacted]"
+		}
+	}
+	return value
+}
+
+// Loads the config file with all secret values redacted
+func redactedConfigFile(configPath string) ([]byte, error) {
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(redactConfig(raw), "", "  ")
+}
+
+// Makes an admin authenticated request against the local HTTP API
+func AdminRequest(config *Config, method, path string) ([]byte, error) {
+	return AdminRequestJSON(config, method, path, nil)
+}
+
+// Like AdminRequest, sending payload (unless nil) as the JSON request body
+func AdminRequestJSON(config *Config, method, path string, payload interface{}) ([]byte, error) {
+	scheme := "http://"
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	// The API's own certificate is trusted too, since it's likely self signed
+	if config.APITLSCertPath != "" {
+		scheme = "https://"
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if data, err := ioutil.ReadFile(config.APITLSCertPath); err == nil {
+			pool.AppendCertsFromPEM(data)
+		}
+		tlsConfig := &tls.Config{RootCAs: pool}
+
+		if config.APIClientCertPath != "" {
+			cert, err := tls.LoadX509KeyPair(config.APIClientCertPath, config.APIClientKeyPath)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, scheme+config.APIBind+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+config.APIToken)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", path, resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Writes a gzipped tarball with everything needed to debug a bowser install: build
+// info, the redacted config, and (when the HTTP API is reachable) info, runtime
+// stats, recent logs and a goroutine dump from the running daemon. Anything that
+// couldn't be collected is listed in errors.txt.
+func WriteSupportBundle(configPath string, w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+
+	var errors []string
+	add := func(name string, data []byte) error {
+		err := archive.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = archive.Write(data)
+		return err
+	}
+
+	version, _ := json.MarshalIndent(GetBuildInfo(), "", "  ")
+	if err := add("version.json", version); err != nil {
+		return err
+	}
+
+	config, err := redactedConfigFile(configPath)
+	if err != nil {
+		errors = append(errors, fmt.Sprintf("config.json: %v", err))
+	} else if err := add("config.json", config); err != nil {
+		return err
+	}
+
+	loaded, err := LoadConfig(configPath)
+	if err == nil && loaded.APIBind != "" {
+		for name, path := range map[string]string{
+			"info.json":      "/info",
+			"runtime.json":   "/debug/runtime",
+			"logs.jsonl":     "/debug/logs",
+			"goroutines.txt": "/debug/goroutines",
+		} {
+			data, err := AdminRequest(loaded, "GET", path)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("%s: %v", name, err))
+				continue
+			}
+
+			if err := add(name, data); err != nil {
+				return err
+			}
+		}
+	} else {
+		errors = append(errors, "daemon: http api is not enabled, skipped live daemon data")
+	}
+
+	if len(errors) > 0 {
+		if err := add("errors.txt", []byte(strings.Join(errors, "\n")+"\n")); err != nil {
+			return err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
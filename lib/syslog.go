@@ -0,0 +1,274 @@
+package bowser
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Configuration for shipping audit events over syslog. Format is either "rfc5424"
+// (structured data) or "cef" (ArcSight Common Event Format inside RFC5424).
+type SyslogConfig struct {
+	Network     string `json:"network"`
+	Address     string `json:"address"`
+	TLS         bool   `json:"tls"`
+	Format      string `json:"format"`
+	MinSeverity string `json:"min_severity"`
+}
+
+// The private enterprise number used for our structured data element
+const syslogSDID = "bowser@32473"
+
+// Facility 10 is authpriv
+const syslogFacility = 10
+
+type SyslogSink struct {
+	config   SyslogConfig
+	hostname string
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+func NewSyslogSink(config SyslogConfig) (*SyslogSink, error) {
+	if config.Network == "" {
+		config.Network = "udp"
+	}
+
+	if config.Format == "" {
+		config.Format = "rfc5424"
+	}
+
+	if config.Format != "rfc5424" && config.Format != "cef" {
+		return nil, fmt.Errorf("unknown syslog format %q", config.Format)
+	}
+
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+
+	return &SyslogSink{config: config, hostname: hostname}, nil
+}
+
+func (s *SyslogSink) Name() string {
+	return "syslog"
+}
+
+func (s *SyslogSink) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if s.config.TLS {
+		return tls.DialWithDialer(dialer, s.config.Network, s.config.Address, nil)
+	}
+
+	return dialer.Dial(s.config.Network, s.config.Address)
+}
+
+func (s *SyslogSink) Emit(event AuditEvent) error {
+	var message string
+	if s.config.Format == "cef" {
+		message = formatCEF(event)
+	} else {
+		message = auditSummary(event)
+	}
+
+	line := s.format(event, message)
+
+	// Stream transports need framing, we use octet counting (RFC6587)
+	if s.config.Network != "udp" {
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Try once on the current connection, and once more on a fresh one
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			s.conn, err = s.dial()
+			if err != nil {
+				return err
+			}
+		}
+
+		s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		_, err = s.conn.Write([]byte(line))
+		if err == nil {
+			return nil
+		}
+
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	return err
+}
+
+func (s *SyslogSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+// Syslog and CEF severities for our audit severities
+var syslogSeverities = map[string]int{
+	AuditSeverityInfo:     6,
+	AuditSeverityNotice:   5,
+	AuditSeverityWarning:  4,
+	AuditSeverityCritical: 2,
+}
+
+var cefSeverities = map[string]int{
+	AuditSeverityInfo:     3,
+	AuditSeverityNotice:   5,
+	AuditSeverityWarning:  7,
+	AuditSeverityCritical: 10,
+}
+
+// Builds an RFC5424 syslog line for the event
+func (s *SyslogSink) format(event AuditEvent, message string) string {
+	severity := syslogSeverities[event.Severity]
+
+	var sd bytes.Buffer
+	sd.WriteString("[" + syslogSDID)
+	for _, field := range auditFields(event) {
+		sd.WriteString(fmt.Sprintf(" %s=\"%s\"", field[0], escapeSDValue(field[1])))
+	}
+	sd.WriteString("]")
+
+	return fmt.Sprintf(
+		"<%d>1 %s %s bowser %d %s %s %s",
+		syslogFacility*8+severity,
+		event.Time.UTC().Format(time.RFC3339Nano),
+		s.hostname,
+		os.Getpid(),
+		event.Type,
+		sd.String(),
+		message,
+	)
+}
+
+// Returns the events fields as sorted key/value pairs
+func auditFields(event AuditEvent) [][2]string {
+	fields := [][2]string{{"type", event.Type}}
+
+	for _, field := range [][2]string{
+		{"severity", event.Severity},
+		{"username", event.Username},
+		{"session", event.SessionID},
+		{"source", event.Source},
+		{"country", event.Country},
+		{"destination", event.Destination},
+		{"reason", event.Reason},
+	} {
+		if field[1] != "" {
+			fields = append(fields, field)
+		}
+	}
+
+	var keys []string
+	for key := range event.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fields = append(fields, [2]string{key, event.Fields[key]})
+	}
+
+	return fields
+}
+
+// Usernames on failed logins are whatever the client sent, so line breaks are escaped
+// before they can forge records wherever messages end up line framed
+var summaryEscaper = strings.NewReplacer("\n", `\n`, "\r", `\r`)
+
+// A short human readable description of the event, on a single line
+func auditSummary(event AuditEvent) string {
+	summary := event.Type
+	if event.Username != "" {
+		summary += " user=" + event.Username
+	}
+
+	if event.Destination != "" {
+		summary += " destination=" + event.Destination
+	}
+
+	if event.Reason != "" {
+		summary += " reason=" + event.Reason
+	}
+
+	return summaryEscaper.Replace(summary)
+}
+
+func escapeSDValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+var cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+var cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+
+// Maps our audit fields onto CEF extension keys where a standard key exists
+var cefKeys = map[string]string{
+	"username":    "suser",
+	"session":     "externalId",
+	"source":      "src",
+	"destination": "dhost",
+	"reason":      "reason",
+}
+
+// Custom CEF extension keys must be alphanumeric, so we camel case our field name
+// behind a vendor prefix, e.g. key_id becomes bowserKeyId
+func cefCustomKey(field string) string {
+	key := "bowser"
+	for _, part := range strings.Split(field, "_") {
+		if part != "" {
+			key += strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return key
+}
+
+// Builds a CEF record for the event
+func formatCEF(event AuditEvent) string {
+	severity := cefSeverities[event.Severity]
+
+	var extension []string
+	extension = append(extension, fmt.Sprintf("rt=%d", event.Time.UnixNano()/int64(time.Millisecond)))
+	for _, field := range auditFields(event)[1:] {
+		key, exists := cefKeys[field[0]]
+		if !exists {
+			key = cefCustomKey(field[0])
+		}
+
+		value := field[1]
+		if key == "src" {
+			// src must be a bare IP address
+			if host, _, err := net.SplitHostPort(value); err == nil {
+				value = host
+			}
+		}
+
+		extension = append(extension, key+"="+cefExtensionEscaper.Replace(value))
+	}
+
+	return fmt.Sprintf(
+		"CEF:0|Discord|Bowser|%s|%s|%s|%d|%s",
+		cefHeaderEscaper.Replace(VERSION),
+		cefHeaderEscaper.Replace(event.Type),
+		cefHeaderEscaper.Replace(auditSummary(event)),
+		severity,
+		strings.Join(extension, " "),
+	)
+}
@@ -0,0 +1,93 @@
+package bowser
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The first file descriptor systemd passes with socket activation
+const systemdListenFDsStart = 3
+
+// Returns the sockets systemd passed us through socket activation, keyed by their
+// FileDescriptorName (which defaults to the socket unit name). Returns nothing when
+// not socket activated.
+func systemdListeners() (map[string]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// Children (e.g. git for backups) must not think the sockets are theirs
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make(map[string]net.Listener)
+	for i := 0; i < count; i++ {
+		name := strconv.Itoa(i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(systemdListenFDsStart+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		listeners[name] = listener
+	}
+
+	return listeners, nil
+}
+
+// Picks the socket activated listener for a bind address, matching on the socket's
+// FileDescriptorName or its address. A single socket is used for a single listener.
+func pickSystemdListener(listeners map[string]net.Listener, bind string, single bool) net.Listener {
+	if listener, exists := listeners[bind]; exists {
+		delete(listeners, bind)
+		return listener
+	}
+
+	for name, listener := range listeners {
+		if listener.Addr().String() == bind || (single && len(listeners) == 1) {
+			delete(listeners, name)
+			return listener
+		}
+	}
+
+	return nil
+}
+
+// Reports a state change (e.g. READY=1) to systemd when running as a Type=notify
+// service, does nothing otherwise.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	// Abstract namespace sockets are passed with a leading @
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,222 @@
+package bowser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Configuration for a Microsoft Teams provider posting Adaptive Cards to an incoming
+// webhook (or a Workflows webhook). Events limits which event types are sent (all of
+// them when empty) and APIURL is used to link sessions from cards.
+//
+// Cards posted through webhooks can only open URLs, and terminating a session needs
+// an admin token, so the terminate action opens TerminateURL instead, e.g. an internal
+// tool calling DELETE /sessions/<id>. {session_id} in it is replaced by the session.
+//
+// Templates replace the card's title and facts with a single block of (markdown)
+// text, the actions are kept.
+type TeamsConfig struct {
+	WebhookURL   string            `json:"webhook_url"`
+	Events       []string          `json:"events"`
+	APIURL       string            `json:"api_url"`
+	TerminateURL string            `json:"terminate_url"`
+	Templates    map[string]string `json:"templates"`
+}
+
+type TeamsWebhookProvider struct {
+	Config TeamsConfig
+
+	templates notificationTemplates
+}
+
+type teamsMessage struct {
+	Type        string            `json:"type"`
+	Attachments []teamsAttachment `json:"attachments"`
+}
+
+type teamsAttachment struct {
+	ContentType string    `json:"contentType"`
+	Content     teamsCard `json:"content"`
+}
+
+type teamsCard struct {
+	Schema  string                   `json:"$schema"`
+	Type    string                   `json:"type"`
+	Version string                   `json:"version"`
+	Body    []map[string]interface{} `json:"body"`
+	Actions []map[string]interface{} `json:"actions,omitempty"`
+	MSTeams map[string]interface{}   `json:"msteams,omitempty"`
+}
+
+type teamsFact struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+func (t TeamsWebhookProvider) PlatformName() string {
+	return "teams"
+}
+
+func (t TeamsWebhookProvider) wants(eventType string) bool {
+	if len(t.Config.Events) == 0 {
+		return true
+	}
+
+	for _, wanted := range t.Config.Events {
+		if wanted == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (t TeamsWebhookProvider) Notify(event WebhookEvent) error {
+	if !t.wants(event.Type) {
+		return nil
+	}
+
+	var title, color string
+	switch event.Type {
+	case WebhookSessionStart:
+		title, color = fmt.Sprintf("%s connected", event.Username), "accent"
+	case WebhookSessionEnd:
+		title, color = fmt.Sprintf("%s disconnected", event.Username), "accent"
+	case WebhookForwardOpen:
+		title, color = fmt.Sprintf("%s@%s", event.Username, event.Destination), "good"
+	case WebhookForwardClose:
+		title, color = fmt.Sprintf("%s@%s closed", event.Username, event.Destination), "default"
+	case WebhookRemoteForwardOpen:
+		title, color = fmt.Sprintf("%s exposed %s", event.Username, event.Destination), "good"
+	case WebhookRemoteForwardClose:
+		title, color = fmt.Sprintf("%s closed %s", event.Username, event.Destination), "default"
+	case WebhookACLReject:
+		title, color = fmt.Sprintf("%s was denied access to %s", event.Username, event.Destination), "warning"
+	case WebhookMFAFailure:
+		title, color = fmt.Sprintf("%s failed MFA", event.Username), "attention"
+	case WebhookSourceBanned:
+		title, color = fmt.Sprintf("%s was temporarily banned", event.Source), "attention"
+	default:
+		return nil
+	}
+
+	card := teamsCard{
+		Schema:  "http://adaptivecards.io/schemas/adaptive-card.json",
+		Type:    "AdaptiveCard",
+		Version: "1.4",
+	}
+
+	var facts []teamsFact
+	if platformID := event.PlatformIDs[t.PlatformName()]; platformID != "" {
+		mention := fmt.Sprintf("<at>%s</at>", event.Username)
+		facts = append(facts, teamsFact{"User", mention})
+		card.MSTeams = map[string]interface{}{
+			"entities": []map[string]interface{}{{
+				"type":      "mention",
+				"text":      mention,
+				"mentioned": map[string]string{"id": platformID, "name": event.Username},
+			}},
+		}
+	} else if event.Username != "" {
+		facts = append(facts, teamsFact{"User", event.Username})
+	}
+
+	if event.Destination != "" {
+		facts = append(facts, teamsFact{"Host", event.Destination})
+	}
+
+	if event.Country != "" {
+		facts = append(facts, teamsFact{"Source", fmt.Sprintf("%s (%s)", event.Source, event.Country)})
+	} else {
+		facts = append(facts, teamsFact{"Source", event.Source})
+	}
+
+	if event.SessionID != "" {
+		facts = append(facts, teamsFact{"Session", event.SessionID})
+	}
+
+	if event.Reason != "" {
+		facts = append(facts, teamsFact{"Reason", event.Reason})
+	}
+
+	if event.Type == WebhookSessionEnd || event.Type == WebhookForwardClose || event.Type == WebhookRemoteForwardClose {
+		facts = append(facts, teamsFact{"Duration", event.Duration.String()})
+		facts = append(facts, teamsFact{"Transferred", fmt.Sprintf("%d bytes sent, %d bytes received", event.BytesSent, event.BytesReceived)})
+	}
+
+	if len(event.Traffic) > 0 {
+		for _, entry := range event.Traffic {
+			facts = append(facts, teamsFact{entry.Destination, fmt.Sprintf("%d bytes sent, %d bytes received", entry.BytesSent, entry.BytesReceived)})
+		}
+	} else if len(event.Destinations) > 0 {
+		facts = append(facts, teamsFact{"Destinations", strings.Join(event.Destinations, ", ")})
+	}
+
+	card.Body = []map[string]interface{}{
+		{"type": "TextBlock", "text": title, "weight": "bolder", "size": "medium", "color": color, "wrap": true},
+		{"type": "FactSet", "facts": facts},
+	}
+
+	if text, templated, err := t.templates.render(event, t.PlatformName()); templated {
+		if err != nil {
+			return err
+		}
+		card.Body = []map[string]interface{}{{"type": "TextBlock", "text": text, "wrap": true}}
+		card.MSTeams = nil
+	}
+
+	if event.SessionID != "" {
+		if apiURL := strings.TrimRight(t.Config.APIURL, "/"); apiURL != "" {
+			card.Actions = append(card.Actions, map[string]interface{}{
+				"type":  "Action.OpenUrl",
+				"title": "View session",
+				"url":   fmt.Sprintf("%s/sessions/%s", apiURL, event.SessionID),
+			})
+		}
+
+		// Only sessions which are still open can be terminated
+		if t.Config.TerminateURL != "" && event.Type != WebhookSessionEnd {
+			card.Actions = append(card.Actions, map[string]interface{}{
+				"type":  "Action.OpenUrl",
+				"title": "Terminate session",
+				"url":   strings.Replace(t.Config.TerminateURL, "{session_id}", event.SessionID, -1),
+			})
+		}
+	}
+
+	return t.send(teamsMessage{
+		Type: "message",
+		Attachments: []teamsAttachment{{
+			ContentType: "application/vnd.microsoft.card.adaptive",
+			Content:     card,
+		}},
+	})
+}
+
+func (t TeamsWebhookProvider) send(message teamsMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", t.Config.WebhookURL, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("teams returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package bowser
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// Sealed TOTP secrets are the usual password encrypted value, encrypted again with
+// the TOTP master key and bound to the account's username
+const sealedTOTPPrefix = "sealed:"
+
+var totpMasterKeyMissingError = fmt.Errorf("totp secret is sealed but no totp master key is configured")
+
+func isSealedTOTP(value string) bool {
+	return strings.HasPrefix(value, sealedTOTPPrefix)
+}
+
+// Loads the master key, either given directly or as a data key encrypted by KMS
+func (c TOTPConfig) masterKey() ([]byte, error) {
+	if c.MasterKey != "" && c.KMSDataKey != "" {
+		return nil, fmt.Errorf("totp master_key and kms_data_key can't both be set")
+	}
+
+	var key []byte
+	switch {
+	case c.MasterKey != "":
+		decoded, err := base64.StdEncoding.DecodeString(c.MasterKey)
+		if err != nil {
+			return nil, fmt.Errorf("totp master_key must be 32 base64 encoded bytes")
+		}
+		key = decoded
+	case c.KMSDataKey != "":
+		blob, err := base64.StdEncoding.DecodeString(c.KMSDataKey)
+		if err != nil {
+			return nil, fmt.Errorf("totp kms_data_key must be base64 encoded")
+		}
+
+		awsConfig := aws.NewConfig()
+		if c.KMSRegion != "" {
+			awsConfig = awsConfig.WithRegion(c.KMSRegion)
+		}
+
+		sess, err := session.NewSession(awsConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		output, err := kms.New(sess).Decrypt(&kms.DecryptInput{CiphertextBlob: blob})
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt totp kms_data_key: %v", err)
+		}
+		key = output.Plaintext
+	default:
+		return nil, nil
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("totp master key must be 32 bytes")
+	}
+	return key, nil
+}
+
+func totpGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seals a TOTP secret with the master key, leaving it alone when there's no key or
+// it's already sealed or stored in the secrets backend
+func (c *Config) sealTOTP(username, value string) (string, error) {
+	if c.totpKey == nil || value == "" || isSealedTOTP(value) || strings.HasPrefix(value, secretReferencePrefix) {
+		return value, nil
+	}
+
+	gcm, err := totpGCM(c.totpKey)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(value), []byte(username))
+	return sealedTOTPPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Opens a sealed TOTP secret, returning unsealed values unchanged
+func (c *Config) unsealTOTP(username, value string) (string, error) {
+	if !isSealedTOTP(value) {
+		return value, nil
+	}
+
+	if c.totpKey == nil {
+		return "", totpMasterKeyMissingError
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, sealedTOTPPrefix))
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := totpGCM(c.totpKey)
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("sealed totp secret is too short")
+	}
+
+	opened, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(username))
+	if err != nil {
+		return "", fmt.Errorf("failed to unseal totp secret: %v", err)
+	}
+	return string(opened), nil
+}
+
+// Returns copies of the accounts with every TOTP secret sealed, along with how many
+// weren't sealed before
+func (c *Config) sealAccounts(accounts []Account) ([]Account, int, error) {
+	if c.totpKey == nil {
+		return accounts, 0, nil
+	}
+
+	sealed := make([]Account, len(accounts))
+	copy(sealed, accounts)
+
+	count := 0
+	for i := range sealed {
+		account := &sealed[i]
+		value, err := c.sealTOTP(account.Username, account.MFA.TOTP)
+		if err != nil {
+			return nil, 0, fmt.Errorf("account %s: %v", account.Username, err)
+		}
+
+		if value != account.MFA.TOTP {
+			account.MFA.TOTP = value
+			count++
+		}
+	}
+	return sealed, count, nil
+}
+
+// Seals every TOTP secret in the accounts backend which isn't already, returning how
+// many were sealed
+func (c *Config) SealTOTPSecrets() (int, error) {
+	if c.totpKey == nil {
+		return 0, fmt.Errorf("no totp master key is configured")
+	}
+
+	accounts, err := c.LoadAccounts()
+	if err != nil {
+		return 0, err
+	}
+
+	_, count, err := c.sealAccounts(accounts)
+	if err != nil || count == 0 {
+		return 0, err
+	}
+	return count, c.SaveAccounts(accounts)
+}
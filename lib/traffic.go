@@ -0,0 +1,100 @@
+package bowser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Bytes moved to and from one destination over all of a session's forwards to it
+type DestinationTraffic struct {
+	Destination   string `json:"destination"`
+	Forwards      int64  `json:"forwards"`
+	BytesSent     int64  `json:"bytes_sent"`
+	BytesReceived int64  `json:"bytes_received"`
+}
+
+type trafficCounts struct {
+	forwards int64
+	sent     int64
+	received int64
+}
+
+// Totals of closed forwards by some key, e.g. destination or username. The zero
+// value is ready to use.
+type trafficTotals struct {
+	lock   sync.Mutex
+	totals map[string]*trafficCounts
+}
+
+func (t *trafficTotals) add(key string, sent, received int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.totals == nil {
+		t.totals = make(map[string]*trafficCounts)
+	}
+
+	counts, exists := t.totals[key]
+	if !exists {
+		counts = &trafficCounts{}
+		t.totals[key] = counts
+	}
+	counts.forwards++
+	counts.sent += sent
+	counts.received += received
+}
+
+func (t *trafficTotals) snapshot() map[string]trafficCounts {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	snapshot := make(map[string]trafficCounts, len(t.totals))
+	for key, counts := range t.totals {
+		snapshot[key] = *counts
+	}
+	return snapshot
+}
+
+// Adds a closed forward to the session's and the bastion's traffic totals
+func (s *SSHSession) recordTraffic(destination string, sent, received int64) {
+	s.traffic.add(destination, sent, received)
+	s.State.destinationTraffic.add(destination, sent, received)
+	s.State.accountTraffic.add(s.Account().Username, sent, received)
+}
+
+// Returns the session's traffic per destination, for closed and open forwards
+func (s *SSHSession) trafficByDestination() []DestinationTraffic {
+	totals := s.traffic.snapshot()
+	for _, forward := range s.active.list() {
+		counts := totals[forward.Destination]
+		counts.forwards++
+		counts.sent += atomic.LoadInt64(&forward.bytesSent)
+		counts.received += atomic.LoadInt64(&forward.bytesReceived)
+		totals[forward.Destination] = counts
+	}
+
+	traffic := []DestinationTraffic{}
+	for destination, counts := range totals {
+		traffic = append(traffic, DestinationTraffic{
+			Destination:   destination,
+			Forwards:      counts.forwards,
+			BytesSent:     counts.sent,
+			BytesReceived: counts.received,
+		})
+	}
+
+	sort.Slice(traffic, func(i, j int) bool { return traffic[i].Destination < traffic[j].Destination })
+	return traffic
+}
+
+// Formats traffic for notifications, one destination per line
+func formatTraffic(traffic []DestinationTraffic) string {
+	lines := make([]string, 0, len(traffic))
+	for _, entry := range traffic {
+		lines = append(lines, fmt.Sprintf("%s: %d bytes sent, %d bytes received", entry.Destination, entry.BytesSent, entry.BytesReceived))
+	}
+	return strings.Join(lines, "\n")
+}
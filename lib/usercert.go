@@ -0,0 +1,184 @@
+package bowser
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+var untrustedUserCAError = fmt.Errorf("certificate is not signed by a trusted user ca")
+
+// The external CAs whose user certificates are accepted in place of an account's
+// keys. A certificate logs in as an account when one of its principals, after
+// mapping through user_ca_principals, is the account's username.
+type userCertAuthorities struct {
+	keys       map[string]bool
+	principals map[string]string
+	revoked    *parsedKRL
+	checker    *ssh.CertChecker
+}
+
+func (c *Config) loadUserCertAuthorities() (*userCertAuthorities, error) {
+	if c.TrustedUserCAKeysPath == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(c.TrustedUserCAKeysPath)
+	if err != nil {
+		return nil, err
+	}
+
+	authorities := &userCertAuthorities{
+		keys:       make(map[string]bool),
+		principals: c.UserCAPrincipals,
+	}
+
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", c.TrustedUserCAKeysPath, err)
+		}
+		authorities.keys[string(key.Marshal())] = true
+		data = rest
+	}
+
+	if len(authorities.keys) == 0 {
+		return nil, fmt.Errorf("%s contains no keys", c.TrustedUserCAKeysPath)
+	}
+
+	if c.RevokedUserKeysPath != "" {
+		authorities.revoked, err = loadKRL(c.RevokedUserKeysPath)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", c.RevokedUserKeysPath, err)
+		}
+	}
+
+	authorities.checker = &ssh.CertChecker{
+		SupportedCriticalOptions: []string{"source-address"},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return authorities.revoked != nil && authorities.revoked.revoked(cert)
+		},
+	}
+	return authorities, nil
+}
+
+// Checks a certificate may log in as username from the given address, returning the
+// principal that matched it
+func (u *userCertAuthorities) check(cert *ssh.Certificate, username string, source net.Addr) (string, error) {
+	if cert.CertType != ssh.UserCert || !u.keys[string(cert.SignatureKey.Marshal())] {
+		return "", untrustedUserCAError
+	}
+
+	// CertChecker treats a certificate without principals as valid for all of them
+	if len(cert.ValidPrincipals) == 0 {
+		return "", fmt.Errorf("certificate has no principals")
+	}
+
+	var principal string
+	for _, candidate := range cert.ValidPrincipals {
+		mapped, exists := u.principals[candidate]
+		if !exists {
+			mapped = candidate
+		}
+
+		if mapped == username {
+			principal = candidate
+			break
+		}
+	}
+
+	if principal == "" {
+		return "", fmt.Errorf("no certificate principal maps to %s", username)
+	}
+
+	if err := u.checker.CheckCert(principal, cert); err != nil {
+		return "", err
+	}
+
+	if allowed, exists := cert.CriticalOptions["source-address"]; exists && !sourceAddressAllowed(allowed, source) {
+		return "", fmt.Errorf("certificate does not allow connections from %s", source)
+	}
+	return principal, nil
+}
+
+// Matches an address against a certificate's comma separated source-address list
+func sourceAddressAllowed(allowed string, source net.Addr) bool {
+	ip := net.ParseIP(remoteIP(source))
+	if ip == nil {
+		return false
+	}
+
+	for _, entry := range strings.Split(allowed, ",") {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			if ip.Equal(net.ParseIP(entry)) {
+				return true
+			}
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds the account a user certificate authenticates, logging why it doesn't
+func (s *SSHDState) certificateAccount(conn ssh.ConnMetadata, cert *ssh.Certificate, logger *zap.Logger) *Account {
+	authorities := s.trustedUserCAs()
+	if authorities == nil {
+		return nil
+	}
+
+	principal, err := authorities.check(cert, conn.User(), conn.RemoteAddr())
+	if err != nil {
+		logger.Warn(
+			"Rejecting user certificate",
+			zap.String("key-id", cert.KeyId),
+			zap.Uint64("serial", cert.Serial),
+			zap.Error(err))
+		return nil
+	}
+
+	accounts, _ := s.accountSet()
+	account, exists := accounts[conn.User()]
+	if !exists {
+		logger.Warn("Rejecting user certificate for unknown account", zap.String("key-id", cert.KeyId))
+		return nil
+	}
+
+	logger.Info(
+		"Accepted user certificate",
+		zap.String("key-id", cert.KeyId),
+		zap.Uint64("serial", cert.Serial),
+		zap.String("principal", principal))
+	return account
+}
+
+// Re-reads the trusted user CAs and their revocation list
+func (s *SSHDState) reloadUserCAs() error {
+	authorities, err := s.Config().loadUserCertAuthorities()
+	if err != nil {
+		s.log.Error("Failed to load trusted user cas", zap.Error(err))
+		return err
+	}
+
+	s.liveLock.Lock()
+	s.userCAs = authorities
+	s.liveLock.Unlock()
+	return nil
+}
+
+// Returns the trusted user CAs, nil when there are none
+func (s *SSHDState) trustedUserCAs() *userCertAuthorities {
+	s.liveLock.RLock()
+	defer s.liveLock.RUnlock()
+	return s.userCAs
+}
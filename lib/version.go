@@ -0,0 +1,28 @@
+package bowser
+
+import (
+	"runtime"
+)
+
+// These are set at build time with -ldflags "-X github.com/b1naryth1ef/bowser/lib.GitCommit=..."
+var (
+	GitCommit = "unknown"
+	BuildDate = "unknown"
+)
+
+// BuildInfo describes the running binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+func GetBuildInfo() BuildInfo {
+	return BuildInfo{
+		Version:   VERSION,
+		GitCommit: GitCommit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+}
@@ -0,0 +1,170 @@
+package bowser
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// Config settings which are applied as soon as the config file changes. Everything
+// else is only picked up by a restart.
+var liveConfigFields = map[string]bool{
+	"hosts":                      true,
+	"identities":                 true,
+	"deny_networks":              true,
+	"force_user":                 true,
+	"force_command":              true,
+	"permitted_source_addresses": true,
+	"max_sessions_per_account":   true,
+	"max_forwards_per_session":   true,
+	"discord_webhooks":           true,
+	"slack_webhooks":             true,
+	"discord":                    true,
+	"teams":                      true,
+	"motd":                       true,
+	"motd_path":                  true,
+	"capture":                    true,
+	"recording":                  true,
+	"auth_timeout":               true,
+	"bandwidth":                  true,
+	"aliases":                    true,
+}
+
+// Waits this long for bursts of events (editors often write files in several steps)
+// to settle before reloading
+const watchDebounce = 500 * time.Millisecond
+
+// Watches the config, accounts and motd files, reloading whatever changed. The
+// directories are watched rather than the files, since editors and config management
+// usually replace files instead of writing to them.
+func (s *SSHDState) watchFiles() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		s.log.Error("Failed to watch config files", zap.Error(err))
+		return
+	}
+	defer watcher.Close()
+
+	files := map[string]func(){
+		s.configPath: s.reloadConfig,
+	}
+	if store, ok := s.Config().accountStore().(fileAccountStore); ok {
+		files[store.path] = func() {
+			s.log.Info("Accounts file changed, reloading accounts")
+			s.reloadAccounts()
+		}
+	}
+	if s.Config().MOTDPath != "" {
+		files[s.Config().MOTDPath] = func() { s.reloadMOTD() }
+	}
+
+	watched := make(map[string]func())
+	for path, reload := range files {
+		path, _ = filepath.Abs(path)
+		watched[path] = reload
+
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			s.log.Error("Failed to watch file", zap.String("path", path), zap.Error(err))
+		}
+	}
+
+	pending := make(map[string]bool)
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			path, _ := filepath.Abs(event.Name)
+			if _, exists := watched[path]; exists && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				pending[path] = true
+				timer.Reset(watchDebounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			s.log.Warn("Error watching config files", zap.Error(err))
+		case <-timer.C:
+			for path := range pending {
+				watched[path]()
+				delete(pending, path)
+			}
+		}
+	}
+}
+
+// Applies the live settings of the config file, logging which fields changed and
+// which of them need a restart
+func (s *SSHDState) reloadConfig() {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	loaded, err := LoadConfig(s.configPath)
+	if err != nil {
+		s.log.Error("Failed to reload config", zap.Error(err))
+		return
+	}
+
+	previous := s.Config()
+	updated := *previous
+	current := reflect.ValueOf(previous).Elem()
+	next := reflect.ValueOf(loaded).Elem()
+	target := reflect.ValueOf(&updated).Elem()
+
+	var applied, restart []string
+	for i := 0; i < current.NumField(); i++ {
+		field := current.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || reflect.DeepEqual(current.Field(i).Interface(), next.Field(i).Interface()) {
+			continue
+		}
+
+		if liveConfigFields[name] {
+			target.Field(i).Set(next.Field(i))
+			applied = append(applied, name)
+		} else {
+			restart = append(restart, name)
+		}
+	}
+
+	if len(applied) == 0 && len(restart) == 0 {
+		return
+	}
+
+	if len(restart) > 0 {
+		s.log.Warn("Config changes need a restart to apply", zap.Strings("fields", restart))
+	}
+
+	if len(applied) == 0 {
+		return
+	}
+
+	// Recomputes derived settings like deny networks
+	if err := updated.validate(); err != nil {
+		s.log.Error("Failed to reload config", zap.Error(err))
+		return
+	}
+
+	providers := webhookProviders(&updated)
+
+	s.liveLock.Lock()
+	s.config = &updated
+	s.aclCache = newACLCache(updated.ACLCacheSize)
+	s.WebhookProviders = providers
+	s.liveLock.Unlock()
+
+	s.reloadMOTD()
+	s.webhooks.setProviders(providers)
+
+	s.log.Info("Reloaded config", zap.Strings("fields", applied))
+	s.audit.Emit(AuditEvent{Type: AuditAdminAction, Reason: "config reloaded: " + strings.Join(applied, ", ")})
+}
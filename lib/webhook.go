@@ -1,72 +1,149 @@
 package bowser
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"net/http"
-	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
 )
 
-type MessagePayload struct {
-	Embeds []Embed `json:"embeds"`
-}
+// The types of events webhook providers can be notified about
+const (
+	WebhookSessionStart = "session_start"
+	WebhookSessionEnd   = "session_end"
+	WebhookForwardOpen  = "forward_open"
+	WebhookForwardClose = "forward_close"
+	WebhookACLReject    = "acl_reject"
+	WebhookMFAFailure   = "mfa_failure"
+	WebhookSourceBanned = "source_banned"
+
+	WebhookRemoteForwardOpen  = "remote_forward_open"
+	WebhookRemoteForwardClose = "remote_forward_close"
+)
+
+// A WebhookEvent describes something that happened which providers may want to
+// notify about. Providers are free to ignore event types they don't handle.
+type WebhookEvent struct {
+	Type        string
+	Username    string
+	PlatformIDs map[string]string
+	SessionID   string
+	Destination string
+	Source      string
+	Country     string
+	Reason      string
+	Time        time.Time
 
-type Embed struct {
-	Title       string `json:"title"`
-	Description string `json:"description"`
-	URL         string `json:"url"`
-	Color       uint   `json:"color"`
+	// Only set for session_end and forward_close events. Bytes are counted from the
+	//  users point of view, sent is data going to destinations.
+	Duration      time.Duration
+	BytesSent     int64
+	BytesReceived int64
+	Destinations  []string
+
+	// Only set for session_end events, the traffic to each destination visited
+	Traffic []DestinationTraffic
 }
 
 type WebhookProvider interface {
-	NotifySessionStart(platformID, username, sessionID, proxyHost, sourceHost string) error
+	Notify(event WebhookEvent) error
 	PlatformName() string
 }
 
-type DiscordWebhookProvider struct {
-	URL string
+type webhookJob struct {
+	provider WebhookProvider
+	event    WebhookEvent
 }
 
-func (d DiscordWebhookProvider) PlatformName() string {
-	return "discord"
+// WebhookQueue delivers webhook notifications from a background worker, so slow
+// providers never block a forward, and can be flushed when the daemon shuts down.
+type WebhookQueue struct {
+	providers []WebhookProvider
+	jobs      chan webhookJob
+	done      chan struct{}
+	log       *zap.Logger
+
+	lock    sync.Mutex
+	closed  bool
+	dropped int
 }
 
-func (d DiscordWebhookProvider) send(payload MessagePayload) (err error) {
-	data, err := json.Marshal(payload)
-	if err != nil {
-		return
+func NewWebhookQueue(providers []WebhookProvider, size int, log *zap.Logger) *WebhookQueue {
+	q := &WebhookQueue{
+		providers: providers,
+		jobs:      make(chan webhookJob, size),
+		done:      make(chan struct{}),
+		log:       log,
 	}
 
-	req, err := http.NewRequest("POST", d.URL, bytes.NewBuffer(data))
-	if err != nil {
-		return err
-	}
+	go q.run()
+	return q
+}
 
-	req.Header.Set("Content-Type", "application/json")
+func (q *WebhookQueue) run() {
+	defer close(q.done)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	defer resp.Body.Close()
-	return err
+	for job := range q.jobs {
+		err := job.provider.Notify(job.event)
+		if err != nil {
+			q.log.Warn(
+				"Failed to deliver webhook",
+				zap.String("platform", job.provider.PlatformName()),
+				zap.String("type", job.event.Type),
+				zap.Error(err))
+		}
+	}
 }
 
-func (d DiscordWebhookProvider) NotifySessionStart(platformID, username, sessionID, proxyHost, sourceHost string) error {
-	var desc []string
+// Replaces the providers events are delivered to, e.g. after a config reload
+func (q *WebhookQueue) setProviders(providers []WebhookProvider) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.providers = providers
+}
 
-	if platformID != "" {
-		desc = append(desc, fmt.Sprintf("**User:** <@%s>", platformID))
-	} else {
-		desc = append(desc, fmt.Sprintf("**User:** %s", username))
+// Queue an event for delivery to every provider. If the queue is full (or already
+// closed) the event is dropped rather than blocking the caller.
+func (q *WebhookQueue) Notify(event WebhookEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
 	}
 
-	desc = append(desc, fmt.Sprintf("**Host:** %s", proxyHost))
-	desc = append(desc, fmt.Sprintf("**Source:** %s", sourceHost))
-	desc = append(desc, fmt.Sprintf("**Session:** %s", sessionID))
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, provider := range q.providers {
+		if q.closed {
+			q.dropped++
+			continue
+		}
+
+		select {
+		case q.jobs <- webhookJob{provider: provider, event: event}:
+		default:
+			q.dropped++
+			q.log.Warn("Dropping webhook, queue is full", zap.String("platform", provider.PlatformName()))
+		}
+	}
+}
+
+// Stop accepting new notifications and wait up to timeout for queued ones to be
+// delivered. Returns the number of notifications that were dropped over the
+// lifetime of the queue, including any still queued when the timeout expired.
+func (q *WebhookQueue) Close(timeout time.Duration) int {
+	q.lock.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.lock.Unlock()
+
+	select {
+	case <-q.done:
+	case <-time.After(timeout):
+	}
 
-	return d.send(MessagePayload{Embeds: []Embed{Embed{
-		Title:       fmt.Sprintf("%s@%s", username, proxyHost),
-		Description: strings.Join(desc, "\n"),
-		Color:       7855479,
-	}}})
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.dropped + len(q.jobs)
 }
@@ -0,0 +1,178 @@
+package bowser
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const yubiCloudURL = "https://api.yubico.com/wsapi/2.0/verify"
+
+// Yubico OTPs are encoded in modhex, the trailing 32 characters are the encrypted
+// token and anything before it is the keys public ID.
+const yubikeyModhex = "cbdefghijklnrtuv"
+const yubikeyTokenLength = 32
+
+var yubikeyReplayedError = fmt.Errorf("yubikey otp was already used")
+
+// Configuration for validating Yubico OTPs, against YubiCloud by default or a list
+// of self-hosted validation servers. The secret key is the base64 API key used to
+// sign requests and verify responses.
+type YubicoConfig struct {
+	ClientID  string   `json:"client_id"`
+	SecretKey string   `json:"secret_key"`
+	URLs      []string `json:"urls"`
+}
+
+type yubicoClient struct {
+	config YubicoConfig
+	key    []byte
+	http   *http.Client
+}
+
+func newYubicoClient(config YubicoConfig) (*yubicoClient, error) {
+	if len(config.URLs) == 0 {
+		config.URLs = []string{yubiCloudURL}
+	}
+
+	key, err := base64.StdEncoding.DecodeString(config.SecretKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid yubico secret key: %v", err)
+	}
+
+	return &yubicoClient{
+		config: config,
+		key:    key,
+		http:   &http.Client{Timeout: 5 * time.Second},
+	}, nil
+}
+
+// Returns the public ID of a Yubico OTP, or an empty string if the value does not
+// look like one.
+func YubikeyPublicID(otp string) string {
+	if len(otp) <= yubikeyTokenLength || len(otp) > yubikeyTokenLength+16 {
+		return ""
+	}
+
+	for _, c := range otp {
+		if !strings.ContainsRune(yubikeyModhex, c) {
+			return ""
+		}
+	}
+
+	return otp[:len(otp)-yubikeyTokenLength]
+}
+
+// Checks whether an OTP belongs to one of the accounts registered keys
+func (am *AccountMFA) hasYubikey(otp string) bool {
+	publicID := YubikeyPublicID(otp)
+	if publicID == "" {
+		return false
+	}
+
+	for _, id := range am.YubiKeys {
+		if id == publicID {
+			return true
+		}
+	}
+	return false
+}
+
+// Signs a set of parameters as described by the Yubico validation protocol, the
+// sorted key=value pairs are joined without url encoding.
+func (y *yubicoClient) sign(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		if key != "h" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + params[key]
+	}
+
+	mac := hmac.New(sha1.New, y.key)
+	mac.Write([]byte(strings.Join(pairs, "&")))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Validates an OTP, trying each configured server until one gives an answer
+func (y *yubicoClient) verify(otp string) (err error) {
+	raw := make([]byte, 16)
+	if _, err = rand.Read(raw); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(raw)
+
+	params := map[string]string{
+		"id":    y.config.ClientID,
+		"otp":   otp,
+		"nonce": nonce,
+	}
+	if len(y.key) > 0 {
+		params["h"] = y.sign(params)
+	}
+
+	query := url.Values{}
+	for key, value := range params {
+		query.Set(key, value)
+	}
+
+	for _, server := range y.config.URLs {
+		err = y.verifyWith(server+"?"+query.Encode(), otp, nonce)
+		if err == nil || err == yubikeyReplayedError {
+			return err
+		}
+	}
+
+	return err
+}
+
+func (y *yubicoClient) verifyWith(url, otp, nonce string) error {
+	resp, err := y.http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	response := make(map[string]string)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(parts) == 2 {
+			response[parts[0]] = parts[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(y.key) > 0 && !hmac.Equal([]byte(response["h"]), []byte(y.sign(response))) {
+		return fmt.Errorf("yubico response has an invalid signature")
+	}
+
+	if response["otp"] != otp || response["nonce"] != nonce {
+		return fmt.Errorf("yubico response does not match request")
+	}
+
+	switch response["status"] {
+	case "OK":
+		return nil
+	case "REPLAYED_OTP":
+		return yubikeyReplayedError
+	default:
+		return fmt.Errorf("yubico validation failed: %s", response["status"])
+	}
+}
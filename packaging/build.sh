@@ -11,15 +11,20 @@ pushd build
 # Create build folders for package
 mkdir -p usr/bin
 mkdir -p etc
+mkdir -p lib/systemd/system
 
 # Build bowse
-go build ../../cmd/bowser/bowser.go
+LDFLAGS="-X github.com/b1naryth1ef/bowser/lib.GitCommit=$(git rev-parse --short HEAD) -X github.com/b1naryth1ef/bowser/lib.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+go build -ldflags "$LDFLAGS" ../../cmd/bowser/bowser.go
 go build ../../cmd/bowser-create-account/bowser-create-account.go
+go build ../../cmd/bowser-admin/bowser-admin.go
 
 # Copy files in place
 mv bowser usr/bin/
 mv bowser-create-account usr/bin/
+mv bowser-admin usr/bin/
 cp -r bowser etc/
+cp ../systemd/bowser.socket ../systemd/bowser.service lib/systemd/system/
 
 popd
 